@@ -24,6 +24,7 @@ import (
 
 	"bramp.net/myip/lib/conf"
 	"bramp.net/myip/lib/myip"
+	"bramp.net/myip/lib/rdap"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
@@ -66,6 +67,11 @@ var prodConfig = &conf.Config{
 }
 
 var appengineDefaultConfig = &conf.Config{
+	// Requests arrive from Google's front end, over a link-local address, which appends the
+	// client's address to X-Forwarded-For. Load balancers' front ends also use Google's ranges.
+	TrustedProxies: []string{"169.254.0.0/16", "35.191.0.0/16", "130.211.0.0/22"},
+	ProxyHeader:    "X-Forwarded-For",
+
 	RequestIDHeader: "X-Cloud-Trace-Context",
 	LatLongHeader:   "X-Appengine-Citylatlong",
 	CityHeader:      "X-Appengine-City",
@@ -104,9 +110,6 @@ func main() {
 
 	// IsAppEngine tests if running on AppEngine
 	if appengine.IsAppEngine() {
-		// ProxyHeaders takes X-Forwarded Headers and populates the request with this information.
-		r.Use(handlers.ProxyHeaders)
-
 		// Warmup handler
 		r.HandleFunc("/_ah/warmup", func(w http.ResponseWriter, r *http.Request) {
 			log.Println("warmup done")
@@ -115,7 +118,18 @@ func main() {
 
 	config := config()
 
-	myip.Register(r, config)
+	rdap.DefaultBootstrap.Dir = config.RDAPBootstrapDir
+	rdap.DefaultBootstrap.Offline = config.RDAPBootstrapOffline
+	if config.DisableRDAPHierarchy {
+		rdap.MaxParents = 0
+	}
+	go rdap.DefaultBootstrap.Run(context.Background())
+
+	server := myip.NewServer(config)
+	if server.Origins != nil {
+		go server.Origins.Run(context.Background())
+	}
+	server.Register(r)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -152,6 +166,12 @@ func config() *conf.Config {
 		}
 	}
 
+	// Allow MYIP_* environment variables (or a config file) to override the built in config
+	config, err := conf.Load(os.Getenv("MYIP_CONFIG"), config)
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+
 	// Load the MapsAPISigningKey secret key (from environment or secret manager)
 	loadSecrets(config)
 
@@ -0,0 +1,300 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// myip-server is a standalone implementation of myip, for running on plain VMs or in containers.
+// Unlike the appengine binary it has no dependency on Google Cloud.
+package main // import "bramp.net/myip/cmd/myip-server"
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/dns"
+	"bramp.net/myip/lib/myip"
+	"bramp.net/myip/lib/proxyproto"
+	"bramp.net/myip/lib/rdap"
+	"bramp.net/myip/lib/stun"
+	"bramp.net/myip/lib/whois"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	configFile = flag.String("config", env("MYIP_CONFIG", ""), "path to a YAML, TOML or JSON config file")
+
+	listen  = flag.String("listen", env("MYIP_LISTEN", ":"+env("PORT", "8080")), "address to listen on for both IPv4 and IPv6 (empty to disable)")
+	listen4 = flag.String("listen4", env("MYIP_LISTEN4", ""), "additional address to listen on for IPv4 only")
+	listen6 = flag.String("listen6", env("MYIP_LISTEN6", ""), "additional address to listen on for IPv6 only")
+
+	listenWhois = flag.String("listen-whois", env("MYIP_LISTEN_WHOIS", ""), "address to serve WHOIS queries on, typically :43 (empty to disable)")
+	listenDNS   = flag.String("listen-dns", env("MYIP_LISTEN_DNS", ""), "address to serve the dns_zone on (UDP and TCP), typically :53 (empty to disable)")
+
+	listenSTUN    = flag.String("listen-stun", env("MYIP_LISTEN_STUN", ""), "address to serve STUN on (UDP), typically :3478 (empty to disable)")
+	listenSTUNAlt = flag.String("listen-stun-alt", env("MYIP_LISTEN_STUN_ALT", ""), "alternate STUN address with a different IP and/or port, enabling NAT behaviour tests")
+
+	tlsCert = flag.String("tls-cert", env("MYIP_TLS_CERT", ""), "path to a PEM encoded TLS certificate")
+	tlsKey  = flag.String("tls-key", env("MYIP_TLS_KEY", ""), "path to a PEM encoded TLS private key")
+
+	host  = flag.String("host", "", "main host name, serving both IPv4 and IPv6")
+	host4 = flag.String("host4", "", "host name that only resolves to IPv4 addresses")
+	host6 = flag.String("host6", "", "host name that only resolves to IPv6 addresses")
+
+	debug = flag.Bool("debug", false, "enable unsafe options for debugging")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for requests to finish when shutting down")
+)
+
+// env returns the value of the environment variable key, or def if it is not set.
+func env(key, def string) string {
+	if value, found := os.LookupEnv(key); found {
+		return value
+	}
+	return def
+}
+
+func main() {
+	flag.Parse()
+
+	config, err := config()
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+
+	rdap.DefaultBootstrap.Dir = config.RDAPBootstrapDir
+	rdap.DefaultBootstrap.Offline = config.RDAPBootstrapOffline
+	if config.DisableRDAPHierarchy {
+		rdap.MaxParents = 0
+	}
+
+	ds := &dns.Server{Zone: config.DNSZone}
+
+	server := myip.NewServer(config)
+	if *listenDNS != "" {
+		// Share the resolvers seen by the DNS server with the resolver leak test.
+		ds.Log = &dns.ResolverLog{}
+		server.Resolvers = ds.Log
+		ds.Lookup = server.DNSLookup
+	}
+
+	if *listenSTUN != "" {
+		server.STUN, err = stun.Listen(*listenSTUN, *listenSTUNAlt)
+		if err != nil {
+			log.Fatalf("Failed to listen for STUN: %s", err)
+		}
+	}
+
+	r := mux.NewRouter()
+	server.Register(r)
+
+	s := &http.Server{
+		// Log all requests using the standard Apache format.
+		Handler: handlers.CombinedLoggingHandler(os.Stderr, r),
+
+		// Make the PROXY protocol header available to the handlers.
+		ConnContext: proxyproto.ConnContext,
+	}
+
+	upstreams, err := conf.ParsePrefixes(config.ProxyProtocolUpstreams)
+	if err != nil {
+		log.Fatalf("Failed to parse proxy_protocol_upstreams: %s", err)
+	}
+
+	listeners, err := listenAll(upstreams)
+	if err != nil {
+		log.Fatalf("Failed to listen: %s", err)
+	}
+	if len(listeners) == 0 {
+		log.Fatal("No addresses to listen on, set at least one of -listen, -listen4 or -listen6")
+	}
+
+	errs := make(chan error, len(listeners)+3)
+	for _, l := range listeners {
+		log.Printf("Listening on %s for %s", l.Addr(), config.Host)
+		go func(l net.Listener) {
+			errs <- serve(s, l)
+		}(l)
+	}
+
+	// Limit and cache WHOIS lookups in the same way as /lookup/.
+	ws := &whois.Server{Lookup: server.WhoisLookup}
+	if *listenWhois != "" {
+		l, err := listenOn("tcp", *listenWhois, upstreams)
+		if err != nil {
+			log.Fatalf("Failed to listen for WHOIS: %s", err)
+		}
+
+		log.Printf("Listening on %s for WHOIS", l.Addr())
+		go func() {
+			if err := ws.Serve(l); !errors.Is(err, whois.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+
+	if *listenDNS != "" {
+		log.Printf("Listening on %s for DNS queries in %s", *listenDNS, config.DNSZone)
+		go func() {
+			if err := ds.ListenAndServe(*listenDNS); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	if server.STUN != nil {
+		log.Printf("Listening on %s for STUN", server.STUN.Addrs())
+		go func() {
+			if err := server.STUN.Serve(); !errors.Is(err, stun.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go rdap.DefaultBootstrap.Run(ctx)
+	if server.Origins != nil {
+		go server.Origins.Run(ctx)
+	}
+
+	select {
+	case err := <-errs:
+		log.Fatalf("Serve() failed: %s", err)
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for requests to finish", *shutdownTimeout)
+
+	ws.Close()
+	if server.STUN != nil {
+		server.STUN.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if *listenDNS != "" {
+		ds.Shutdown(ctx)
+	}
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Fatalf("Shutdown() failed: %s", err)
+	}
+}
+
+// serve serves HTTP, or HTTPS if a certificate was configured, on the listener.
+func serve(s *http.Server, l net.Listener) error {
+	var err error
+	if *tlsCert != "" || *tlsKey != "" {
+		err = s.ServeTLS(l, *tlsCert, *tlsKey)
+	} else {
+		err = s.Serve(l)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// listenAll opens all the configured HTTP listeners.
+func listenAll(upstreams []netip.Prefix) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, l := range []struct {
+		network, addr string
+	}{
+		{"tcp", *listen},
+		{"tcp4", *listen4},
+		{"tcp6", *listen6},
+	} {
+		if l.addr == "" {
+			continue
+		}
+
+		ln, err := listenOn(l.network, l.addr, upstreams)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// listenOn opens a listener, wrapping it to decode the PROXY protocol if there are any upstreams.
+func listenOn(network, addr string, upstreams []netip.Prefix) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(upstreams) > 0 {
+		ln = &proxyproto.Listener{
+			Listener:  ln,
+			Upstreams: upstreams,
+		}
+	}
+	return ln, nil
+}
+
+// config builds the conf.Config from the config file, environment and flags.
+func config() (*conf.Config, error) {
+	config, err := conf.Load(*configFile, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flags override both the config file and environment.
+	if *host != "" {
+		config.Host = *host
+	}
+	if *host4 != "" {
+		config.Host4 = *host4
+	}
+	if *host6 != "" {
+		config.Host6 = *host6
+	}
+	if *debug {
+		config.Debug = true
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if *listenDNS != "" && config.DNSZone == "" {
+		return nil, errors.New("-listen-dns requires dns_zone to be configured")
+	}
+
+	if config.Debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	config.Version = Version
+	config.BuildTime = BuildTime
+
+	return config, nil
+}
@@ -0,0 +1,12 @@
+package main
+
+// These are set at build time with:
+//
+//	go build -ldflags "-X main.Version=`git describe --long --tags --dirty --always`"
+var (
+	// Version is the applications build version
+	Version = "unknown version"
+
+	// BuildTime is when this application was built
+	BuildTime = "unknown build time"
+)
@@ -0,0 +1,243 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+)
+
+// MRT record types, and TABLE_DUMP_V2 subtypes, from RFC 6396 and RFC 8050.
+const (
+	mrtTableDump   = 12
+	mrtTableDumpV2 = 13
+	mrtBGP4MP      = 16
+	mrtBGP4MPET    = 17
+
+	ribIPv4Unicast        = 2
+	ribIPv6Unicast        = 4
+	ribIPv4UnicastAddPath = 8
+	ribIPv6UnicastAddPath = 10
+)
+
+// BGP path attributes, and AS_PATH segment types, from RFC 4271.
+const (
+	attrExtendedLength = 0x10
+	attrASPath         = 2
+
+	asSet      = 1
+	asSequence = 2
+)
+
+const (
+	// mrtHeaderLen is the length of the header at the start of every MRT record.
+	mrtHeaderLen = 12
+
+	// maxMRTRecord is the largest MRT record read. RIB records for prefixes seen by many peers
+	// can be large, but nothing like this.
+	maxMRTRecord = 16 << 20
+)
+
+var errMalformedRIB = errors.New("malformed RIB entry")
+
+// isMRT returns true if r starts with a MRT record header, with one of the BGP record types.
+func isMRT(r *bufio.Reader) bool {
+	header, err := r.Peek(mrtHeaderLen)
+	if err != nil {
+		return false
+	}
+	switch binary.BigEndian.Uint16(header[4:6]) {
+	case mrtTableDump, mrtTableDumpV2, mrtBGP4MP, mrtBGP4MPET:
+		return true
+	}
+	return false
+}
+
+// ParseMRT reads the RIB entries from a MRT routing table dump (RFC 6396), such as the "bview"
+// files from RIPE RIS, or the "rib" files from RouteViews. Each prefix's origin AS numbers are
+// the last AS in the AS_PATH seen by each peer, or the members of the AS_SET it ends with. Only
+// TABLE_DUMP_V2 unicast records are used, everything else is skipped.
+func ParseMRT(r io.Reader) (*Table, error) {
+	t := &Table{}
+	header := make([]byte, mrtHeaderLen)
+	var body []byte
+	ribs := 0
+
+	for records := 0; ; records++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("MRT record %d: %w", records, err)
+		}
+
+		typ := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+		if length > maxMRTRecord {
+			return nil, fmt.Errorf("MRT record %d: too long (%d bytes)", records, length)
+		}
+
+		body = slices.Grow(body[:0], int(length))[:length]
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("MRT record %d: %w", records, err)
+		}
+
+		if typ != mrtTableDumpV2 {
+			continue
+		}
+
+		var prefix netip.Prefix
+		var asns []uint32
+		var err error
+		switch subtype {
+		case ribIPv4Unicast, ribIPv4UnicastAddPath:
+			prefix, asns, err = parseRIB(body, 4, subtype == ribIPv4UnicastAddPath)
+		case ribIPv6Unicast, ribIPv6UnicastAddPath:
+			prefix, asns, err = parseRIB(body, 16, subtype == ribIPv6UnicastAddPath)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("MRT record %d: %w", records, err)
+		}
+
+		ribs++
+		t.Insert(prefix, asns...)
+	}
+
+	if ribs == 0 {
+		return nil, errors.New("no TABLE_DUMP_V2 RIB records found")
+	}
+	return t, nil
+}
+
+// parseRIB parses a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record, returning the prefix and the
+// origins from all its entries. With addPath, each entry has a path identifier (RFC 8050).
+func parseRIB(b []byte, addrLen int, addPath bool) (netip.Prefix, []uint32, error) {
+	// Sequence number (4), then the prefix length (1), and as many bytes of prefix as needed.
+	if len(b) < 5 {
+		return netip.Prefix{}, nil, errMalformedRIB
+	}
+	bits := int(b[4])
+	n := (bits + 7) / 8
+	if bits > addrLen*8 || len(b) < 5+n+2 {
+		return netip.Prefix{}, nil, errMalformedRIB
+	}
+
+	var a [16]byte
+	copy(a[:], b[5:5+n])
+	addr := netip.AddrFrom16(a)
+	if addrLen == 4 {
+		addr = netip.AddrFrom4([4]byte(a[:4]))
+	}
+	prefix := netip.PrefixFrom(addr, bits)
+
+	count := int(binary.BigEndian.Uint16(b[5+n:]))
+	b = b[5+n+2:]
+
+	// Each entry is the peer index (2), originated time (4), the path identifier (4) if addPath,
+	// then the attributes' length (2), and the attributes.
+	entryHeader := 8
+	if addPath {
+		entryHeader += 4
+	}
+
+	var origins []uint32
+	for i := 0; i < count; i++ {
+		if len(b) < entryHeader {
+			return netip.Prefix{}, nil, errMalformedRIB
+		}
+		attrLen := int(binary.BigEndian.Uint16(b[entryHeader-2:]))
+		if len(b) < entryHeader+attrLen {
+			return netip.Prefix{}, nil, errMalformedRIB
+		}
+
+		asns, err := originASNs(b[entryHeader : entryHeader+attrLen])
+		if err != nil {
+			return netip.Prefix{}, nil, err
+		}
+		for _, asn := range asns {
+			if !slices.Contains(origins, asn) {
+				origins = append(origins, asn)
+			}
+		}
+		b = b[entryHeader+attrLen:]
+	}
+
+	return prefix, origins, nil
+}
+
+// originASNs returns the origin AS numbers from the AS_PATH in the BGP path attributes. In
+// TABLE_DUMP_V2 records, AS numbers are always 4 bytes.
+func originASNs(attrs []byte) ([]uint32, error) {
+	for len(attrs) > 0 {
+		// Flags (1), type (1), then the length (1, or 2 if extended).
+		if len(attrs) < 3 {
+			return nil, errMalformedRIB
+		}
+		flags, code := attrs[0], attrs[1]
+		length, start := int(attrs[2]), 3
+		if flags&attrExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return nil, errMalformedRIB
+			}
+			length, start = int(binary.BigEndian.Uint16(attrs[2:])), 4
+		}
+		if len(attrs) < start+length {
+			return nil, errMalformedRIB
+		}
+
+		if code == attrASPath {
+			return pathOrigins(attrs[start : start+length])
+		}
+		attrs = attrs[start+length:]
+	}
+	return nil, nil
+}
+
+// pathOrigins returns the last AS in the AS_PATH, or all the members of its last AS_SET.
+// Confederation segments are skipped, as they're internal to the neighbouring AS.
+func pathOrigins(path []byte) ([]uint32, error) {
+	var origins []uint32
+	for len(path) > 0 {
+		// Segment type (1), number of ASes (1), then the ASes.
+		if len(path) < 2 {
+			return nil, errMalformedRIB
+		}
+		segType, count := path[0], int(path[1])
+		if len(path) < 2+count*4 {
+			return nil, errMalformedRIB
+		}
+
+		asns := path[2 : 2+count*4]
+		switch {
+		case segType == asSequence && count > 0:
+			origins = []uint32{binary.BigEndian.Uint32(asns[len(asns)-4:])}
+		case segType == asSet && count > 0:
+			origins = origins[:0:0]
+			for i := 0; i < len(asns); i += 4 {
+				origins = append(origins, binary.BigEndian.Uint32(asns[i:]))
+			}
+		}
+		path = path[2+count*4:]
+	}
+	return origins, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// mrtRecord returns a MRT record.
+func mrtRecord(typ, subtype uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 1700000000)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, subtype)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// segment is an AS_PATH segment.
+type segment struct {
+	typ  byte
+	asns []uint32
+}
+
+// pathAttrs returns the path attributes for a route with the AS_PATH, using the extended length
+// for the AS_PATH if asked.
+func pathAttrs(extended bool, segments ...segment) []byte {
+	var path []byte
+	for _, s := range segments {
+		path = append(path, s.typ, byte(len(s.asns)))
+		for _, asn := range s.asns {
+			path = binary.BigEndian.AppendUint32(path, asn)
+		}
+	}
+
+	b := []byte{0x40, 1, 1, 0} // ORIGIN IGP
+	if extended {
+		b = append(b, 0x50, attrASPath)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(path)))
+	} else {
+		b = append(b, 0x40, attrASPath, byte(len(path)))
+	}
+	return append(b, path...)
+}
+
+// ribRecord returns a TABLE_DUMP_V2 RIB record for the prefix, with an entry for each of the
+// routes' path attributes.
+func ribRecord(prefix netip.Prefix, addPath bool, routes ...[]byte) []byte {
+	subtype := uint16(ribIPv6Unicast)
+	if prefix.Addr().Is4() {
+		subtype = ribIPv4Unicast
+	}
+	if addPath {
+		subtype += 6
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, 0) // Sequence number
+	b = append(b, byte(prefix.Bits()))
+	b = append(b, prefix.Addr().AsSlice()[:(prefix.Bits()+7)/8]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(routes)))
+	for i, attrs := range routes {
+		b = binary.BigEndian.AppendUint16(b, uint16(i)) // Peer index
+		b = binary.BigEndian.AppendUint32(b, 1700000000)
+		if addPath {
+			b = binary.BigEndian.AppendUint32(b, uint32(i))
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(attrs)))
+		b = append(b, attrs...)
+	}
+	return mrtRecord(mrtTableDumpV2, subtype, b)
+}
+
+// testMRT returns a small RIB dump.
+func testMRT() []byte {
+	var b []byte
+	b = append(b, mrtRecord(mrtTableDumpV2, 1, []byte("peer index table, skipped"))...)
+	b = append(b, ribRecord(netip.MustParsePrefix("8.8.8.0/24"), false,
+		pathAttrs(false, segment{asSequence, []uint32{3356, 15169}}),
+		pathAttrs(true, segment{asSequence, []uint32{174, 15169}}),
+	)...)
+	b = append(b, ribRecord(netip.MustParsePrefix("192.0.2.0/23"), false,
+		pathAttrs(false, segment{asSequence, []uint32{64500}}, segment{asSet, []uint32{64496, 64497}}),
+		pathAttrs(false, segment{asSequence, []uint32{64501, 64496}}),
+	)...)
+	b = append(b, mrtRecord(mrtBGP4MP, 4, []byte("an update, skipped"))...)
+	b = append(b, ribRecord(netip.MustParsePrefix("198.51.100.0/22"), false,
+		pathAttrs(false, segment{asSequence, []uint32{64502}}, segment{3 /* AS_CONFED_SEQUENCE */, []uint32{65001}}),
+		pathAttrs(false), // Empty AS_PATH
+	)...)
+	b = append(b, ribRecord(netip.MustParsePrefix("2001:db8::/32"), true,
+		pathAttrs(false, segment{asSequence, []uint32{6939, 64503}}),
+		pathAttrs(false, segment{asSequence, []uint32{6939, 64503}}),
+	)...)
+	return b
+}
+
+func TestParseMRT(t *testing.T) {
+	table, err := ParseMRT(bytes.NewReader(testMRT()))
+	if err != nil {
+		t.Fatalf("ParseMRT() err = %s", err)
+	}
+	if got := table.Len(); got != 4 {
+		t.Errorf("ParseMRT().Len() = %d, want 4", got)
+	}
+
+	data := []struct {
+		addr       string
+		wantPrefix string
+		wantASNs   []uint32
+	}{
+		{addr: "8.8.8.8", wantPrefix: "8.8.8.0/24", wantASNs: []uint32{15169}},
+		{addr: "192.0.3.1", wantPrefix: "192.0.2.0/23", wantASNs: []uint32{64496, 64497}},
+		{addr: "198.51.100.1", wantPrefix: "198.51.100.0/22", wantASNs: []uint32{64502}},
+		{addr: "2001:db8::1", wantPrefix: "2001:db8::/32", wantASNs: []uint32{64503}},
+	}
+
+	for _, test := range data {
+		prefix, asns := table.Lookup(netip.MustParseAddr(test.addr))
+		if prefix.String() != test.wantPrefix {
+			t.Errorf("Lookup(%q) prefix = %s, want %s", test.addr, prefix, test.wantPrefix)
+		}
+		if diff := pretty.Compare(asns, test.wantASNs); diff != "" {
+			t.Errorf("Lookup(%q) ASNs diff (-got +want)\n%s", test.addr, diff)
+		}
+	}
+}
+
+func TestParseMRTErrors(t *testing.T) {
+	rib := ribRecord(netip.MustParsePrefix("8.8.8.0/24"), false, pathAttrs(false, segment{asSequence, []uint32{15169}}))
+
+	badPath := bytes.Clone(rib)
+	badPath[len(badPath)-5] = 2 // The segment claims two ASes, but only has one
+
+	data := map[string][]byte{
+		"truncated":   rib[:len(rib)-1],
+		"bad AS_PATH": badPath,
+		"no RIBs":     mrtRecord(mrtTableDumpV2, 1, nil),
+		"bad prefix":  mrtRecord(mrtTableDumpV2, ribIPv4Unicast, []byte{0, 0, 0, 0, 33}),
+	}
+
+	for name, input := range data {
+		if _, err := ParseMRT(bytes.NewReader(input)); err == nil {
+			t.Errorf("ParseMRT(%s) err = nil, want an error", name)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(testMRT())
+	w.Close()
+
+	data := map[string][]byte{
+		"pfx2as":       []byte(testPfx2as),
+		"mrt":          testMRT(),
+		"mrt.gz":       gz.Bytes(),
+		"pfx2as, crlf": []byte(strings.ReplaceAll(testPfx2as, "\n", "\r\n")),
+	}
+
+	for name, input := range data {
+		table, err := Parse(bytes.NewReader(input))
+		if err != nil {
+			t.Errorf("Parse(%s) err = %s", name, err)
+			continue
+		}
+		if prefix, asns := table.Lookup(netip.MustParseAddr("8.8.8.8")); prefix.String() != "8.8.8.0/24" || len(asns) != 1 || asns[0] != 15169 {
+			t.Errorf("Parse(%s).Lookup(8.8.8.8) = %s, %v, want 8.8.8.0/24, [15169]", name, prefix, asns)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ParsePfx2as reads a prefix-to-AS file, as published by CAIDA. Each line is the prefix's
+// address, its length, and the origin AS, separated by whitespace, e.g. "8.8.8.0	24	15169".
+// Prefixes announced by more than one AS have them separated by "_", and AS sets by ",".
+func ParsePfx2as(r io.Reader) (*Table, error) {
+	t := &Table{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		prefix, asns, err := parsePfx2asLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		t.Insert(prefix, asns...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parsePfx2asLine parses one line of a prefix-to-AS file.
+func parsePfx2asLine(line string) (netip.Prefix, []uint32, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return netip.Prefix{}, nil, fmt.Errorf("want 3 fields, got %d", len(fields))
+	}
+
+	addr, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return netip.Prefix{}, nil, err
+	}
+	bits, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return netip.Prefix{}, nil, fmt.Errorf("invalid prefix length %q", fields[1])
+	}
+	prefix, err := addr.Unmap().Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, nil, err
+	}
+
+	var asns []uint32
+	for _, s := range strings.FieldsFunc(fields[2], func(r rune) bool { return r == '_' || r == ',' }) {
+		asn, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return netip.Prefix{}, nil, fmt.Errorf("invalid AS number %q", s)
+		}
+		asns = append(asns, uint32(asn))
+	}
+	if len(asns) == 0 {
+		return netip.Prefix{}, nil, fmt.Errorf("no AS number")
+	}
+
+	return prefix, asns, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const testPfx2as = `# A few lines of a RouteViews pfx2as file
+8.0.0.0	9	3356
+8.8.8.0	24	15169
+192.0.2.0	24	64496_64497
+198.51.100.0	24	64498,64499,64498
+2001:4860::	32	15169
+`
+
+func TestParsePfx2as(t *testing.T) {
+	table, err := ParsePfx2as(strings.NewReader(testPfx2as))
+	if err != nil {
+		t.Fatalf("ParsePfx2as() err = %s", err)
+	}
+	if got := table.Len(); got != 5 {
+		t.Errorf("ParsePfx2as().Len() = %d, want 5", got)
+	}
+
+	data := []struct {
+		addr       string
+		wantPrefix string
+		wantASNs   []uint32
+	}{
+		{addr: "8.8.8.8", wantPrefix: "8.8.8.0/24", wantASNs: []uint32{15169}},
+		{addr: "192.0.2.1", wantPrefix: "192.0.2.0/24", wantASNs: []uint32{64496, 64497}},
+		{addr: "198.51.100.1", wantPrefix: "198.51.100.0/24", wantASNs: []uint32{64498, 64499}},
+		{addr: "2001:4860:4860::8888", wantPrefix: "2001:4860::/32", wantASNs: []uint32{15169}},
+	}
+
+	for _, test := range data {
+		prefix, asns := table.Lookup(netip.MustParseAddr(test.addr))
+		if prefix.String() != test.wantPrefix {
+			t.Errorf("Lookup(%q) prefix = %s, want %s", test.addr, prefix, test.wantPrefix)
+		}
+		if diff := pretty.Compare(asns, test.wantASNs); diff != "" {
+			t.Errorf("Lookup(%q) ASNs diff (-got +want)\n%s", test.addr, diff)
+		}
+	}
+}
+
+func TestParsePfx2asErrors(t *testing.T) {
+	for _, input := range []string{
+		"8.8.8.0	24",
+		"8.8.8.x	24	15169",
+		"8.8.8.0	33	15169",
+		"8.8.8.0	24	AS15169",
+		"8.8.8.0	24	_",
+	} {
+		if _, err := ParsePfx2as(strings.NewReader(input)); err == nil {
+			t.Errorf("ParsePfx2as(%q) err = nil, want an error", input)
+		}
+	}
+}
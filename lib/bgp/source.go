@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCheckInterval is how often a Source checks if its file changed, if not configured.
+const DefaultCheckInterval = time.Minute
+
+// Source is a Table loaded from a file, which is reloaded when the file changes. Lookups always
+// see either the old table, or the new one, never one part way through loading.
+type Source struct {
+	Path string
+
+	// CheckInterval is how often Run checks if the file changed. Zero uses DefaultCheckInterval.
+	CheckInterval time.Duration
+
+	table atomic.Pointer[Table]
+
+	mu      sync.Mutex // Held while loading
+	modTime time.Time  // Of the file last loaded, or that failed to load
+	size    int64
+}
+
+// NewSource returns a Source for the file at path. It's empty until Load or Run is called.
+func NewSource(path string) *Source {
+	return &Source{Path: path}
+}
+
+// Load reads the file, replacing the table if successful. If it fails, the old table is kept.
+func (s *Source) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	return s.load(info)
+}
+
+func (s *Source) load(info os.FileInfo) error {
+	// Remember the file, even if it's broken, so it's not loaded again until it changes.
+	s.modTime, s.size = info.ModTime(), info.Size()
+
+	start := time.Now()
+	t, err := Load(s.Path)
+	if err != nil {
+		return err
+	}
+
+	s.table.Store(t)
+	log.Infof("Loaded %d prefixes from %q in %s", t.Len(), s.Path, time.Since(start))
+	return nil
+}
+
+// changed returns the file's info if it's different from when it was last loaded.
+func (s *Source) changed() (os.FileInfo, bool) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, false
+	}
+	return info, !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// Run checks the file every CheckInterval, and reloads it when it changes, until ctx is done.
+func (s *Source) Run(ctx context.Context) {
+	interval := s.CheckInterval
+	if interval == 0 {
+		interval = DefaultCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if info, changed := s.changed(); changed {
+			if err := s.load(info); err != nil {
+				log.Warningf("Failed to reload %q, keeping the old table: %s", s.Path, err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Table returns the current table, or nil if nothing has loaded.
+func (s *Source) Table() *Table {
+	return s.table.Load()
+}
+
+// Lookup returns the most specific prefix containing addr, and its origin AS numbers, from the
+// current table.
+func (s *Source) Lookup(addr netip.Addr) (netip.Prefix, []uint32) {
+	return s.Table().Lookup(addr)
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// origin returns the first origin AS of addr, or 0.
+func origin(s *Source, addr string) uint32 {
+	if _, asns := s.Lookup(netip.MustParseAddr(addr)); len(asns) > 0 {
+		return asns[0]
+	}
+	return 0
+}
+
+func TestSourceReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pfx2as.txt")
+	s := &Source{Path: path, CheckInterval: time.Millisecond}
+
+	// Nothing has loaded yet.
+	if err := s.Load(); err == nil {
+		t.Errorf("Load() of a missing file err = nil, want an error")
+	}
+	if got := origin(s, "192.0.2.1"); got != 0 {
+		t.Errorf("Lookup() before loading = AS%d, want nothing", got)
+	}
+
+	if err := os.WriteFile(path, []byte("192.0.2.0 24 64496\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(); err != nil {
+		t.Fatalf("Load() err = %s", err)
+	}
+	if got := origin(s, "192.0.2.1"); got != 64496 {
+		t.Errorf("Lookup() = AS%d, want AS64496", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// waitFor waits for the lookup of 192.0.2.1 to return want.
+	waitFor := func(want uint32) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if origin(s, "192.0.2.1") == want {
+				return
+			}
+		}
+		t.Fatalf("Lookup() = AS%d, want AS%d after the file changed", origin(s, "192.0.2.1"), want)
+	}
+
+	// A change is picked up. The size changes too, in case the modification time is coarse.
+	if err := os.WriteFile(path, []byte("192.0.2.0  24  64497\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(64497)
+
+	// A broken file keeps the old table.
+	if err := os.WriteFile(path, []byte("not a table at all\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := origin(s, "192.0.2.1"); got != 64497 {
+		t.Errorf("Lookup() after a broken file = AS%d, want AS64497 still", got)
+	}
+
+	// Then it's fixed.
+	if err := os.WriteFile(path, []byte("192.0.2.0 24 64498\n2001:db8:: 32 64498\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(64498)
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bgp maps addresses to the prefix announcing them in BGP, and its origin AS numbers,
+// using a local copy of the routing table, such as CAIDA's RouteViews pfx2as files, or an MRT RIB
+// dump from RouteViews or RIPE RIS.
+package bgp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+)
+
+// entry is an announced prefix, and its origins.
+type entry struct {
+	prefix netip.Prefix
+	asns   []uint32
+}
+
+// Table maps prefixes to their origin AS numbers. The zero value is an empty table. A Table must
+// not be modified once it's being looked up.
+type Table struct {
+	v4, v6  trie
+	entries []entry
+}
+
+// Insert adds the prefix, announced by the asns. If the prefix is already in the table, the asns
+// are added to those it has.
+func (t *Table) Insert(prefix netip.Prefix, asns ...uint32) {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	prefix = prefix.Masked()
+	if !prefix.IsValid() || len(asns) == 0 {
+		return
+	}
+
+	tr := &t.v6
+	if prefix.Addr().Is4() {
+		tr = &t.v4
+	}
+
+	value := int32(len(t.entries))
+	if got := tr.insert(addrKey(prefix.Addr()), uint8(prefix.Bits()), value); got == value {
+		t.entries = append(t.entries, entry{prefix: prefix})
+	} else {
+		value = got
+	}
+
+	e := &t.entries[value]
+	for _, asn := range asns {
+		if !slices.Contains(e.asns, asn) {
+			e.asns = append(e.asns, asn)
+		}
+	}
+}
+
+// Lookup returns the most specific prefix containing addr, and its origin AS numbers. There is
+// more than one if the prefix is announced by several, or from an AS set. If addr isn't in any
+// prefix, the zero netip.Prefix is returned.
+func (t *Table) Lookup(addr netip.Addr) (netip.Prefix, []uint32) {
+	if t == nil || !addr.IsValid() {
+		return netip.Prefix{}, nil
+	}
+	addr = addr.Unmap()
+
+	tr := &t.v6
+	if addr.Is4() {
+		tr = &t.v4
+	}
+	i := tr.lookup(addrKey(addr))
+	if i < 0 {
+		return netip.Prefix{}, nil
+	}
+	return t.entries[i].prefix, slices.Clone(t.entries[i].asns)
+}
+
+// Len returns the number of prefixes in the table.
+func (t *Table) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.entries)
+}
+
+// Load reads the table from a pfx2as file, or an MRT RIB dump, either of which may be compressed
+// with gzip or bzip2.
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return t, nil
+}
+
+// Parse reads the table from a pfx2as file, or an MRT RIB dump, either of which may be compressed
+// with gzip or bzip2. The format is worked out from the first few bytes.
+func Parse(r io.Reader) (*Table, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(3)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		br = bufio.NewReader(bzip2.NewReader(br))
+	}
+
+	if isMRT(br) {
+		return ParseMRT(br)
+	}
+	return ParsePfx2as(br)
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestTableLookup(t *testing.T) {
+	table := &Table{}
+	table.Insert(netip.MustParsePrefix("8.0.0.0/9"), 3356)
+	table.Insert(netip.MustParsePrefix("8.8.8.0/24"), 15169)
+	table.Insert(netip.MustParsePrefix("8.8.8.0/24"), 15169, 36040) // Merged with the above
+	table.Insert(netip.MustParsePrefix("192.0.2.128/25"), 64497)
+	table.Insert(netip.MustParsePrefix("192.0.2.0/25"), 64496)
+	table.Insert(netip.MustParsePrefix("192.0.2.1/24"), 64499) // Host bits are ignored
+	table.Insert(netip.MustParsePrefix("::ffff:198.51.100.0/120"), 64498)
+	table.Insert(netip.MustParsePrefix("2001:4860::/32"), 15169)
+	table.Insert(netip.MustParsePrefix("2001:4860:4860::8888/128"), 15169)
+	table.Insert(netip.MustParsePrefix("203.0.113.0/24")) // No origin, so ignored
+
+	if got, want := table.Len(), 8; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+
+	data := []struct {
+		addr       string
+		wantPrefix string
+		wantASNs   []uint32
+	}{
+		{addr: "8.8.8.8", wantPrefix: "8.8.8.0/24", wantASNs: []uint32{15169, 36040}},
+		{addr: "8.8.4.4", wantPrefix: "8.0.0.0/9", wantASNs: []uint32{3356}},
+		{addr: "8.128.0.1"},
+		{addr: "::ffff:8.8.8.8", wantPrefix: "8.8.8.0/24", wantASNs: []uint32{15169, 36040}},
+		{addr: "192.0.2.1", wantPrefix: "192.0.2.0/25", wantASNs: []uint32{64496}},
+		{addr: "192.0.2.200", wantPrefix: "192.0.2.128/25", wantASNs: []uint32{64497}},
+		{addr: "198.51.100.7", wantPrefix: "198.51.100.0/24", wantASNs: []uint32{64498}},
+		{addr: "2001:4860:4860::8888", wantPrefix: "2001:4860:4860::8888/128", wantASNs: []uint32{15169}},
+		{addr: "2001:4860:4860::8844", wantPrefix: "2001:4860::/32", wantASNs: []uint32{15169}},
+		{addr: "2001:db8::1"},
+		{addr: "203.0.113.1"},
+	}
+
+	for _, test := range data {
+		prefix, asns := table.Lookup(netip.MustParseAddr(test.addr))
+		got := ""
+		if prefix.IsValid() {
+			got = prefix.String()
+		}
+		if got != test.wantPrefix {
+			t.Errorf("Lookup(%q) prefix = %q, want %q", test.addr, got, test.wantPrefix)
+		}
+		if diff := pretty.Compare(asns, test.wantASNs); diff != "" {
+			t.Errorf("Lookup(%q) ASNs diff (-got +want)\n%s", test.addr, diff)
+		}
+	}
+}
+
+func TestTableLookupEmpty(t *testing.T) {
+	var table *Table
+	if prefix, asns := table.Lookup(netip.MustParseAddr("192.0.2.1")); prefix.IsValid() || asns != nil {
+		t.Errorf("nil Table.Lookup() = %s, %v, want nothing", prefix, asns)
+	}
+
+	table = &Table{}
+	table.Insert(netip.MustParsePrefix("0.0.0.0/0"), 64496)
+	if prefix, _ := table.Lookup(netip.MustParseAddr("192.0.2.1")); prefix.String() != "0.0.0.0/0" {
+		t.Errorf("Lookup() with a default route = %s, want 0.0.0.0/0", prefix)
+	}
+	if prefix, _ := table.Lookup(netip.MustParseAddr("2001:db8::1")); prefix.IsValid() {
+		t.Errorf("Lookup(IPv6) with an IPv4 default route = %s, want nothing", prefix)
+	}
+}
+
+// TestTableLookupRandom compares the trie against checking every prefix.
+func TestTableLookupRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	randomAddr := func(v4 bool) netip.Addr {
+		var b [16]byte
+		r.Read(b[:])
+		b[0] = byte(r.Intn(4)) // Crowd them together, so prefixes nest.
+		if v4 {
+			return netip.AddrFrom4([4]byte(b[:4]))
+		}
+		return netip.AddrFrom16(b)
+	}
+
+	table := &Table{}
+	var prefixes []netip.Prefix
+	for i := 0; i < 2000; i++ {
+		v4 := i%2 == 0
+		maxBits := 128
+		if v4 {
+			maxBits = 32
+		}
+		p := netip.PrefixFrom(randomAddr(v4), r.Intn(maxBits+1)).Masked()
+		table.Insert(p, uint32(i))
+		prefixes = append(prefixes, p)
+	}
+
+	for i := 0; i < 5000; i++ {
+		addr := randomAddr(i%2 == 0)
+
+		var want netip.Prefix
+		for _, p := range prefixes {
+			if p.Contains(addr) && (!want.IsValid() || p.Bits() > want.Bits()) {
+				want = p
+			}
+		}
+
+		if got, _ := table.Lookup(addr); got != want {
+			t.Fatalf("Lookup(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func BenchmarkTableLookup(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	table := &Table{}
+	for i := 0; i < 500000; i++ {
+		addr := netip.AddrFrom4([4]byte{byte(r.Intn(224)), byte(r.Intn(256)), byte(r.Intn(256)), 0})
+		table.Insert(netip.PrefixFrom(addr, 16+r.Intn(9)).Masked(), uint32(i))
+	}
+	addr := netip.MustParseAddr("8.8.8.8")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(addr)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// key is an address as a 128 bit number, most significant bit first. IPv4 addresses use the top
+// 32 bits.
+type key struct {
+	hi, lo uint64
+}
+
+func addrKey(addr netip.Addr) key {
+	if addr.Is4() {
+		b := addr.As4()
+		return key{hi: uint64(b[0])<<56 | uint64(b[1])<<48 | uint64(b[2])<<40 | uint64(b[3])<<32}
+	}
+	b := addr.As16()
+	var k key
+	for i := 0; i < 8; i++ {
+		k.hi = k.hi<<8 | uint64(b[i])
+		k.lo = k.lo<<8 | uint64(b[i+8])
+	}
+	return k
+}
+
+// bit returns the i'th bit of the key.
+func (k key) bit(i uint8) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// common returns how many leading bits a and b share, up to max.
+func common(a, b key, max uint8) uint8 {
+	n := bits.LeadingZeros64(a.hi ^ b.hi)
+	if n == 64 {
+		n += bits.LeadingZeros64(a.lo ^ b.lo)
+	}
+	return min(uint8(n), max)
+}
+
+// mask returns the key with all but the first n bits cleared.
+func (k key) mask(n uint8) key {
+	switch {
+	case n == 0:
+		return key{}
+	case n < 64:
+		return key{hi: k.hi &^ (1<<(64-n) - 1)}
+	case n == 64:
+		return key{hi: k.hi}
+	case n < 128:
+		return key{hi: k.hi, lo: k.lo &^ (1<<(128-n) - 1)}
+	}
+	return k
+}
+
+// node is a node in the trie. Nodes are only kept where a prefix is stored, or where two
+// branches split, so there are fewer than two per prefix.
+type node struct {
+	key   key
+	bits  uint8
+	child [2]int32 // Indexes into trie.nodes, or 0 for none.
+	value int32    // Index into Table.entries, or -1 for none.
+}
+
+// trie is a path compressed binary trie, for longest prefix matches. The nodes are kept in one
+// slice, and refer to each other by index, which is smaller, and kinder to the garbage collector,
+// than pointers.
+type trie struct {
+	nodes []node // nodes[0] is unused, so a 0 index means no node.
+	root  int32
+}
+
+func (t *trie) newNode(k key, n uint8, value int32) int32 {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, node{})
+	}
+	t.nodes = append(t.nodes, node{key: k.mask(n), bits: n, value: value})
+	return int32(len(t.nodes) - 1)
+}
+
+// insert stores value for the prefix k/n, unless it already has one, and returns the prefix's
+// value.
+func (t *trie) insert(k key, n uint8, value int32) int32 {
+	if t.root == 0 {
+		t.root = t.newNode(k, n, value)
+		return value
+	}
+
+	parent, dir := int32(0), 0
+	cur := t.root
+	for {
+		nd := t.nodes[cur]
+		c := common(k, nd.key, min(n, nd.bits))
+
+		if c == nd.bits && c == n {
+			if nd.value >= 0 {
+				return nd.value
+			}
+			t.nodes[cur].value = value
+			return value
+		}
+
+		if c == nd.bits {
+			// nd is a prefix of k, so carry on down.
+			d := k.bit(nd.bits)
+			if nd.child[d] == 0 {
+				leaf := t.newNode(k, n, value)
+				t.nodes[cur].child[d] = leaf
+				return value
+			}
+			parent, dir, cur = cur, d, nd.child[d]
+			continue
+		}
+
+		// k and nd differ before the end of nd, so a node is needed above nd.
+		var split int32
+		if c == n {
+			// k is a prefix of nd.
+			split = t.newNode(k, n, value)
+		} else {
+			split = t.newNode(k, c, -1)
+			leaf := t.newNode(k, n, value)
+			t.nodes[split].child[k.bit(c)] = leaf
+		}
+		t.nodes[split].child[nd.key.bit(c)] = cur
+
+		if parent == 0 {
+			t.root = split
+		} else {
+			t.nodes[parent].child[dir] = split
+		}
+		return value
+	}
+}
+
+// lookup returns the value of the longest prefix containing k, or -1 if there is none.
+func (t *trie) lookup(k key) int32 {
+	found := int32(-1)
+	for cur := t.root; cur != 0; {
+		nd := &t.nodes[cur]
+		if common(k, nd.key, nd.bits) < nd.bits {
+			break
+		}
+		if nd.value >= 0 {
+			found = nd.value
+		}
+		if nd.bits == 128 {
+			break
+		}
+		cur = nd.child[k.bit(nd.bits)]
+	}
+	return found
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache caches lookup results by the network range they cover, so a later lookup of any
+// address in the same allocation can be answered without asking the registries again.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Store is a key/value store, whose values expire after a TTL. LRU is an in-memory Store, and
+// others (e.g. Redis or memcache) can be used by implementing this.
+type Store interface {
+	// Get returns the value for key, if it exists and hasn't expired.
+	Get(ctx context.Context, key string) ([]byte, bool)
+
+	// GetMulti returns the values of those keys that exist and haven't expired. RangeCache probes
+	// dozens of keys for each address, so this should take a single round trip (e.g. Redis MGET).
+	GetMulti(ctx context.Context, keys []string) map[string][]byte
+
+	// Set stores the value for key, until ttl has passed.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+}
+
+// Entry is a cached value, and the range of addresses it covers.
+type Entry struct {
+	Start, End netip.Addr
+
+	// Stored is when the value was put in the cache.
+	Stored time.Time
+
+	Value json.RawMessage
+}
+
+// Prefix lengths RangeCache keys entries by. Registries rarely allocate networks outside these, so
+// a range is stored under the smallest prefix containing it, clamped to them. Get then fetches
+// the keys for each of these prefixes of the address at once.
+const (
+	minBits4, maxBits4 = 8, 32
+	minBits6, maxBits6 = 19, 64
+)
+
+// RangeCache caches values by the range of addresses they cover, in a Store.
+//
+// Each range is stored once, under the smallest CIDR prefix containing it, so Get finds the entry
+// for an address by fetching each of its prefixes, and using the most specific one whose range
+// contains it. That makes the most specific range win, if there are overlapping ones (such as a
+// customer's reassignment within their ISP's allocation).
+type RangeCache struct {
+	Store Store
+	TTL   time.Duration
+
+	now func() time.Time // for testing
+}
+
+// New returns a RangeCache storing entries in store, for ttl.
+func New(store Store, ttl time.Duration) *RangeCache {
+	return &RangeCache{
+		Store: store,
+		TTL:   ttl,
+	}
+}
+
+func (c *RangeCache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// key returns the Store key for the prefix, in the namespace kind (e.g. "rdap").
+func key(kind string, prefix netip.Prefix) string {
+	return kind + "/" + prefix.String()
+}
+
+// prefixLengths returns the range of prefix lengths entries for addr's family are keyed by.
+func prefixLengths(addr netip.Addr) (minBits, maxBits int) {
+	if addr.Is4() {
+		return minBits4, maxBits4
+	}
+	return minBits6, maxBits6
+}
+
+// keyPrefix returns the prefix the entry for start to end is stored under. That's the smallest
+// containing the range, or if it's shorter than Get looks for, the shortest containing start.
+func keyPrefix(start, end netip.Addr) netip.Prefix {
+	minBits, maxBits := prefixLengths(start)
+	for bits := maxBits; bits > minBits; bits-- {
+		if p, _ := start.Prefix(bits); p.Contains(end) {
+			return p
+		}
+	}
+	p, _ := start.Prefix(minBits)
+	return p
+}
+
+// Get returns the entry of kind whose range contains addr.
+func (c *RangeCache) Get(ctx context.Context, kind string, addr netip.Addr) (*Entry, bool) {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return nil, false
+	}
+
+	// Most specific first.
+	minBits, maxBits := prefixLengths(addr)
+	keys := make([]string, 0, maxBits-minBits+1)
+	for bits := maxBits; bits >= minBits; bits-- {
+		prefix, _ := addr.Prefix(bits)
+		keys = append(keys, key(kind, prefix))
+	}
+
+	values := c.Store.GetMulti(ctx, keys)
+	for _, k := range keys {
+		data, found := values[k]
+		if !found {
+			continue
+		}
+
+		e := &Entry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			log.Warningf("cache: invalid entry for %q: %s", k, err)
+			continue
+		}
+		if e.Start.Compare(addr) <= 0 && addr.Compare(e.End) <= 0 {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Put stores value (which must marshal to JSON) as the entry of kind, for every address from
+// start to end inclusive.
+func (c *RangeCache) Put(ctx context.Context, kind string, start, end netip.Addr, value interface{}) error {
+	start, end = start.Unmap(), end.Unmap()
+	if !start.IsValid() || start.BitLen() != end.BitLen() || end.Less(start) {
+		return fmt.Errorf("invalid range %s - %s", start, end)
+	}
+
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&Entry{
+		Start:  start,
+		End:    end,
+		Stored: c.timeNow(),
+		Value:  v,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Store.Set(ctx, key(kind, keyPrefix(start, end)), data, c.TTL)
+	return nil
+}
+
+// LastAddr returns the last address in the prefix, e.g. 192.0.2.255 for 192.0.2.0/24.
+func LastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	data := []struct {
+		start, end string
+		want       string
+	}{
+		{"192.0.2.0", "192.0.2.255", "192.0.2.0/24"},
+		{"192.0.2.1", "192.0.2.1", "192.0.2.1/32"},
+		{"198.212.194.0", "198.212.195.255", "198.212.194.0/23"},
+		{"192.0.2.1", "192.0.2.6", "192.0.2.0/29"},
+		{"192.0.2.0", "192.0.4.255", "192.0.0.0/21"},
+		{"0.0.0.0", "255.255.255.255", "0.0.0.0/8"},
+		{"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", "2001:db8::/32"},
+		{"2001:db8::", "2001:db8::ffff", "2001:db8::/64"},
+		{"2000::", "3fff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "2000::/19"},
+	}
+
+	for _, test := range data {
+		if got := keyPrefix(netip.MustParseAddr(test.start), netip.MustParseAddr(test.end)).String(); got != test.want {
+			t.Errorf("keyPrefix(%s, %s) = %s, want %s", test.start, test.end, got, test.want)
+		}
+	}
+}
+
+func TestLastAddr(t *testing.T) {
+	data := []struct {
+		prefix string
+		want   string
+	}{
+		{"192.0.2.0/24", "192.0.2.255"},
+		{"192.0.2.1/23", "192.0.3.255"},
+		{"192.0.2.1/32", "192.0.2.1"},
+		{"0.0.0.0/0", "255.255.255.255"},
+		{"2001:db8::/33", "2001:db8:7fff:ffff:ffff:ffff:ffff:ffff"},
+	}
+
+	for _, test := range data {
+		if got := LastAddr(netip.MustParsePrefix(test.prefix)).String(); got != test.want {
+			t.Errorf("LastAddr(%s) = %s, want %s", test.prefix, got, test.want)
+		}
+	}
+}
+
+// countingStore counts the calls to a Store.
+type countingStore struct {
+	Store
+	gets, sets int
+}
+
+func (s *countingStore) GetMulti(ctx context.Context, keys []string) map[string][]byte {
+	s.gets++
+	return s.Store.GetMulti(ctx, keys)
+}
+
+func (s *countingStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	s.sets++
+	s.Store.Set(ctx, key, value, ttl)
+}
+
+func TestRangeCacheRoundTrips(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Store: NewLRU(100)}
+	c := New(store, time.Hour)
+
+	// A range that isn't a single prefix is still only stored once.
+	if err := c.Put(ctx, "test", netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.6"), "v"); err != nil {
+		t.Fatalf("Put() err: %s", err)
+	}
+	if store.sets != 1 {
+		t.Errorf("Put() made %d Sets, want 1", store.sets)
+	}
+
+	for _, addr := range []string{"192.0.2.6", "2001:db8::1"} {
+		store.gets = 0
+		c.Get(ctx, "test", netip.MustParseAddr(addr))
+		if store.gets != 1 {
+			t.Errorf("Get(%s) made %d GetMultis, want 1", addr, store.gets)
+		}
+	}
+
+	if err := c.Put(ctx, "test", netip.MustParseAddr("192.0.2.6"), netip.MustParseAddr("192.0.2.1"), "v"); err == nil {
+		t.Errorf("Put() with end before start err = nil, want an error")
+	}
+}
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+
+	l := NewLRU(2)
+	l.now = func() time.Time { return now }
+
+	l.Set(ctx, "a", []byte("1"), time.Minute)
+	l.Set(ctx, "b", []byte("2"), time.Minute)
+	l.Get(ctx, "a") // a is now more recently used than b
+	l.Set(ctx, "c", []byte("3"), time.Minute)
+
+	if _, found := l.Get(ctx, "b"); found {
+		t.Errorf("Get(b) found, want evicted")
+	}
+	if v, found := l.Get(ctx, "a"); !found || string(v) != "1" {
+		t.Errorf("Get(a) = %q, %t, want 1, true", v, found)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, found := l.Get(ctx, "c"); found {
+		t.Errorf("Get(c) found, want expired")
+	}
+	if got := l.Len(); got != 1 {
+		t.Errorf("Len() = %d, want 1", got)
+	}
+}
+
+func TestRangeCache(t *testing.T) {
+	ctx := context.Background()
+	c := New(NewLRU(100), time.Hour)
+
+	put := func(start, end, value string) {
+		if err := c.Put(ctx, "test", netip.MustParseAddr(start), netip.MustParseAddr(end), value); err != nil {
+			t.Fatalf("Put(%s, %s) err: %s", start, end, err)
+		}
+	}
+	put("192.0.0.0", "192.0.255.255", "isp")
+	put("192.0.2.0", "192.0.2.127", "customer") // Reassigned within the ISP's allocation
+	put("2001:db8::", "2001:db8::ffff", "v6")
+
+	data := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", `"customer"`},
+		{"192.0.2.127", `"customer"`},
+		{"192.0.2.128", `"isp"`},
+		{"192.0.2.200", `"isp"`},
+		{"::ffff:192.0.1.1", `"isp"`},
+		{"192.1.0.0", ""},
+		{"2001:db8::1234", `"v6"`},
+		{"2001:db8::1:0", ""},
+	}
+
+	for _, test := range data {
+		e, found := c.Get(ctx, "test", netip.MustParseAddr(test.addr))
+		got := ""
+		if found {
+			got = string(e.Value)
+		}
+		if got != test.want {
+			t.Errorf("Get(%s) = %s, want %s", test.addr, got, test.want)
+		}
+	}
+
+	// Kinds are kept apart.
+	if _, found := c.Get(ctx, "other", netip.MustParseAddr("192.0.2.1")); found {
+		t.Errorf("Get(other, 192.0.2.1) found, want not found")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// LRU is an in-memory Store, holding up to Size values, evicting the least recently used.
+type LRU struct {
+	size int
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List // Most recently used at the front
+
+	now func() time.Time // for testing
+}
+
+type lruItem struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU returns an LRU holding up to size values.
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:  size,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (l *LRU) timeNow() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Get implements Store.
+func (l *LRU) Get(_ context.Context, key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, found := l.items[key]
+	if !found {
+		return nil, false
+	}
+
+	item := e.Value.(*lruItem)
+	if l.timeNow().After(item.expires) {
+		l.remove(e)
+		return nil, false
+	}
+
+	l.order.MoveToFront(e)
+	return item.value, true
+}
+
+// GetMulti implements Store.
+func (l *LRU) GetMulti(ctx context.Context, keys []string) map[string][]byte {
+	values := make(map[string][]byte)
+	for _, key := range keys {
+		if value, found := l.Get(ctx, key); found {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// Set implements Store.
+func (l *LRU) Set(_ context.Context, key string, value []byte, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expires := l.timeNow().Add(ttl)
+	if e, found := l.items[key]; found {
+		item := e.Value.(*lruItem)
+		item.value, item.expires = value, expires
+		l.order.MoveToFront(e)
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value, expires: expires})
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+	}
+}
+
+// Len returns the number of values stored, including any expired ones not yet removed.
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// remove deletes the element. Must be called with the lock held.
+func (l *LRU) remove(e *list.Element) {
+	l.order.Remove(e)
+	delete(l.items, e.Value.(*lruItem).key)
+}
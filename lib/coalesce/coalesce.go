@@ -0,0 +1,134 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package coalesce merges concurrent identical lookups into one, so when many clients behind the
+// same NAT arrive at once, the upstream servers are only asked once.
+package coalesce
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Group coalesces concurrent calls with the same key. The zero value is ready to use.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+// call is an in-flight, or finished, call to fn.
+type call[T any] struct {
+	done chan struct{} // Closed once val and err are set
+	val  T
+	err  error
+
+	callers int // Every caller that joined this call
+	waiters int // Callers still waiting for the result
+
+	ctx    *callContext
+	cancel context.CancelFunc
+}
+
+// callContext is the context fn runs with. It isn't canceled with any one caller, and its
+// deadline is the latest of the callers', so a caller with a short deadline doesn't cut the call
+// short for those willing to wait longer.
+type callContext struct {
+	context.Context
+
+	mu       sync.Mutex
+	deadline time.Time // Zero if a caller had no deadline
+}
+
+// Deadline returns the latest deadline of the callers, or ok false if any had none.
+func (c *callContext) Deadline() (deadline time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline, !c.deadline.IsZero()
+}
+
+// extend moves the deadline to ctx's, if that's later.
+func (c *callContext) extend(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok {
+		c.deadline = time.Time{}
+	} else if !c.deadline.IsZero() && deadline.After(c.deadline) {
+		c.deadline = deadline
+	}
+}
+
+// Do calls fn and returns its result, unless a call for the same key is already in flight, in
+// which case it waits for that call and returns its result instead. shared is true if the result
+// was given to more than one caller, so must not be modified.
+//
+// fn's context keeps the first caller's values, but isn't canceled with it, so one caller going
+// away doesn't fail the others. Its deadline is the latest of every caller's, and it's canceled
+// once they have all gone. If ctx is done before the result is ready, Do returns ctx.Err()
+// without waiting.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(context.Context) (T, error)) (v T, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+	c, found := g.calls[key]
+	if !found {
+		c = &call[T]{done: make(chan struct{})}
+		g.calls[key] = c
+
+		detached, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		deadline, _ := ctx.Deadline()
+		c.ctx, c.cancel = &callContext{Context: detached, deadline: deadline}, cancel
+		go g.run(key, c, c.ctx, fn)
+	} else {
+		c.ctx.extend(ctx)
+	}
+	c.callers++
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.callers > 1, c.err
+
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody wants the result anymore, so stop the call, and don't let anyone new join it.
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return v, false, ctx.Err()
+	}
+}
+
+func (g *Group[T]) run(key string, c *call[T], ctx context.Context, fn func(context.Context) (T, error)) {
+	defer c.cancel()
+
+	c.val, c.err = fn(ctx)
+
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+
+	close(c.done)
+}
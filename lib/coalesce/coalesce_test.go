@@ -0,0 +1,214 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	var g Group[string]
+	var calls int32
+
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "result", nil
+	}
+
+	const callers = 10
+	results := make(chan string, callers)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, _, err := g.Do(context.Background(), "key", fn)
+			if err != nil {
+				t.Errorf("Do() err: %s", err)
+			}
+			results <- v
+		}()
+	}
+
+	// Give every caller a chance to join the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for v := range results {
+		if v != "result" {
+			t.Errorf("Do() = %q, want %q", v, "result")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+
+	// Once finished, the next call runs again.
+	if _, _, err := g.Do(context.Background(), "key", fn); err != nil || calls != 2 {
+		t.Errorf("Do() after the first finished = %v, called %d times, want 2", err, calls)
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	var g Group[string]
+
+	var once sync.Once
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fnErr := make(chan error, 2)
+	fn := func(ctx context.Context) (string, error) {
+		once.Do(func() { close(started) })
+		<-release
+		fnErr <- ctx.Err()
+		return "result", nil
+	}
+
+	// The first caller gives up, but the second still gets the result.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(ctx, "key", fn)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan string, 1)
+	go func() {
+		v, _, _ := g.Do(context.Background(), "key", fn)
+		second <- v
+	}()
+
+	// Give the second caller a chance to join the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() with canceled ctx err = %v, want context.Canceled", err)
+	}
+
+	close(release)
+	if v := <-second; v != "result" {
+		t.Errorf("Do() = %q, want %q", v, "result")
+	}
+	if err := <-fnErr; err != nil {
+		t.Errorf("fn's ctx err = %v, want nil", err)
+	}
+}
+
+func TestDoAbandoned(t *testing.T) {
+	var g Group[string]
+
+	started := make(chan struct{})
+	fnErr := make(chan error, 1)
+	fn := func(ctx context.Context) (string, error) {
+		close(started)
+		<-ctx.Done()
+		fnErr <- ctx.Err()
+		return "", ctx.Err()
+	}
+
+	// The only caller gives up, so the call is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(ctx, "key", fn)
+		done <- err
+	}()
+	<-started
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() with canceled ctx err = %v, want context.Canceled", err)
+	}
+	select {
+	case err := <-fnErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("fn's ctx err = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fn's ctx wasn't canceled after every caller went away")
+	}
+
+	// The abandoned call isn't joined by new callers.
+	v, _, err := g.Do(context.Background(), "key", func(context.Context) (string, error) {
+		return "fresh", nil
+	})
+	if err != nil || v != "fresh" {
+		t.Errorf("Do() after an abandoned call = %q, %v, want %q", v, err, "fresh")
+	}
+}
+
+func TestDoDeadline(t *testing.T) {
+	var g Group[string]
+
+	var once sync.Once
+	started := make(chan struct{})
+	release := make(chan struct{})
+	type result struct {
+		deadline time.Time
+		ok       bool
+		err      error
+	}
+	fnResult := make(chan result, 1)
+	fn := func(ctx context.Context) (string, error) {
+		once.Do(func() { close(started) })
+		<-release
+		deadline, ok := ctx.Deadline()
+		fnResult <- result{deadline, ok, ctx.Err()}
+		return "result", nil
+	}
+
+	// The first caller has a short deadline, and the second a longer one.
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(short, "key", fn)
+		first <- err
+	}()
+	<-started
+
+	long, cancelLong := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelLong()
+	second := make(chan string, 1)
+	go func() {
+		v, _, _ := g.Do(long, "key", fn)
+		second <- v
+	}()
+
+	// The first gives up at its own deadline, without waiting for the call.
+	if err := <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do() with short deadline err = %v, want context.DeadlineExceeded", err)
+	}
+
+	// But the call carries on with the second's deadline.
+	close(release)
+	if v := <-second; v != "result" {
+		t.Errorf("Do() = %q, want %q", v, "result")
+	}
+	want, _ := long.Deadline()
+	if got := <-fnResult; got.err != nil || !got.ok || !got.deadline.Equal(want) {
+		t.Errorf("fn's ctx deadline = %s, %t, err %v, want %s, true, nil", got.deadline, got.ok, got.err, want)
+	}
+}
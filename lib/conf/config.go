@@ -15,65 +15,158 @@
 package conf
 
 import (
-	"encoding/json"
+	"net/netip"
 	"net/url"
 	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 )
 
+// DefaultLookupRateLimit is the number of /lookup/ requests each client may make per minute, if
+// not configured.
+const DefaultLookupRateLimit = 10
+
+// DefaultBulkLookupWorkers is the number of addresses a POST to /lookup looks up at once, if not
+// configured.
+const DefaultBulkLookupWorkers = 8
+
+// DefaultCacheTTL is how long RDAP and WHOIS results are cached for, if not configured.
+const DefaultCacheTTL = Duration(6 * time.Hour)
+
+// DefaultCacheSize is the most entries kept in the lookup cache, if not configured.
+const DefaultCacheSize = 10000
+
+// DefaultLookupTimeout is how long all the lookups for a request may take, if not configured.
+const DefaultLookupTimeout = Duration(10 * time.Second)
+
 // Config contains all the configuration options for this application.
-// TODO Turn this into a config file that gets parsed onstartup
+//
+// It can be built in code, or read from a file with Load. The yaml (and json and toml) tags are the
+// keys used in config files, and MYIP_ followed by the upper-cased key is the environment variable
+// that overrides it.
 type Config struct {
 	// The build version
-	Version string
+	Version string `json:"-" yaml:"-" toml:"-"`
 
 	// The build time
-	BuildTime string
+	BuildTime string `json:"-" yaml:"-" toml:"-"`
 
-	Host  string `json:",omitempty"`
-	Host4 string `json:",omitempty"`
-	Host6 string `json:",omitempty"`
+	Host  string `json:"host,omitempty" yaml:"host" toml:"host"`
+	Host4 string `json:"host4,omitempty" yaml:"host4" toml:"host4"`
+	Host6 string `json:"host6,omitempty" yaml:"host6" toml:"host6"`
 
 	// AllowedOrigins is a list of additional origins allowed via CORS.
 	// Supports * as a wildcard.
-	AllowedOrigins []string `json:",omitempty"`
+	AllowedOrigins []string `json:"allowed_origins,omitempty" yaml:"allowed_origins" toml:"allowed_origins"`
 
 	// Debug enables unsafe options for debugging
-	Debug bool `json:",omitempty"`
+	Debug bool `json:"debug,omitempty" yaml:"debug" toml:"debug"`
+
+	// TrustedProxies is a list of networks (in CIDR notation) or addresses of proxies, whose
+	// X-Forwarded-For, Forwarded or Cf-Connecting-Ip headers are trusted to contain the client's
+	// address. For example, the load balancer and CloudFlare's ranges.
+	TrustedProxies []string `json:"trusted_proxies,omitempty" yaml:"trusted_proxies" toml:"trusted_proxies"`
+
+	// ProxyHeader is the header the nearest trusted proxy appends the client's address to, one of
+	// "Forwarded", "X-Forwarded-For" or "Cf-Connecting-Ip". Only that header is believed, so a
+	// client can't add its own copy of another. If empty, X-Forwarded-For is used if present, then
+	// Forwarded, then Cf-Connecting-Ip.
+	ProxyHeader string `json:"proxy_header,omitempty" yaml:"proxy_header" toml:"proxy_header"`
+
+	// ProxyProtocolUpstreams is a list of networks (in CIDR notation) or addresses of TCP load
+	// balancers that send a HAProxy PROXY protocol (v1 or v2) header at the start of each
+	// connection. Connections from anywhere else are assumed not to have the header.
+	ProxyProtocolUpstreams []string `json:"proxy_protocol_upstreams,omitempty" yaml:"proxy_protocol_upstreams" toml:"proxy_protocol_upstreams"`
+
+	// DNSZone is the domain delegated to our DNS server, which answers queries with the address of
+	// the resolver that asked, e.g. "whoami.example.net".
+	DNSZone string `json:"dns_zone,omitempty" yaml:"dns_zone" toml:"dns_zone"`
+
+	// DisableLookup turns off the /lookup/ endpoint, which looks up any address, not just the
+	// client's.
+	DisableLookup bool `json:"disable_lookup,omitempty" yaml:"disable_lookup" toml:"disable_lookup"`
+
+	// LookupRateLimit is the number of /lookup/ requests each client may make per minute. Zero uses
+	// DefaultLookupRateLimit, and a negative number removes the limit.
+	LookupRateLimit int `json:"lookup_rate_limit,omitempty" yaml:"lookup_rate_limit" toml:"lookup_rate_limit"`
+
+	// BulkLookupWorkers is the number of addresses a POST to /lookup looks up at once. Zero uses
+	// DefaultBulkLookupWorkers.
+	BulkLookupWorkers int `json:"bulk_lookup_workers,omitempty" yaml:"bulk_lookup_workers" toml:"bulk_lookup_workers"`
+
+	// CacheTTL is how long RDAP and WHOIS results are cached for. Zero uses DefaultCacheTTL.
+	CacheTTL Duration `json:"cache_ttl,omitempty" yaml:"cache_ttl" toml:"cache_ttl"`
+
+	// CacheSize is the most entries kept in the lookup cache. Zero uses DefaultCacheSize, and a
+	// negative number disables the cache.
+	CacheSize int `json:"cache_size,omitempty" yaml:"cache_size" toml:"cache_size"`
+
+	// LookupTimeout is the deadline for all the lookups made for a request. Any still running are
+	// abandoned, and reported as timed out. Zero uses DefaultLookupTimeout.
+	LookupTimeout Duration `json:"lookup_timeout,omitempty" yaml:"lookup_timeout" toml:"lookup_timeout"`
+
+	// ReverseTimeout, RDAPTimeout and WhoisTimeout are shorter deadlines for each kind of lookup, so
+	// one slow source can't use up all of LookupTimeout. Zero means only LookupTimeout applies.
+	ReverseTimeout Duration `json:"reverse_timeout,omitempty" yaml:"reverse_timeout" toml:"reverse_timeout"`
+	RDAPTimeout    Duration `json:"rdap_timeout,omitempty" yaml:"rdap_timeout" toml:"rdap_timeout"`
+	WhoisTimeout   Duration `json:"whois_timeout,omitempty" yaml:"whois_timeout" toml:"whois_timeout"`
+
+	// RDAPBootstrapDir is a directory to keep the RDAP bootstrap files in, which say which registry
+	// to ask about each address, so they survive restarts. Files put there by hand are used instead
+	// of the copy built in.
+	RDAPBootstrapDir string `json:"rdap_bootstrap_dir,omitempty" yaml:"rdap_bootstrap_dir" toml:"rdap_bootstrap_dir"`
+
+	// RDAPBootstrapOffline stops the RDAP bootstrap files being refreshed from IANA, so only those
+	// in RDAPBootstrapDir, or built in, are used.
+	RDAPBootstrapOffline bool `json:"rdap_bootstrap_offline,omitempty" yaml:"rdap_bootstrap_offline" toml:"rdap_bootstrap_offline"`
+
+	// DisableRDAPHierarchy stops RDAP lookups following each network's parents, which costs up to
+	// five more requests to the registries.
+	DisableRDAPHierarchy bool `json:"disable_rdap_hierarchy,omitempty" yaml:"disable_rdap_hierarchy" toml:"disable_rdap_hierarchy"`
+
+	// PrefixToASFile is a prefix-to-AS table, used to find the prefix and AS announcing the client's
+	// address. It's either a CAIDA pfx2as file, or an MRT RIB dump, optionally gzip or bzip2
+	// compressed, and is reloaded when it changes. The origin AS isn't shown if empty.
+	PrefixToASFile string `json:"prefix_to_as_file,omitempty" yaml:"prefix_to_as_file" toml:"prefix_to_as_file"`
 
 	// LatLongHeader is the header with the LatLong information
 	// Examples:
 	//   "X-Appengine-Citylatlong" for App Engine (Standard)
-	LatLongHeader string `json:",omitempty"`
+	LatLongHeader string `json:"latlong_header,omitempty" yaml:"latlong_header" toml:"latlong_header"`
 
 	// CityHeader is the header with the city information
 	// Examples:
 	//   "Cf-Ipcountry" for CloudFlare
 	//   "X-Appengine-City" for App Engine (Standard)
-	CityHeader string `json:",omitempty"`
+	CityHeader string `json:"city_header,omitempty" yaml:"city_header" toml:"city_header"`
 
 	// TODO Document
-	RegionHeader  string `json:",omitempty"`
-	CountryHeader string `json:",omitempty"`
+	RegionHeader  string `json:"region_header,omitempty" yaml:"region_header" toml:"region_header"`
+	CountryHeader string `json:"country_header,omitempty" yaml:"country_header" toml:"country_header"`
 
 	// RequestIDHeader is the header with the Request ID
 	// Examples:
 	//   "Cf-Ray" for CloudFlare
 	//   "X-Appengine-City" for App Engine (Standard)
-	RequestIDHeader string `json:",omitempty"`
+	RequestIDHeader string `json:"request_id_header,omitempty" yaml:"request_id_header" toml:"request_id_header"`
 
 	// DisallowedHeaders is a list of headers filtered from the response. These either add no value
 	// or leak information that we don't want displayed to the user.
-	DisallowedHeaders []string `json:",omitempty"`
+	DisallowedHeaders []string `json:"disallowed_headers,omitempty" yaml:"disallowed_headers" toml:"disallowed_headers"`
 
 	// MapsAPIKey is used to render static Google Maps.
 	// Request your own at https://developers.google.com/maps/documentation/static-maps/
 	// To secure your key, you must also configure MapsAPISigningKey.
-	MapsAPIKey string `json:",omitempty"`
+	MapsAPIKey string `json:"maps_api_key,omitempty" yaml:"maps_api_key" toml:"maps_api_key"`
 
 	// MapsAPISigningKey is a secret key that allows you to sign the map URL request
 	// to prove we are the owning of the static map api key.
-	// This can be configured via an environment variable (MAPS_API_SIGNING_KEY), or stored in a secret manager (e.g. Google Secret Manager).
-	MapsAPISigningKey []byte `json:",omitempty"`
+	// This can be configured via an environment variable (MYIP_MAPS_API_SIGNING_KEY, base64 encoded),
+	// or stored in a secret manager (e.g. Google Secret Manager). It can't be set in a config file.
+	// The old MAPS_API_SIGNING_KEY variable is still read, if the new one isn't set.
+	MapsAPISigningKey []byte `json:"-" yaml:"-" toml:"-" env:"maps_api_signing_key" deprecated_env:"MAPS_API_SIGNING_KEY"`
 }
 
 // MatchOrigin returns true if the given origin matches the allowed hosts or origins.
@@ -104,20 +197,52 @@ func (c *Config) MatchOrigin(origin string) bool {
 	return false
 }
 
+// ParsePrefixes parses a list of networks in CIDR notation. Single addresses are also accepted,
+// and treated as a network containing only that address.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clone returns a copy of the config, that shares no slices with it, so decoding into the copy
+// doesn't change the original.
+func (c *Config) clone() *Config {
+	configCopy := *c
+	configCopy.AllowedOrigins = slices.Clone(c.AllowedOrigins)
+	configCopy.TrustedProxies = slices.Clone(c.TrustedProxies)
+	configCopy.ProxyProtocolUpstreams = slices.Clone(c.ProxyProtocolUpstreams)
+	configCopy.DisallowedHeaders = slices.Clone(c.DisallowedHeaders)
+	configCopy.MapsAPISigningKey = slices.Clone(c.MapsAPISigningKey)
+	return &configCopy
+}
+
 // ApplyDefaults returns a new config with any zero field in config, set to the default value.
 func ApplyDefaults(config, defaults *Config) (*Config, error) {
 	configCopy := &Config{}
-	*configCopy = *defaults // Copy default
+	*configCopy = *config
 
-	// Hack, Marshal the config, and Unmarshalling it over a copy of the defaults. Thus replacing
-	// any fields that were explictly set, and zero
-	tmp, err := json.Marshal(config)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := json.Unmarshal(tmp, configCopy); err != nil {
-		return nil, err
+	dst := reflect.ValueOf(configCopy).Elem()
+	src := reflect.ValueOf(defaults).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if field := dst.Field(i); field.IsZero() {
+			field.Set(src.Field(i))
+		}
 	}
 
 	return configCopy, nil
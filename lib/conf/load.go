@@ -0,0 +1,224 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the (upper-cased) config key to form the environment variable name.
+const envPrefix = "MYIP_"
+
+// Load starts with defaults, overlays the config file at path, and then any MYIP_* environment
+// variables, and validates the result. Anything set in the file or environment, even to false or
+// zero, replaces the default. The file format is picked by the
+// extension, one of .yaml, .yml, .toml or .json. path and defaults may both be empty.
+//
+// If the config is invalid, the returned error is a *ValidationError.
+func Load(path string, defaults *Config) (*Config, error) {
+	return load(path, defaults, os.LookupEnv)
+}
+
+func load(path string, defaults *Config, lookupEnv func(string) (string, bool)) (*Config, error) {
+	config := &Config{}
+	if defaults != nil {
+		config = defaults.clone()
+	}
+
+	// set records which fields were explicitly set, so we can tell set-but-empty from unset.
+	set := map[string]bool{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := decode(filepath.Ext(path), data, config, set); err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(config, set, lookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := config.validate(set); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// decode parses data in the format given by ext into config. Unknown keys are an error, as
+// they are most likely typos.
+func decode(ext string, data []byte, config *Config, set map[string]bool) error {
+	var keys map[string]interface{}
+
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(config); err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &keys); err != nil {
+			return err
+		}
+
+	case ".toml":
+		md, err := toml.Decode(string(data), config)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown keys %v", undecoded)
+		}
+		if _, err := toml.Decode(string(data), &keys); err != nil {
+			return err
+		}
+
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(config); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown config file format %q", ext)
+	}
+
+	t := reflect.TypeOf(*config)
+	for key := range keys {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			// All the formats use the same keys, but JSON's are case insensitive.
+			if name := f.Tag.Get("yaml"); name != "-" && strings.EqualFold(key, name) {
+				set[f.Name] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// envName returns the environment variable that overrides the field, or "" if it can't be set.
+func envName(f reflect.StructField) string {
+	name := f.Tag.Get("env")
+	if name == "" {
+		name = f.Tag.Get("yaml")
+	}
+	if name == "" || name == "-" {
+		return ""
+	}
+	return envPrefix + strings.ToUpper(name)
+}
+
+// applyEnv overlays any environment variables on top of config. Lists are comma separated, and
+// byte slices are URL safe base64 encoded. A field's old variable, named by its deprecated_env tag,
+// is used if the new one isn't set.
+func applyEnv(config *Config, set map[string]bool, lookupEnv func(string) (string, bool)) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := envName(t.Field(i))
+		if name == "" {
+			continue
+		}
+
+		value, found := lookupEnv(name)
+		if old := t.Field(i).Tag.Get("deprecated_env"); !found && old != "" {
+			if value, found = lookupEnv(old); found {
+				log.Warnf("%s is deprecated, set %s instead", old, name)
+				name = old
+			}
+		}
+		if !found {
+			continue
+		}
+
+		if err := setField(v.Field(i), strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("parsing %s: %w", name, err)
+		}
+		set[t.Field(i).Name] = true
+	}
+
+	return nil
+}
+
+// setField parses value and stores it in field.
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case Duration:
+		var d Duration
+		if err := d.UnmarshalText([]byte(value)); err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+
+	case int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+
+	case []string:
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+
+	case []byte:
+		b, err := base64.URLEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		field.SetBytes(b)
+
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// noEnv is a lookupEnv that never finds anything.
+func noEnv(string) (string, bool) { return "", false }
+
+// writeConfig writes contents to a temporary file with the given name, returning the path.
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(contents), 0600); err != nil {
+		t.Fatalf("WriteFile(%q) failed: %s", p, err)
+	}
+	return p
+}
+
+func TestLoadFormats(t *testing.T) {
+	want := &Config{
+		Host:           "ip.example.net",
+		Host4:          "ip4.example.net",
+		Host6:          "ip6.example.net",
+		AllowedOrigins: []string{"*.example.net"},
+		LatLongHeader:  "X-Latlong",
+		CacheTTL:       Duration(90 * time.Minute),
+	}
+
+	data := []struct {
+		name     string
+		contents string
+	}{
+		{"config.yaml", `
+host: ip.example.net
+host4: ip4.example.net
+host6: ip6.example.net
+allowed_origins: ["*.example.net"]
+latlong_header: X-Latlong
+cache_ttl: 1h30m
+`},
+		{"config.toml", `
+host = "ip.example.net"
+host4 = "ip4.example.net"
+host6 = "ip6.example.net"
+allowed_origins = ["*.example.net"]
+latlong_header = "X-Latlong"
+cache_ttl = "1h30m"
+`},
+		{"config.json", `{
+	"host": "ip.example.net",
+	"host4": "ip4.example.net",
+	"host6": "ip6.example.net",
+	"allowed_origins": ["*.example.net"],
+	"latlong_header": "X-Latlong",
+	"cache_ttl": "1h30m"
+}`},
+	}
+
+	for _, test := range data {
+		got, err := load(writeConfig(t, test.name, test.contents), nil, noEnv)
+		if err != nil {
+			t.Errorf("load(%q) err: %s, want nil", test.name, err)
+			continue
+		}
+		if diff := pretty.Compare(got, want); diff != "" {
+			t.Errorf("load(%q) diff (-got +want)\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		contents string
+	}{
+		{"config.yaml", "hostt: ip.example.net\n"},
+		{"config.toml", "hostt = \"ip.example.net\"\n"},
+		{"config.json", `{"hostt": "ip.example.net"}`},
+		{"config.json", `{"Version": "1.0"}`},
+		{"config.json", `{"BuildTime": "now"}`},
+		{"config.json", `{"MapsAPISigningKey": "AQID"}`},
+		{"config.json", `{"maps_api_signing_key": "AQID"}`},
+		{"config.ini", "host = ip.example.net\n"},
+	} {
+		if _, err := load(writeConfig(t, test.name, test.contents), nil, noEnv); err == nil {
+			t.Errorf("load(%q) err = nil, want error", test.name)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	env := map[string]string{
+		"MYIP_HOST":                 "env.example.net",
+		"MYIP_DEBUG":                "true",
+		"MYIP_DISALLOWED_HEADERS":   "X-One, X-Two",
+		"MYIP_MAPS_API_SIGNING_KEY": "AQID",
+		"MYIP_LOOKUP_RATE_LIMIT":    "30",
+		"MYIP_CACHE_TTL":            "10m",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		value, found := env[key]
+		return value, found
+	}
+
+	path := writeConfig(t, "config.yaml", "host: file.example.net\nhost4: ip4.example.net\n")
+	defaults := &Config{
+		Host4:      "default4.example.net",
+		Host6:      "default6.example.net",
+		MapsAPIKey: "key",
+	}
+
+	got, err := load(path, defaults, lookupEnv)
+	if err != nil {
+		t.Fatalf("load() err: %s, want nil", err)
+	}
+
+	want := &Config{
+		Host:              "env.example.net",
+		Host4:             "ip4.example.net",
+		Host6:             "default6.example.net",
+		Debug:             true,
+		DisallowedHeaders: []string{"X-One", "X-Two"},
+		LookupRateLimit:   30,
+		CacheTTL:          Duration(10 * time.Minute),
+		MapsAPIKey:        "key",
+		MapsAPISigningKey: []byte{1, 2, 3},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("load() diff (-got +want)\n%s", diff)
+	}
+}
+
+func TestLoadDeprecatedEnv(t *testing.T) {
+	data := []struct {
+		name string
+		env  map[string]string
+		want []byte
+	}{
+		{"old name", map[string]string{"MAPS_API_SIGNING_KEY": "AQID"}, []byte{1, 2, 3}},
+		{"new name wins", map[string]string{"MAPS_API_SIGNING_KEY": "AQID", "MYIP_MAPS_API_SIGNING_KEY": "BAUG"}, []byte{4, 5, 6}},
+		{"neither", map[string]string{}, nil},
+	}
+
+	for _, test := range data {
+		lookupEnv := func(key string) (string, bool) {
+			value, found := test.env[key]
+			return value, found
+		}
+
+		got, err := load("", nil, lookupEnv)
+		if err != nil {
+			t.Errorf("%s: load() err: %s, want nil", test.name, err)
+			continue
+		}
+		if diff := pretty.Compare(got.MapsAPISigningKey, test.want); diff != "" {
+			t.Errorf("%s: load() MapsAPISigningKey diff (-got +want)\n%s", test.name, diff)
+		}
+	}
+
+	bad := func(key string) (string, bool) {
+		return "not base64!", key == "MAPS_API_SIGNING_KEY"
+	}
+	if _, err := load("", nil, bad); err == nil || !strings.Contains(err.Error(), "MAPS_API_SIGNING_KEY") {
+		t.Errorf("load() with an invalid MAPS_API_SIGNING_KEY err = %v, want an error naming it", err)
+	}
+}
+
+func TestLoadOverridesDefaults(t *testing.T) {
+	env := map[string]string{
+		"MYIP_DEBUG": "false",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		value, found := env[key]
+		return value, found
+	}
+
+	defaults := &Config{
+		Debug:           true,
+		LookupRateLimit: DefaultLookupRateLimit,
+		CacheSize:       DefaultCacheSize,
+		AllowedOrigins:  []string{"a.example.net", "b.example.net"},
+	}
+
+	for _, test := range []struct {
+		name     string
+		contents string
+	}{
+		{"config.yaml", "lookup_rate_limit: 0\nallowed_origins: [c.example.net]\n"},
+		{"config.toml", "lookup_rate_limit = 0\nallowed_origins = [\"c.example.net\"]\n"},
+		{"config.json", `{"lookup_rate_limit": 0, "allowed_origins": ["c.example.net"]}`},
+	} {
+		got, err := load(writeConfig(t, test.name, test.contents), defaults, lookupEnv)
+		if err != nil {
+			t.Errorf("load(%q) err: %s, want nil", test.name, err)
+			continue
+		}
+
+		want := &Config{
+			CacheSize:      DefaultCacheSize,
+			AllowedOrigins: []string{"c.example.net"},
+		}
+		if diff := pretty.Compare(got, want); diff != "" {
+			t.Errorf("load(%q) diff (-got +want)\n%s", test.name, diff)
+		}
+	}
+
+	if got := defaults.AllowedOrigins[0]; got != "a.example.net" {
+		t.Errorf("load() modified the defaults, AllowedOrigins[0] = %q", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	data := []struct {
+		name     string
+		contents string
+		want     error
+	}{
+		{"same-host.yaml", "host4: ip.example.net\nhost6: ip.example.net\n", ErrSameHost},
+		{"bad-origin.yaml", "allowed_origins: [\"[*.example.net\"]\n", ErrBadPattern},
+		{"empty-header.yaml", "latlong_header: \"\"\n", ErrEmptyHeader},
+		{"blank-header.yaml", "city_header: \" \"\n", ErrEmptyHeader},
+		{"bad-header.yaml", "request_id_header: \"X Request\"\n", ErrBadHeader},
+		{"bad-proxy.yaml", "trusted_proxies: [\"10.0.0.0/33\"]\n", ErrBadCIDR},
+		{"bad-proxy-header.yaml", "proxy_header: X-Real-Ip\n", ErrBadProxyHeader},
+		{"bad-zone.yaml", "dns_zone: whoami..example.net\n", ErrBadDomain},
+		{"bad-workers.yaml", "bulk_lookup_workers: -1\n", ErrNegative},
+		{"bad-ttl.yaml", "cache_ttl: -1h\n", ErrNegative},
+		{"bad-timeout.yaml", "rdap_timeout: -5s\n", ErrNegative},
+	}
+
+	for _, test := range data {
+		_, err := load(writeConfig(t, test.name, test.contents), nil, noEnv)
+		if !errors.Is(err, test.want) {
+			t.Errorf("load(%q) err = %v, want %v", test.name, err, test.want)
+		}
+
+		var v *ValidationError
+		if !errors.As(err, &v) || len(v.Errors) != 1 {
+			t.Errorf("load(%q) err = %#v, want a ValidationError with one error", test.name, err)
+		}
+	}
+
+	// An unset header is fine.
+	if _, err := load(writeConfig(t, "ok.yaml", "host: ip.example.net\n"), nil, noEnv); err != nil {
+		t.Errorf("load(%q) err: %s, want nil", "ok.yaml", err)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	config := &Config{Host: "ip.example.net"}
+	defaults := &Config{Host: "default.example.net", CityHeader: "X-City"}
+
+	got, err := ApplyDefaults(config, defaults)
+	if err != nil {
+		t.Fatalf("ApplyDefaults() err: %s, want nil", err)
+	}
+
+	want := &Config{Host: "ip.example.net", CityHeader: "X-City"}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("ApplyDefaults() diff (-got +want)\n%s", diff)
+	}
+	if config.CityHeader != "" {
+		t.Errorf("ApplyDefaults() modified its argument")
+	}
+}
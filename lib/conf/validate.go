@@ -0,0 +1,217 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrSameHost is returned when the IPv4 and IPv6 only hosts are the same.
+	ErrSameHost = errors.New("must be different to Host4")
+
+	// ErrBadPattern is returned when a wildcard pattern is malformed.
+	ErrBadPattern = errors.New("malformed pattern")
+
+	// ErrEmptyHeader is returned when a header name is set, but empty.
+	ErrEmptyHeader = errors.New("header name is set but empty")
+
+	// ErrBadHeader is returned when a header name contains invalid characters.
+	ErrBadHeader = errors.New("invalid header name")
+
+	// ErrBadProxyHeader is returned when the proxy header isn't one we know how to parse.
+	ErrBadProxyHeader = errors.New("must be Forwarded, X-Forwarded-For or Cf-Connecting-Ip")
+
+	// ErrBadCIDR is returned when a network is not valid CIDR notation.
+	ErrBadCIDR = errors.New("invalid CIDR")
+
+	// ErrBadDomain is returned when a domain name is malformed.
+	ErrBadDomain = errors.New("invalid domain name")
+
+	// ErrNegative is returned when a number must not be negative.
+	ErrNegative = errors.New("must not be negative")
+)
+
+// FieldError describes a single invalid field in a Config.
+type FieldError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %q: %s", e.Field, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError contains every problem found while validating a Config. Use errors.Is to
+// check for a specific problem, e.g. errors.Is(err, ErrSameHost).
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Validate checks the config for mistakes, returning a *ValidationError if any are found.
+func (c *Config) Validate() error {
+	return c.validate(nil)
+}
+
+// validate checks the config, where set contains the names of the fields that were explicitly
+// set (for example in a config file), even if to the zero value.
+func (c *Config) validate(set map[string]bool) error {
+	v := &ValidationError{}
+	add := func(field, value string, err error) {
+		v.Errors = append(v.Errors, &FieldError{Field: field, Value: value, Err: err})
+	}
+
+	if c.Host4 != "" && c.Host4 == c.Host6 {
+		add("Host6", c.Host6, ErrSameHost)
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil || origin == "" {
+			add("AllowedOrigins", origin, ErrBadPattern)
+		}
+	}
+
+	for _, list := range []struct {
+		field string
+		cidrs []string
+	}{
+		{"TrustedProxies", c.TrustedProxies},
+		{"ProxyProtocolUpstreams", c.ProxyProtocolUpstreams},
+	} {
+		for _, cidr := range list.cidrs {
+			if _, err := ParsePrefixes([]string{cidr}); err != nil {
+				add(list.field, cidr, ErrBadCIDR)
+			}
+		}
+	}
+
+	switch textproto.CanonicalMIMEHeaderKey(c.ProxyHeader) {
+	case "", "Forwarded", "X-Forwarded-For", "Cf-Connecting-Ip":
+	default:
+		add("ProxyHeader", c.ProxyHeader, ErrBadProxyHeader)
+	}
+
+	for _, d := range []struct {
+		field string
+		value Duration
+	}{
+		{"CacheTTL", c.CacheTTL},
+		{"LookupTimeout", c.LookupTimeout},
+		{"ReverseTimeout", c.ReverseTimeout},
+		{"RDAPTimeout", c.RDAPTimeout},
+		{"WhoisTimeout", c.WhoisTimeout},
+	} {
+		if d.value < 0 {
+			add(d.field, d.value.String(), ErrNegative)
+		}
+	}
+
+	if c.BulkLookupWorkers < 0 {
+		add("BulkLookupWorkers", strconv.Itoa(c.BulkLookupWorkers), ErrNegative)
+	}
+
+	if c.DNSZone != "" && !validDomain(c.DNSZone) {
+		add("DNSZone", c.DNSZone, ErrBadDomain)
+	}
+
+	for _, h := range []struct {
+		field, value string
+	}{
+		{"LatLongHeader", c.LatLongHeader},
+		{"CityHeader", c.CityHeader},
+		{"RegionHeader", c.RegionHeader},
+		{"CountryHeader", c.CountryHeader},
+		{"RequestIDHeader", c.RequestIDHeader},
+	} {
+		if strings.TrimSpace(h.value) == "" {
+			if h.value != "" || set[h.field] {
+				add(h.field, h.value, ErrEmptyHeader)
+			}
+			continue
+		}
+		if !validHeader(h.value) {
+			add(h.field, h.value, ErrBadHeader)
+		}
+	}
+
+	for _, header := range c.DisallowedHeaders {
+		if !validHeader(header) {
+			add("DisallowedHeaders", header, ErrBadHeader)
+		}
+	}
+
+	if len(v.Errors) > 0 {
+		return v
+	}
+	return nil
+}
+
+// validHeader returns true if name is a valid HTTP header name (a RFC 7230 token).
+func validHeader(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r >= 0x7f || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validDomain returns true if name is a valid domain name, optionally fully qualified.
+func validDomain(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -16,7 +16,12 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"net"
+	"slices"
+	"time"
+
+	"bramp.net/myip/lib/coalesce"
 )
 
 var (
@@ -25,6 +30,9 @@ var (
 
 		// TODO In future perhaps override `Dial` so we can force the DNS server that is used.
 	}
+
+	// lookups coalesces concurrent reverse lookups of the same address.
+	lookups coalesce.Group[[]string]
 )
 
 // Response contains the DNS data we send to the user.
@@ -34,25 +42,34 @@ type Response struct {
 	// One of the following
 	Names []string `json:",omitempty"`
 	Error string   `json:",omitempty"`
+
+	// Duration is how long the lookup took, in milliseconds.
+	Duration int `json:",omitempty"`
+
+	// TimedOut is set if the lookup was abandoned because the context's deadline passed.
+	TimedOut bool `json:",omitempty"`
 }
 
 // HandleReverseDNS generates a dns.Response for the given IP address.
 func HandleReverseDNS(ctx context.Context, ipAddr string) *Response {
+	start := time.Now()
 	names, err := LookupAddr(ctx, ipAddr)
 
 	resp := &Response{
-		Query: ipAddr,
-		Names: names,
+		Query:    ipAddr,
+		Names:    names,
+		Duration: int(time.Since(start).Milliseconds()),
 	}
 	if err != nil {
 		resp.Error = err.Error()
+		resp.TimedOut = errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded)
 	}
 
 	return resp
 }
 
 // LookupAddr performs a reverse lookup for the given address, returning a list
-// of names mapping to that address.
+// of names mapping to that address. Concurrent lookups of the same address share a query.
 func LookupAddr(ctx context.Context, ipAddr string) ([]string, error) {
 	// Special case localhost
 	if ip := net.ParseIP(ipAddr); ip.IsLoopback() {
@@ -63,5 +80,11 @@ func LookupAddr(ctx context.Context, ipAddr string) ([]string, error) {
 	}
 
 	// Issue a real DNS query
-	return dns.LookupAddr(ctx, ipAddr)
+	names, shared, err := lookups.Do(ctx, ipAddr, func(ctx context.Context) ([]string, error) {
+		return dns.LookupAddr(ctx, ipAddr)
+	})
+	if shared {
+		names = slices.Clone(names)
+	}
+	return names, err
 }
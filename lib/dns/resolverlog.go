@@ -0,0 +1,169 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// LeakLabel is the label under the zone used for resolver leak tests. The browser looks up
+	// <nonce>.leak.<zone>, and we record which resolvers asked.
+	LeakLabel = "leak"
+
+	// ResolverLogTTL is how long resolvers are remembered for each nonce.
+	ResolverLogTTL = 5 * time.Minute
+
+	// ResolverLogSize is the maximum number of nonces remembered.
+	ResolverLogSize = 10000
+
+	// ResolverLogMaxResolvers is the maximum number of resolvers remembered for each nonce. Few
+	// clients use more than a handful, and anyone can send queries for a nonce from spoofed
+	// addresses.
+	ResolverLogMaxResolvers = 16
+)
+
+// ValidNonce returns true if nonce is suitable for a leak test, that is 16 to 63 lower case
+// letters or digits. It must be long enough to be unguessable, and fit in a single DNS label.
+func ValidNonce(nonce string) bool {
+	if len(nonce) < 16 || len(nonce) > 63 {
+		return false
+	}
+	for _, r := range nonce {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolverLog records which recursive resolvers looked up each leak test nonce. It is safe for
+// concurrent use.
+type ResolverLog struct {
+	// TTL is how long each nonce is remembered. Defaults to ResolverLogTTL.
+	TTL time.Duration
+
+	// Size is the maximum number of nonces remembered. Defaults to ResolverLogSize.
+	Size int
+
+	// MaxResolvers is the maximum number of resolvers remembered for each nonce, any more are
+	// ignored. Defaults to ResolverLogMaxResolvers.
+	MaxResolvers int
+
+	mu      sync.Mutex
+	entries map[string]*resolverLogEntry
+
+	now func() time.Time // for testing
+}
+
+type resolverLogEntry struct {
+	created   time.Time
+	resolvers []netip.Addr
+}
+
+func (l *ResolverLog) ttl() time.Duration {
+	if l.TTL == 0 {
+		return ResolverLogTTL
+	}
+	return l.TTL
+}
+
+func (l *ResolverLog) size() int {
+	if l.Size == 0 {
+		return ResolverLogSize
+	}
+	return l.Size
+}
+
+func (l *ResolverLog) maxResolvers() int {
+	if l.MaxResolvers == 0 {
+		return ResolverLogMaxResolvers
+	}
+	return l.MaxResolvers
+}
+
+func (l *ResolverLog) timeNow() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Add records that resolver looked up nonce, unless MaxResolvers already have.
+func (l *ResolverLog) Add(nonce string, resolver netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.timeNow()
+
+	if l.entries == nil {
+		l.entries = make(map[string]*resolverLogEntry)
+	}
+
+	e, found := l.entries[nonce]
+	if found && now.Sub(e.created) > l.ttl() {
+		found = false
+	}
+	if !found {
+		if len(l.entries) >= l.size() {
+			l.evict(now)
+		}
+		e = &resolverLogEntry{created: now}
+		l.entries[nonce] = e
+	}
+
+	for _, r := range e.resolvers {
+		if r == resolver {
+			return
+		}
+	}
+	if len(e.resolvers) >= l.maxResolvers() {
+		return
+	}
+	e.resolvers = append(e.resolvers, resolver)
+}
+
+// evict removes the expired entries, and if that's not enough, the oldest one. Must be called
+// with the lock held.
+func (l *ResolverLog) evict(now time.Time) {
+	var oldest string
+	for nonce, e := range l.entries {
+		if now.Sub(e.created) > l.ttl() {
+			delete(l.entries, nonce)
+			continue
+		}
+		if oldest == "" || e.created.Before(l.entries[oldest].created) {
+			oldest = nonce
+		}
+	}
+
+	if len(l.entries) >= l.size() && oldest != "" {
+		delete(l.entries, oldest)
+	}
+}
+
+// Get returns the resolvers that looked up nonce, in the order they were first seen.
+func (l *ResolverLog) Get(nonce string) []netip.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, found := l.entries[nonce]
+	if !found || l.timeNow().Sub(e.created) > l.ttl() {
+		return nil
+	}
+	return append([]netip.Addr(nil), e.resolvers...)
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestResolverLog(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &ResolverLog{
+		TTL:  time.Minute,
+		Size: 2,
+		now:  func() time.Time { return now },
+	}
+
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("2001:db8::1")
+
+	l.Add("nonce1", a)
+	l.Add("nonce1", b)
+	l.Add("nonce1", a) // Duplicate
+
+	if got, want := fmt.Sprint(l.Get("nonce1")), "[192.0.2.1 2001:db8::1]"; got != want {
+		t.Errorf("Get(nonce1) = %s, want %s", got, want)
+	}
+	if got := l.Get("unknown"); got != nil {
+		t.Errorf("Get(unknown) = %v, want nil", got)
+	}
+
+	// Adding more than Size nonces evicts the oldest.
+	now = now.Add(time.Second)
+	l.Add("nonce2", a)
+	now = now.Add(time.Second)
+	l.Add("nonce3", a)
+
+	if got := l.Get("nonce1"); got != nil {
+		t.Errorf("Get(nonce1) = %v after eviction, want nil", got)
+	}
+	if got := l.Get("nonce3"); len(got) != 1 {
+		t.Errorf("Get(nonce3) = %v, want one resolver", got)
+	}
+
+	// And entries expire after the TTL.
+	now = now.Add(2 * time.Minute)
+	if got := l.Get("nonce3"); got != nil {
+		t.Errorf("Get(nonce3) = %v after TTL, want nil", got)
+	}
+}
+
+func TestResolverLogMaxResolvers(t *testing.T) {
+	l := &ResolverLog{MaxResolvers: 2}
+
+	for _, r := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"} {
+		l.Add("nonce1", netip.MustParseAddr(r))
+	}
+
+	if got, want := fmt.Sprint(l.Get("nonce1")), "[192.0.2.1 192.0.2.2]"; got != want {
+		t.Errorf("Get(nonce1) = %s, want %s", got, want)
+	}
+}
+
+func TestValidNonce(t *testing.T) {
+	data := []struct {
+		nonce string
+		want  bool
+	}{
+		{"0123456789abcdef", true},
+		{"0123456789abcde", false}, // Too short
+		{"0123456789ABCDEF", false},
+		{"0123456789abcdef-", false},
+		{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", false}, // Too long
+	}
+
+	for _, test := range data {
+		if got := ValidNonce(test.nonce); got != test.want {
+			t.Errorf("ValidNonce(%q) = %t, want %t", test.nonce, got, test.want)
+		}
+	}
+}
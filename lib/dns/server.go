@@ -0,0 +1,288 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"bramp.net/myip/lib/rdap"
+	mdns "github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AnnotateTimeout bounds the reverse DNS and RDAP lookups used to annotate answers. Resolvers
+	// typically give up after a few seconds, so this must be short.
+	AnnotateTimeout = 2 * time.Second
+
+	// maxTXTLen is the longest string allowed in a TXT record.
+	maxTXTLen = 255
+)
+
+// Server is an authoritative DNS server for a "whoami" zone, similar to o-o.myaddr.l.google.com
+// or whoami.akamai.net. Any name in the zone answers with the address of the recursive resolver
+// that asked, so users can tell which resolver they are actually using.
+//
+// TXT queries return the resolver's address, annotated with its reverse DNS and owner from Lookup,
+// and the EDNS Client Subnet (if the resolver sent one). A and AAAA queries return the resolver's address,
+// if it is of the right family.
+//
+//	$ dig +short TXT whoami.example.net
+//
+// Names of the form <nonce>.leak.<zone> are used for resolver leak tests. They don't exist, but
+// the resolvers that asked for them are recorded in Log.
+type Server struct {
+	// Zone is the domain delegated to this server, e.g. "whoami.example.net".
+	Zone string
+
+	// Log records the resolvers that looked up leak test names. May be nil.
+	Log *ResolverLog
+
+	// Lookup returns the resolver's reverse DNS names, and RDAP network, to annotate TXT answers
+	// with. Queries are UDP, so their source is easily spoofed, and it should be cached and rate
+	// limited by resolver. If nil, TXT answers aren't annotated.
+	Lookup func(ctx context.Context, resolver netip.Addr) ([]string, *rdap.Response)
+
+	mu      sync.Mutex
+	servers []*mdns.Server
+}
+
+// ListenAndServe listens on both UDP and TCP on addr, and answers queries until Shutdown is
+// called.
+func (s *Server) ListenAndServe(addr string) error {
+	errs := make(chan error, 2)
+
+	s.mu.Lock()
+	for _, network := range []string{"udp", "tcp"} {
+		server := &mdns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: s,
+		}
+		s.servers = append(s.servers, server)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	s.mu.Unlock()
+
+	// Both servers return nil after Shutdown, so only the first result matters.
+	return <-errs
+}
+
+// Shutdown stops all servers started by ListenAndServe.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for _, server := range s.servers {
+		if e := server.ShutdownContext(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.servers = nil
+	return err
+}
+
+// ServeDNS answers a single DNS query.
+func (s *Server) ServeDNS(w mdns.ResponseWriter, req *mdns.Msg) {
+	resolver := addrOf(w.RemoteAddr())
+
+	ctx, cancel := context.WithTimeout(context.Background(), AnnotateTimeout)
+	defer cancel()
+
+	resp := s.answer(ctx, req, resolver)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		truncate(resp, req)
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		log.Warningf("DNS server failed to reply to %q: %s", resolver, err)
+	}
+}
+
+// answer builds the reply to req, which was sent by resolver.
+func (s *Server) answer(ctx context.Context, req *mdns.Msg, resolver netip.Addr) *mdns.Msg {
+	resp := new(mdns.Msg)
+	resp.SetReply(req)
+
+	if len(req.Question) != 1 {
+		resp.Rcode = mdns.RcodeFormatError
+		return resp
+	}
+
+	q := req.Question[0]
+	zone := mdns.Fqdn(s.Zone)
+	if q.Qclass != mdns.ClassINET || !mdns.IsSubDomain(zone, q.Name) {
+		resp.Rcode = mdns.RcodeRefused
+		return resp
+	}
+	resp.Authoritative = true
+
+	log.Infof("DNS query %s %q from %q", mdns.TypeToString[q.Qtype], q.Name, resolver)
+
+	if nonce, ok := leakNonce(q.Name, zone); ok {
+		if s.Log != nil {
+			s.Log.Add(nonce, resolver)
+		}
+
+		// Leak test names don't exist, so the browser fails fast without connecting anywhere.
+		resp.Rcode = mdns.RcodeNameError
+		resp.Ns = append(resp.Ns, soa(zone))
+		return resp
+	}
+
+	// Never cache the answers, as they depend on who is asking.
+	hdr := mdns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: mdns.ClassINET, Ttl: 0}
+
+	subnet := clientSubnet(req)
+
+	switch q.Qtype {
+	case mdns.TypeTXT:
+		resp.Answer = append(resp.Answer, &mdns.TXT{
+			Hdr: hdr,
+			Txt: s.annotate(ctx, resolver, subnet),
+		})
+
+	case mdns.TypeA:
+		if resolver.Is4() {
+			resp.Answer = append(resp.Answer, &mdns.A{Hdr: hdr, A: resolver.AsSlice()})
+		}
+
+	case mdns.TypeAAAA:
+		if resolver.Is6() {
+			resp.Answer = append(resp.Answer, &mdns.AAAA{Hdr: hdr, AAAA: resolver.AsSlice()})
+		}
+	}
+
+	if len(resp.Answer) == 0 {
+		// NODATA, with the SOA so the resolver knows how long to cache that for.
+		resp.Ns = append(resp.Ns, soa(zone))
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(mdns.DefaultMsgSize, false)
+		if subnet != nil {
+			// The answer is only valid for the subnet that asked (RFC 7871 Section 7.2.1).
+			echo := *subnet
+			echo.SourceScope = echo.SourceNetmask
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &echo)
+		}
+	}
+
+	return resp
+}
+
+// truncate makes resp fit in the largest UDP reply the sender of req accepts, which is 512 bytes
+// without EDNS0, setting the TC bit so it retries over TCP if anything was left out.
+func truncate(resp, req *mdns.Msg) {
+	size := mdns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	resp.Truncate(size)
+}
+
+// annotate returns the TXT strings describing the resolver, and the client subnet.
+func (s *Server) annotate(ctx context.Context, resolver netip.Addr, subnet *mdns.EDNS0_SUBNET) []string {
+	var names []string
+	var rdapResp *rdap.Response
+	if s.Lookup != nil {
+		names, rdapResp = s.Lookup(ctx, resolver)
+	}
+
+	txt := []string{resolver.String()}
+	for _, name := range names {
+		txt = append(txt, "reverse "+name)
+	}
+	if rdapResp != nil && rdapResp.Error == "" {
+		owner := rdapResp.Org()
+		if rdapResp.CIDR != "" {
+			owner += " " + rdapResp.CIDR
+		}
+		if rdapResp.Country != "" {
+			owner += " " + rdapResp.Country
+		}
+		txt = append(txt, "owner "+strings.TrimSpace(owner))
+	}
+	if subnet != nil {
+		txt = append(txt, fmt.Sprintf("edns0-client-subnet %s/%d", subnet.Address, subnet.SourceNetmask))
+	}
+
+	for i := range txt {
+		if len(txt[i]) > maxTXTLen {
+			txt[i] = txt[i][:maxTXTLen]
+		}
+	}
+	return txt
+}
+
+// leakNonce returns the nonce if name is a leak test name, <nonce>.leak.<zone>.
+func leakNonce(name, zone string) (string, bool) {
+	// Resolvers may randomise the case of the name (draft-vixie-dnsext-dns0x20).
+	name = strings.ToLower(name)
+
+	suffix := "." + LeakLabel + "." + strings.ToLower(zone)
+	nonce, found := strings.CutSuffix(name, suffix)
+	if !found || !ValidNonce(nonce) {
+		return "", false
+	}
+	return nonce, true
+}
+
+// clientSubnet returns the EDNS Client Subnet option from the request, or nil.
+func clientSubnet(req *mdns.Msg) *mdns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*mdns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// soa returns a minimal SOA record for the zone.
+func soa(zone string) *mdns.SOA {
+	return &mdns.SOA{
+		Hdr:     mdns.RR_Header{Name: zone, Rrtype: mdns.TypeSOA, Class: mdns.ClassINET, Ttl: 60},
+		Ns:      zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  0,
+	}
+}
+
+// addrOf returns the IP address of a UDP or TCP address.
+func addrOf(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
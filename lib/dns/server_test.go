@@ -0,0 +1,211 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"bramp.net/myip/lib/rdap"
+	"github.com/kylelemons/godebug/pretty"
+	mdns "github.com/miekg/dns"
+)
+
+func TestServerAnswer(t *testing.T) {
+	s := &Server{
+		Zone: "whoami.example.net",
+		Lookup: func(ctx context.Context, resolver netip.Addr) ([]string, *rdap.Response) {
+			return []string{"localhost"}, &rdap.Response{Query: resolver.String(), Name: "LOOPBACK", CIDR: "127.0.0.0/8"}
+		},
+	}
+
+	ecs := &mdns.EDNS0_SUBNET{
+		Code:          mdns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("192.0.2.0").To4(),
+	}
+
+	data := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		resolver  string
+		ecs       bool
+		wantRcode int
+		want      []string // Answer in zone file format
+	}{
+		{
+			name:      "txt",
+			qname:     "whoami.example.net.",
+			qtype:     mdns.TypeTXT,
+			resolver:  "127.0.0.1",
+			wantRcode: mdns.RcodeSuccess,
+			want:      []string{"whoami.example.net.\t0\tIN\tTXT\t\"127.0.0.1\" \"reverse localhost\" \"owner LOOPBACK 127.0.0.0/8\""},
+		},
+		{
+			name:      "txt with client subnet",
+			qname:     "abc.whoami.example.net.",
+			qtype:     mdns.TypeTXT,
+			resolver:  "127.0.0.1",
+			ecs:       true,
+			wantRcode: mdns.RcodeSuccess,
+			want:      []string{"abc.whoami.example.net.\t0\tIN\tTXT\t\"127.0.0.1\" \"reverse localhost\" \"owner LOOPBACK 127.0.0.0/8\" \"edns0-client-subnet 192.0.2.0/24\""},
+		},
+		{
+			name:      "a",
+			qname:     "whoami.example.net.",
+			qtype:     mdns.TypeA,
+			resolver:  "127.0.0.1",
+			wantRcode: mdns.RcodeSuccess,
+			want:      []string{"whoami.example.net.\t0\tIN\tA\t127.0.0.1"},
+		},
+		{
+			name:      "aaaa from ipv4 resolver",
+			qname:     "whoami.example.net.",
+			qtype:     mdns.TypeAAAA,
+			resolver:  "127.0.0.1",
+			wantRcode: mdns.RcodeSuccess,
+		},
+		{
+			name:      "aaaa",
+			qname:     "whoami.example.net.",
+			qtype:     mdns.TypeAAAA,
+			resolver:  "::1",
+			wantRcode: mdns.RcodeSuccess,
+			want:      []string{"whoami.example.net.\t0\tIN\tAAAA\t::1"},
+		},
+		{
+			name:      "outside zone",
+			qname:     "example.com.",
+			qtype:     mdns.TypeTXT,
+			resolver:  "127.0.0.1",
+			wantRcode: mdns.RcodeRefused,
+		},
+	}
+
+	for _, test := range data {
+		req := new(mdns.Msg)
+		req.SetQuestion(test.qname, test.qtype)
+		if test.ecs {
+			req.SetEdns0(4096, false)
+			req.IsEdns0().Option = append(req.IsEdns0().Option, ecs)
+		}
+
+		resp := s.answer(context.Background(), req, netip.MustParseAddr(test.resolver))
+		if resp.Rcode != test.wantRcode {
+			t.Errorf("%s: answer() rcode = %s, want %s", test.name, mdns.RcodeToString[resp.Rcode], mdns.RcodeToString[test.wantRcode])
+		}
+
+		var got []string
+		for _, rr := range resp.Answer {
+			got = append(got, rr.String())
+		}
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("%s: answer() diff (-got +want)\n%s", test.name, diff)
+		}
+
+		if test.wantRcode == mdns.RcodeSuccess && len(test.want) == 0 && len(resp.Ns) != 1 {
+			t.Errorf("%s: answer() NODATA missing SOA, got %v", test.name, resp.Ns)
+		}
+
+		if test.ecs {
+			if got := clientSubnet(resp); got == nil || got.SourceScope != 24 {
+				t.Errorf("%s: answer() client subnet = %v, want scope 24", test.name, got)
+			}
+		}
+	}
+}
+
+func TestServerAnswerNoLookup(t *testing.T) {
+	s := &Server{Zone: "whoami.example.net"}
+
+	req := new(mdns.Msg)
+	req.SetQuestion("whoami.example.net.", mdns.TypeTXT)
+	resp := s.answer(context.Background(), req, netip.MustParseAddr("192.0.2.53"))
+
+	want := []string{"whoami.example.net.\t0\tIN\tTXT\t\"192.0.2.53\""}
+	var got []string
+	for _, rr := range resp.Answer {
+		got = append(got, rr.String())
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("answer() without Lookup diff (-got +want)\n%s", diff)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	// A TXT answer with more annotations than fit in 512 bytes.
+	long := make([]string, 4)
+	for i := range long {
+		long[i] = strings.Repeat("x", maxTXTLen)
+	}
+
+	for _, test := range []struct {
+		name          string
+		udpSize       uint16 // Zero for no EDNS0
+		wantTruncated bool
+	}{
+		{name: "no edns0", wantTruncated: true},
+		{name: "small edns0", udpSize: 256, wantTruncated: true},
+		{name: "edns0", udpSize: 4096, wantTruncated: false},
+	} {
+		req := new(mdns.Msg)
+		req.SetQuestion("whoami.example.net.", mdns.TypeTXT)
+		if test.udpSize > 0 {
+			req.SetEdns0(test.udpSize, false)
+		}
+
+		resp := new(mdns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &mdns.TXT{
+			Hdr: mdns.RR_Header{Name: "whoami.example.net.", Rrtype: mdns.TypeTXT, Class: mdns.ClassINET},
+			Txt: long,
+		})
+
+		truncate(resp, req)
+
+		if resp.Truncated != test.wantTruncated {
+			t.Errorf("%s: truncate() Truncated = %t, want %t", test.name, resp.Truncated, test.wantTruncated)
+		}
+		if test.wantTruncated && resp.Len() > mdns.MinMsgSize {
+			t.Errorf("%s: truncate() Len() = %d, want at most %d", test.name, resp.Len(), mdns.MinMsgSize)
+		}
+		if !test.wantTruncated && len(resp.Answer) != 1 {
+			t.Errorf("%s: truncate() removed the answer", test.name)
+		}
+	}
+}
+
+func TestServerLeak(t *testing.T) {
+	s := &Server{Zone: "whoami.example.net", Log: &ResolverLog{}}
+
+	// Resolvers may randomise the case of the query.
+	req := new(mdns.Msg)
+	req.SetQuestion("0123456789ABCDEF.Leak.whoami.example.net.", mdns.TypeA)
+
+	resp := s.answer(context.Background(), req, netip.MustParseAddr("192.0.2.53"))
+	if resp.Rcode != mdns.RcodeNameError {
+		t.Errorf("answer() rcode = %s, want NXDOMAIN", mdns.RcodeToString[resp.Rcode])
+	}
+
+	if got, want := fmt.Sprint(s.Log.Get("0123456789abcdef")), "[192.0.2.53]"; got != want {
+		t.Errorf("Log.Get() = %s, want %s", got, want)
+	}
+}
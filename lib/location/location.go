@@ -139,7 +139,7 @@ func Handle(config *conf.Config, req *http.Request) *Response {
 
 		if response.MapURL != "" && config.Debug && len(config.MapsAPISigningKey) == 0 {
 			fmt.Println("Warning: MapsAPISigningKey is missing. Google Maps may return a signature error.")
-			fmt.Println("To fix, set the MAPS_API_SIGNING_KEY environment variable.")
+			fmt.Println("To fix, set the MYIP_MAPS_API_SIGNING_KEY environment variable.")
 			// Fallback to placeholder to ensure something is visible in UI tests
 			response.MapURL = placeholderMapURL()
 		}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"net/http"
+	"slices"
+
+	"bramp.net/myip/lib/rdap"
+	"bramp.net/myip/lib/whois"
+)
+
+// Abuse contact sources.
+const (
+	abuseFromRDAP  = "rdap"
+	abuseFromWhois = "whois"
+)
+
+// AbuseContact is who to report abuse from an address to.
+type AbuseContact struct {
+	Email  string
+	Name   string `json:",omitempty"`
+	Phone  string `json:",omitempty"`
+	Handle string `json:",omitempty"`
+
+	// Source is where the contact came from, "rdap" or "whois".
+	Source string
+}
+
+// findAbuse returns the abuse contact from the RDAP response, or failing that, the WHOIS response.
+// It returns nil if neither have one with an email address.
+func findAbuse(rdapResp *rdap.Response, whoisResp *whois.Response) *AbuseContact {
+	if rdapResp != nil {
+		if e := abuseEntity(rdapResp.Entities); e != nil {
+			return newAbuseContact(e, abuseFromRDAP)
+		}
+	}
+
+	if whoisResp == nil {
+		return nil
+	}
+	if whoisResp.Record != nil {
+		if e := abuseEntity(whoisResp.Record.Entities); e != nil {
+			return newAbuseContact(e, abuseFromWhois)
+		}
+	}
+
+	// Try each server's answer, from the most specific, in case the record couldn't be parsed.
+	var bodies []string
+	for i := len(whoisResp.Hops) - 1; i >= 0; i-- {
+		bodies = append(bodies, whoisResp.Hops[i].Body)
+	}
+	if len(bodies) == 0 {
+		bodies = []string{whoisResp.Body}
+	}
+	for _, body := range bodies {
+		if e := whois.FindAbuse(body); e != nil {
+			return newAbuseContact(e, abuseFromWhois)
+		}
+	}
+	return nil
+}
+
+// abuseEntity returns the first entity with the abuse role and an email address, searching the
+// entities' own entities too, as RDAP servers nest the abuse contact under the registrant.
+func abuseEntity(entities []rdap.Entity) *rdap.Entity {
+	for i := range entities {
+		e := &entities[i]
+		if e.Email != "" && slices.Contains(e.Roles, "abuse") {
+			return e
+		}
+		if found := abuseEntity(e.Entities); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func newAbuseContact(e *rdap.Entity, source string) *AbuseContact {
+	return &AbuseContact{
+		Email:  e.Email,
+		Name:   e.Name,
+		Phone:  e.Phone,
+		Handle: e.Handle,
+		Source: source,
+	}
+}
+
+// AbuseHandler returns just the abuse contact for the address, or network, given in the path as
+// /abuse/{query}. It's limited the same as LookupHandler.
+func (s *DefaultServer) AbuseHandler(w http.ResponseWriter, req *http.Request) {
+	query, ok := s.lookupQuery(w, req)
+	if !ok {
+		return
+	}
+
+	opts := s.lookupOptions(req)
+	opts.NoReverse = true
+	opts.NoWhois = false
+
+	lookup := Lookup(req.Context(), query, opts)
+	if lookup.AbuseContact == nil {
+		s.respond(w, req, http.StatusNotFound, &ErrResponse{"no abuse contact found for " + query})
+		return
+	}
+	s.respond(w, req, http.StatusOK, lookup.AbuseContact)
+}
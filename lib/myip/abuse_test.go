@@ -0,0 +1,125 @@
+package myip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/rdap"
+	"bramp.net/myip/lib/whois"
+	"github.com/gorilla/mux"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestFindAbuse(t *testing.T) {
+	data := []struct {
+		name  string
+		rdap  *rdap.Response
+		whois *whois.Response
+		want  *AbuseContact
+	}{
+		{
+			name: "nothing",
+		},
+		{
+			name: "rdap nested",
+			rdap: &rdap.Response{
+				Entities: []rdap.Entity{
+					{Handle: "ABUSE0-ARIN", Roles: []string{"abuse"}}, // No email
+					{
+						Handle: "EXAMPLE-ORG",
+						Roles:  []string{"registrant"},
+						Entities: []rdap.Entity{
+							{Handle: "NOC1-ARIN", Roles: []string{"technical"}, Email: "noc@example.net"},
+							{Handle: "ABUSE1-ARIN", Name: "Abuse", Roles: []string{"abuse"}, Email: "abuse@example.net"},
+						},
+					},
+				},
+			},
+			whois: &whois.Response{Body: "OrgAbuseEmail: whois@example.net"},
+			want:  &AbuseContact{Email: "abuse@example.net", Name: "Abuse", Handle: "ABUSE1-ARIN", Source: "rdap"},
+		},
+		{
+			name: "whois record",
+			rdap: &rdap.Response{Error: "rdap failed"},
+			whois: &whois.Response{
+				Record: &rdap.Response{
+					Entities: []rdap.Entity{{Handle: "AR1-RIPE", Roles: []string{"abuse"}, Email: "abuse@example.nl"}},
+				},
+			},
+			want: &AbuseContact{Email: "abuse@example.nl", Handle: "AR1-RIPE", Source: "whois"},
+		},
+		{
+			name: "whois body",
+			whois: &whois.Response{
+				Body: "OrgAbuseHandle: ABUSE2-ARIN\nOrgAbuseEmail:  abuse@example.com\n",
+			},
+			want: &AbuseContact{Email: "abuse@example.com", Handle: "ABUSE2-ARIN", Source: "whois"},
+		},
+		{
+			name: "whois hops",
+			whois: &whois.Response{
+				Body: "network:Network-Name:CUSTOMER-NET",
+				Hops: []whois.Hop{
+					{Server: "whois.iana.org", Body: "refer: whois.ripe.net"},
+					{Server: "whois.ripe.net", Body: "inetnum: 192.0.2.0 - 192.0.2.255\nabuse-c: AR2-RIPE\n\n" +
+						"role: Abuse\nnic-hdl: AR2-RIPE\nabuse-mailbox: abuse@example.org\n"},
+					{Server: "rwhois://rwhois.example.net", Body: "network:Network-Name:CUSTOMER-NET"},
+				},
+			},
+			want: &AbuseContact{Email: "abuse@example.org", Name: "Abuse", Handle: "AR2-RIPE", Source: "whois"},
+		},
+	}
+
+	for _, test := range data {
+		got := findAbuse(test.rdap, test.whois)
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("%s: findAbuse() diff (-got +want)\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestAbuseHandler(t *testing.T) {
+	fakeLookups(t)
+	lookupRDAP = func(_ context.Context, addr string) *rdap.Response {
+		if addr != "192.0.2.1" {
+			return &rdap.Response{Query: addr}
+		}
+		return &rdap.Response{
+			Query:    addr,
+			Entities: []rdap.Entity{{Handle: "ABUSE1-ARIN", Roles: []string{"abuse"}, Email: "abuse@example.net"}},
+		}
+	}
+
+	data := []struct {
+		query    string
+		format   string
+		want     int
+		wantBody string
+	}{
+		{query: "192.0.2.1", format: "txt", want: http.StatusOK, wantBody: "abuse@example.net\n"},
+		{query: "192.0.2.1", format: "json", want: http.StatusOK, wantBody: `{"Email":"abuse@example.net","Handle":"ABUSE1-ARIN","Source":"rdap"}` + "\n"},
+		{query: "198.51.100.1", format: "json", want: http.StatusNotFound, wantBody: `{"error":"no abuse contact found for 198.51.100.1"}` + "\n"},
+		{query: "example.com", format: "json", want: http.StatusBadRequest, wantBody: "invalid address or network"},
+	}
+
+	s := NewServer(&conf.Config{})
+	for _, test := range data {
+		// whois=false is ignored, as the contact comes from RDAP or WHOIS.
+		req := httptest.NewRequest("GET", "http://localhost/abuse/"+test.query+"?whois=false&format="+test.format, nil)
+		req = mux.SetURLVars(req, map[string]string{"query": test.query})
+		w := httptest.NewRecorder()
+
+		s.AbuseHandler(w, req)
+
+		if w.Code != test.want {
+			t.Errorf("AbuseHandler(%q) status = %d, want %d", test.query, w.Code, test.want)
+		}
+		if got := w.Body.String(); !strings.Contains(got, test.wantBody) {
+			t.Errorf("AbuseHandler(%q) body = %q, want it to contain %q", test.query, got, test.wantBody)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/rdap"
+	"bramp.net/myip/lib/whois"
+)
+
+const (
+	// MaxBulkLookup is the most queries accepted by a single bulk lookup request.
+	MaxBulkLookup = 1000
+
+	// maxBulkLookupBody is the largest bulk lookup request body accepted.
+	maxBulkLookupBody = 1 << 20
+)
+
+// BulkLookup looks up each query with Lookup, running up to workers at once, and calls fn with
+// each result as soon as it's ready. fn is only called from one goroutine at a time, and
+// BulkLookup doesn't return until all the calls are done.
+//
+// Duplicate queries are only looked up once. An address within a network already returned by
+// RDAP reuses the RDAP and WHOIS results, rather than asking the registries again. Invalid
+// queries are returned with Error set.
+func BulkLookup(ctx context.Context, queries []string, workers int, opts LookupOptions, fn func(*LookupResponse)) {
+	if workers <= 0 {
+		workers = conf.DefaultBulkLookupWorkers
+	}
+
+	b := &bulkLookup{opts: opts}
+
+	work := make(chan string)
+	results := make(chan *LookupResponse)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		addToWg(wg, func() {
+			for query := range work {
+				results <- b.lookup(ctx, query)
+			}
+		})
+	}
+
+	go func() {
+		defer close(work)
+
+		seen := make(map[string]bool)
+		for _, query := range queries {
+			canonical, err := parseLookupQuery(strings.TrimSpace(query))
+			if err != nil {
+				results <- &LookupResponse{Query: query, Error: err.Error()}
+				continue
+			}
+			if seen[canonical] {
+				continue
+			}
+			seen[canonical] = true
+
+			select {
+			case work <- canonical:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		fn(result)
+	}
+}
+
+// bulkLookup holds the state shared by the workers of a BulkLookup.
+type bulkLookup struct {
+	opts LookupOptions
+
+	mu       sync.Mutex
+	networks []bulkNetwork
+}
+
+// bulkNetwork is a network returned by RDAP, and the lookups for it.
+type bulkNetwork struct {
+	start, end netip.Addr
+
+	rdap  *rdap.Response
+	whois *whois.Response
+}
+
+// lookup looks up the query, reusing the RDAP and WHOIS results of a known network if possible.
+func (b *bulkLookup) lookup(ctx context.Context, query string) *LookupResponse {
+	if b.opts.NoWhois || strings.Contains(query, "/") {
+		return Lookup(ctx, query, b.opts)
+	}
+
+	addr := netip.MustParseAddr(query) // Already validated by parseLookupQuery.
+	if n, found := b.find(addr); found {
+		opts := b.opts
+		opts.NoWhois = true
+		resp := Lookup(ctx, query, opts)
+
+		// Copy the results, so each has the right Query, and fill in what Lookup skipped.
+		rdapResp, whoisResp := *n.rdap, *n.whois
+		rdapResp.Query, whoisResp.Query = query, query
+		resp.RDAP, resp.Whois = &rdapResp, &whoisResp
+		resp.AbuseContact = findAbuse(resp.RDAP, resp.Whois)
+		if resp.Origin != nil {
+			resp.Origin.compareRDAP(resp.RDAP)
+		}
+		return resp
+	}
+
+	resp := Lookup(ctx, query, b.opts)
+	b.add(resp)
+	return resp
+}
+
+// find returns the known network containing addr.
+func (b *bulkLookup) find(addr netip.Addr) (bulkNetwork, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, n := range b.networks {
+		if n.start.Compare(addr) <= 0 && addr.Compare(n.end) <= 0 {
+			return n, true
+		}
+	}
+	return bulkNetwork{}, false
+}
+
+// add records the network of a successful lookup, unless the WHOIS result is only for part of it.
+func (b *bulkLookup) add(resp *LookupResponse) {
+	start, end, ok := resp.network()
+	if !ok {
+		return
+	}
+	if _, _, ok := whoisRange(resp.Whois, start, end); !ok {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.networks = append(b.networks, bulkNetwork{
+		start: start,
+		end:   end,
+		rdap:  resp.RDAP,
+		whois: resp.Whois,
+	})
+}
+
+// parseBulkQueries parses a JSON list of strings, or one query per line. Blank lines, and
+// anything after a #, are ignored.
+func parseBulkQueries(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var queries []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &queries); err != nil {
+			return nil, fmt.Errorf("invalid JSON list: %s", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				queries = append(queries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(queries) > MaxBulkLookup {
+		return nil, fmt.Errorf("too many queries, the limit is %d", MaxBulkLookup)
+	}
+	return queries, nil
+}
+
+// BulkLookupHandler looks up the addresses (or networks) POSTed to /lookup, either as a JSON list
+// of strings, or one per line. The results are streamed back as they're ready, as newline
+// delimited JSON (NDJSON), in no particular order.
+//
+// It's disabled along with /lookup/{query}. The request counts as one lookup towards the client's
+// rate limit, as does each query the registries are asked about, so addresses in a network already
+// looked up are free. Those over the limit are returned with their RDAP and WHOIS errors set.
+func (s *DefaultServer) BulkLookupHandler(w http.ResponseWriter, req *http.Request) {
+	if s.Config.DisableLookup {
+		s.respond(w, req, http.StatusNotFound, &ErrResponse{"lookup is disabled"})
+		return
+	}
+
+	host, _, err := s.remoteAddr(req)
+	if err != nil {
+		s.respond(w, req, http.StatusInternalServerError, &ErrResponse{err.Error()})
+		return
+	}
+
+	queries, err := parseBulkQueries(http.MaxBytesReader(w, req.Body, maxBulkLookupBody))
+	if err != nil {
+		s.respond(w, req, http.StatusBadRequest, &ErrResponse{err.Error()})
+		return
+	}
+
+	opts := s.lookupOptions(req)
+	if client, err := netip.ParseAddr(host); err == nil {
+		if ok, wait := s.lookupLimiter.Allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.respond(w, req, http.StatusTooManyRequests, &ErrResponse{errTooManyLookups})
+			return
+		}
+		opts.Allow = func() bool {
+			ok, _ := s.lookupLimiter.Allow(client)
+			return ok
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	BulkLookup(req.Context(), queries, s.Config.BulkLookupWorkers, opts, func(resp *LookupResponse) {
+		if err := enc.Encode(resp); err != nil {
+			// The client has most likely gone away, which will cancel the context.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
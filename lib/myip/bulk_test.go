@@ -0,0 +1,238 @@
+package myip
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/dns"
+	"bramp.net/myip/lib/rdap"
+	"bramp.net/myip/lib/whois"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// fakeLookups replaces the lookups, returning a /24 network for each IPv4 address, and counting
+// the RDAP queries.
+func fakeLookups(t *testing.T) *int32 {
+	var rdapCalls int32
+
+	oldReverse, oldRDAP, oldWhois, oldASN := lookupReverse, lookupRDAP, lookupWhois, lookupASN
+	t.Cleanup(func() {
+		lookupReverse, lookupRDAP, lookupWhois, lookupASN = oldReverse, oldRDAP, oldWhois, oldASN
+	})
+
+	lookupReverse = func(_ context.Context, addr string) *dns.Response {
+		return &dns.Response{Query: addr}
+	}
+	lookupRDAP = func(_ context.Context, addr string) *rdap.Response {
+		atomic.AddInt32(&rdapCalls, 1)
+		network := addr[:strings.LastIndex(addr, ".")]
+		return &rdap.Response{
+			Query:        addr,
+			Name:         "NET-" + network,
+			StartAddress: network + ".0",
+			EndAddress:   network + ".255",
+		}
+	}
+	lookupWhois = func(_ context.Context, addr string) *whois.Response {
+		return &whois.Response{Query: addr, Body: "whois " + addr}
+	}
+	lookupASN = func(_ context.Context, asn uint32) *rdap.ASResponse {
+		return &rdap.ASResponse{ASN: asn, Name: fmt.Sprintf("AS-%d", asn)}
+	}
+
+	return &rdapCalls
+}
+
+func TestBulkLookupAbuse(t *testing.T) {
+	fakeLookups(t)
+	lookupWhois = func(_ context.Context, addr string) *whois.Response {
+		return &whois.Response{Query: addr, Body: "OrgAbuseEmail: abuse@example.net\n"}
+	}
+
+	var got []*LookupResponse
+	BulkLookup(context.Background(), []string{"192.0.2.1", "192.0.2.2"}, 1, LookupOptions{}, func(resp *LookupResponse) {
+		got = append(got, resp)
+	})
+
+	if len(got) != 2 {
+		t.Fatalf("BulkLookup() returned %d results, want 2", len(got))
+	}
+	for _, resp := range got {
+		if resp.AbuseContact == nil || resp.AbuseContact.Email != "abuse@example.net" {
+			t.Errorf("BulkLookup() %s AbuseContact = %s, want abuse@example.net", resp.Query, pretty.Sprint(resp.AbuseContact))
+		}
+	}
+}
+
+func TestParseBulkQueries(t *testing.T) {
+	data := []struct {
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{body: "192.0.2.1\n\n  192.0.2.2  # a comment\n# another\n2001:db8::1", want: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+		{body: ` ["192.0.2.1", "192.0.2.0/24"] `, want: []string{"192.0.2.1", "192.0.2.0/24"}},
+		{body: `["192.0.2.1", 1]`, wantErr: true},
+		{body: strings.Repeat("192.0.2.1\n", MaxBulkLookup+1), wantErr: true},
+		{body: "", want: nil},
+	}
+
+	for _, test := range data {
+		got, err := parseBulkQueries(strings.NewReader(test.body))
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseBulkQueries(%q) err = %v, want err %t", test.body, err, test.wantErr)
+			continue
+		}
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("parseBulkQueries(%q) diff (-got +want)\n%s", test.body, diff)
+		}
+	}
+}
+
+func TestBulkLookup(t *testing.T) {
+	rdapCalls := fakeLookups(t)
+
+	queries := []string{
+		"192.0.2.1",
+		"192.0.2.1",        // Duplicate
+		"::ffff:192.0.2.1", // Duplicate, once canonicalised
+		"192.0.2.2",        // In the same network as 192.0.2.1
+		"198.51.100.1",
+		"bogus",
+	}
+
+	got := make(map[string]*LookupResponse)
+	// One worker, so the first lookup of a network is always finished before the next starts.
+	BulkLookup(context.Background(), queries, 1, LookupOptions{}, func(resp *LookupResponse) {
+		if got[resp.Query] != nil {
+			t.Errorf("BulkLookup() returned %q twice", resp.Query)
+		}
+		got[resp.Query] = resp
+	})
+
+	var keys []string
+	for k := range got {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if diff := pretty.Compare(keys, []string{"192.0.2.1", "192.0.2.2", "198.51.100.1", "bogus"}); diff != "" {
+		t.Errorf("BulkLookup() queries diff (-got +want)\n%s", diff)
+	}
+
+	if *rdapCalls != 2 {
+		t.Errorf("BulkLookup() made %d RDAP queries, want 2", *rdapCalls)
+	}
+
+	if r := got["192.0.2.2"]; r == nil || r.RDAP == nil || r.RDAP.Name != "NET-192.0.2" || r.RDAP.Query != "192.0.2.2" ||
+		r.Whois == nil || r.Whois.Query != "192.0.2.2" || r.Reverse == nil || r.Reverse.Query != "192.0.2.2" {
+		t.Errorf("BulkLookup() collapsed result = %s, want the 192.0.2.0/24 network, for 192.0.2.2", pretty.Sprint(r))
+	}
+
+	if r := got["bogus"]; r == nil || r.Error == "" {
+		t.Errorf("BulkLookup() invalid result = %s, want an Error", pretty.Sprint(r))
+	}
+}
+
+func TestBulkLookupHandler(t *testing.T) {
+	fakeLookups(t)
+
+	s := NewServer(&conf.Config{})
+
+	body := "192.0.2.1\n192.0.2.2\n198.51.100.1\n"
+	req := httptest.NewRequest("POST", "http://localhost/lookup", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	s.BulkLookupHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("BulkLookupHandler() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/x-ndjson"; got != want {
+		t.Errorf("BulkLookupHandler() Content-Type = %q, want %q", got, want)
+	}
+
+	var queries []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		resp := &LookupResponse{}
+		if err := json.Unmarshal(scanner.Bytes(), resp); err != nil {
+			t.Fatalf("BulkLookupHandler() returned invalid JSON line %q: %s", scanner.Text(), err)
+		}
+		queries = append(queries, resp.Query)
+	}
+	sort.Strings(queries)
+
+	if diff := pretty.Compare(queries, []string{"192.0.2.1", "192.0.2.2", "198.51.100.1"}); diff != "" {
+		t.Errorf("BulkLookupHandler() queries diff (-got +want)\n%s", diff)
+	}
+
+	// Disabled, along with /lookup/{query}.
+	s = NewServer(&conf.Config{DisableLookup: true})
+	req = httptest.NewRequest("POST", "http://localhost/lookup", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	s.BulkLookupHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("BulkLookupHandler() when disabled status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestBulkLookupHandlerRateLimit(t *testing.T) {
+	rdapCalls := fakeLookups(t)
+
+	s := NewServer(&conf.Config{LookupRateLimit: 5, BulkLookupWorkers: 1})
+
+	// post returns the status, and how many results were over the limit.
+	post := func(body string) (int, int) {
+		req := httptest.NewRequest("POST", "http://localhost/lookup", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.BulkLookupHandler(w, req)
+
+		limited := 0
+		for dec := json.NewDecoder(w.Body); dec.More(); {
+			var resp LookupResponse
+			if err := dec.Decode(&resp); err != nil {
+				break
+			}
+			if resp.RDAP != nil && resp.RDAP.Error == errTooManyLookups {
+				limited++
+			}
+		}
+		return w.Code, limited
+	}
+
+	// One for the request, and one for the network, which the rest reuse.
+	var sameNetwork []string
+	for i := 1; i <= 20; i++ {
+		sameNetwork = append(sameNetwork, fmt.Sprintf("192.0.2.%d", i))
+	}
+
+	data := []struct {
+		name        string
+		body        string
+		want        int
+		wantLimited int
+	}{
+		{"many in one network", strings.Join(sameNetwork, "\n"), http.StatusOK, 0},
+		{"more networks than remain", "198.51.100.1\n203.0.113.1\n100.64.0.1\n", http.StatusOK, 1},
+		{"none remain", "192.0.2.1\n", http.StatusTooManyRequests, 0},
+	}
+
+	for _, test := range data {
+		if got, limited := post(test.body); got != test.want || limited != test.wantLimited {
+			t.Errorf("%s: BulkLookupHandler() status = %d, with %d over the limit, want %d, with %d", test.name, got, limited, test.want, test.wantLimited)
+		}
+	}
+
+	if *rdapCalls != 3 {
+		t.Errorf("BulkLookupHandler() made %d RDAP queries, want 3", *rdapCalls)
+	}
+}
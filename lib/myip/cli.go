@@ -1,50 +1,135 @@
 package myip
 
 import (
+	"io"
 	"net/http"
+	"reflect"
 	"strings"
 	"text/template"
-
-	"github.com/gorilla/mux"
 )
 
 var cliTmpl = template.Must(template.New("test").Parse(
 	"IP: {{.RemoteAddr}}\n" +
 		"{{range .RemoteAddrReverse.Names}}" +
 		"DNS: {{.}}\n" +
+		"{{end}}" +
+		"{{with .RemoteAddrReverse}}{{if .TimedOut}}DNS: (timed out)\n{{end}}{{end}}" +
+		"{{range .ProxyChain}}" +
+		"Hop: {{.Addr}} ({{.Source}}{{if .Trusted}}, trusted{{end}})\n" +
 		"{{end}}\n" +
 		"{{if .RemoteAddrRDAP}}" +
 		"RDAP:\n" +
+		"{{if .RemoteAddrRDAP.TimedOut}}(timed out)\n{{end}}" +
 		"{{.RemoteAddrRDAP.Body}}\n\n" +
 		"{{end}}" +
+		"{{with .RemoteAddrOrigin}}" +
+		"Origin: {{.}} ({{.Prefix}}{{with .Mismatch}}, RDAP mismatch: {{.}}{{end}})\n\n" +
+		"{{end}}" +
 		"{{if .RemoteAddrWhois}}" +
 		"WHOIS:\n" +
+		"{{if .RemoteAddrWhois.TimedOut}}(timed out)\n{{end}}" +
 		"{{.RemoteAddrWhois.Body}}\n\n" +
 		"{{end}}" +
+		"{{with .RemoteAddrAbuseContact}}" +
+		"Abuse: {{.Email}}{{if .Handle}} ({{.Handle}}){{end}}\n\n" +
+		"{{end}}" +
 		"Location: " +
 		"{{.Location.City}} {{.Location.Region}} {{.Location.Country}}" +
 		"{{if (and (ne .Location.Lat 0.0) (ne .Location.Long 0.0))}} ({{.Location.Lat}}, {{.Location.Long}}) {{end}}\n\n" +
 		"ID: {{.RequestID}}\n"))
 
+var ipTmpl = template.Must(template.New("ip").Parse("{{.RemoteAddr}}\n"))
+
+var lookupTmpl = template.Must(template.New("lookup").Parse(
+	"Query: {{.Query}}\n" +
+		"{{with .Reverse}}{{range .Names}}" +
+		"DNS: {{.}}\n" +
+		"{{end}}{{if .TimedOut}}DNS: (timed out)\n{{end}}{{end}}\n" +
+		"{{if .RDAP}}" +
+		"RDAP:\n" +
+		"{{if .RDAP.TimedOut}}(timed out)\n{{end}}" +
+		"{{.RDAP.Body}}\n\n" +
+		"{{end}}" +
+		"{{with .Origin}}" +
+		"Origin: {{.}} ({{.Prefix}}{{with .Mismatch}}, RDAP mismatch: {{.}}{{end}})\n\n" +
+		"{{end}}" +
+		"{{if .Whois}}" +
+		"WHOIS:\n" +
+		"{{if .Whois.TimedOut}}(timed out)\n{{end}}" +
+		"{{.Whois.Body}}\n" +
+		"{{end}}" +
+		"{{with .AbuseContact}}" +
+		"\nAbuse: {{.Email}}{{if .Handle}} ({{.Handle}}){{end}}\n" +
+		"{{end}}"))
+
+var abuseTmpl = template.Must(template.New("abuse").Parse("{{.Email}}\n"))
+
+var errTmpl = template.Must(template.New("error").Parse("Error: {{.Error}}\n"))
+
+var resolverTmpl = template.Must(template.New("resolver").Parse(
+	"{{range .Resolvers}}" +
+		"Resolver: {{.Addr}}" +
+		"{{with .Reverse}}{{range .Names}} {{.}}{{end}}{{end}}" +
+		"{{if .Org}} ({{.Org}}{{if .Country}}, {{.Country}}{{end}}){{end}}\n" +
+		"{{else}}" +
+		"No resolvers have looked up {{.Nonce}} yet.\n" +
+		"{{end}}"))
+
+var natTmpl = template.Must(template.New("nat").Parse(
+	"IP: {{.RemoteAddr}}\n" +
+		"Mapping: {{.Mapping}}\n" +
+		"Filtering: {{.Filtering}}\n" +
+		"{{range .Observations}}" +
+		"Observed: {{.Mapped}} -> {{.Server}}\n" +
+		"{{end}}"))
+
+// textTemplates are the templates used to render each type as text.
+var textTemplates = map[reflect.Type]*template.Template{
+	reflect.TypeOf(&Response{}):         cliTmpl,
+	reflect.TypeOf(&IPResponse{}):       ipTmpl,
+	reflect.TypeOf(&LookupResponse{}):   lookupTmpl,
+	reflect.TypeOf(&AbuseContact{}):     abuseTmpl,
+	reflect.TypeOf(&ErrResponse{}):      errTmpl,
+	reflect.TypeOf(&ResolverResponse{}): resolverTmpl,
+	reflect.TypeOf(&NATResponse{}):      natTmpl,
+}
+
+// cliPrefixes are the User-Agent prefixes of command line tools, which get text by default.
+var cliPrefixes = []string{
+	"curl/",
+	"Wget/",
+	"HTTPie/",
+	"xh/", // HTTPie compatible
+	"aria2/",
+	"fetch libfetch/", // FreeBSD fetch
+	"fetch/",
+}
+
 // isCLI returns true iif the request is coming from a cli tool, such as curl, or wget
-func isCLI(req *http.Request, _ *mux.RouteMatch) bool {
+func isCLI(req *http.Request) bool {
 	ua := req.Header.Get("User-Agent")
-	return strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "Wget/")
-}
+	for _, prefix := range cliPrefixes {
+		if strings.HasPrefix(ua, prefix) {
+			return true
+		}
+	}
 
-// CLIHandler handles a CLI request to the service.
-func (s *DefaultServer) CLIHandler(w http.ResponseWriter, req *http.Request) {
-	response, err := s.MyIPHandler(req)
+	// PowerShell's Invoke-WebRequest claims to be Mozilla, e.g.
+	// "Mozilla/5.0 (Windows NT; Windows NT 10.0; en-US) WindowsPowerShell/5.1.19041.1"
+	return strings.Contains(ua, "PowerShell/")
+}
 
-	w.Header().Set("Content-Type", "text/plain")
+// textRenderer renders responses as human readable text, falling back to YAML for types without
+// a template.
+type textRenderer struct{}
 
-	if err == nil {
-		err = cliTmpl.Execute(w, response)
-		// Drop though with a new err
-	}
+func (textRenderer) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
 
-	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+func (textRenderer) Render(w io.Writer, v interface{}) error {
+	if tmpl, found := textTemplates[reflect.TypeOf(v)]; found {
+		return tmpl.Execute(w, v)
 	}
+	return yamlRenderer{}.Render(w, v)
 }
@@ -17,7 +17,11 @@ package myip
 import (
 	"bytes"
 	"net/http"
+	"strings"
 	"text/template"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/dns"
 )
 
 var configTemplate = `
@@ -29,7 +33,9 @@ var MAIN_HOST = "{{.Host}}";
 var SERVERS = {
    "IPv4": "{{.Host4}}",
    "IPv6": "{{.Host6}}"
-};`
+};
+
+var LEAK_DOMAIN = "{{.LeakDomain}}";`
 
 // ConfigJSHandler returns the config javascript.
 func (s *DefaultServer) ConfigJSHandler(w http.ResponseWriter, _ *http.Request) {
@@ -43,7 +49,15 @@ func (s *DefaultServer) ConfigJSHandler(w http.ResponseWriter, _ *http.Request)
 
 	// Buffer the output so we can put a error at the front if it fails
 	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, s.Config)
+	err = tmpl.Execute(&buf, struct {
+		*conf.Config
+
+		// LeakDomain is where the resolver leak test names live, or empty if disabled.
+		LeakDomain string
+	}{
+		Config:     s.Config,
+		LeakDomain: s.leakDomain(),
+	})
 	if err != nil {
 		// TODO Consider writing out a nice error js field, instead of invalid js.
 		w.WriteHeader(500)
@@ -55,3 +69,11 @@ func (s *DefaultServer) ConfigJSHandler(w http.ResponseWriter, _ *http.Request)
 	w.Header().Set("Content-Type", "text/javascript")
 	buf.WriteTo(w)
 }
+
+// leakDomain returns the domain the resolver leak test names are in, or empty if disabled.
+func (s *DefaultServer) leakDomain() string {
+	if s.Resolvers == nil || s.Config.DNSZone == "" {
+		return ""
+	}
+	return dns.LeakLabel + "." + strings.TrimSuffix(s.Config.DNSZone, ".")
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EventsHandler streams the Response as Server-Sent Events, so the client can show each part as
+// soon as it's ready, instead of waiting for the slowest lookup.
+//
+// The first event, "response", is the Response without any lookups (the address, headers, etc).
+// It's followed by "reverse", "rdap", "whois", "cache", "location" and "ua" events, in the order
+// they finish, each holding the matching field of the Response. The stream ends with a "done"
+// event, or an "error" event holding an ErrResponse.
+func (s *DefaultServer) EventsHandler(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	s.allowOrigin(w, req)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	var mu sync.Mutex
+	send := func(event string, v interface{}) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Warningf("encoding %q event failed: %s", event, err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			// The client has most likely gone away, which will cancel the context.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	_, err := s.myIP(req, func(event string, v interface{}) {
+		if event == "response" {
+			// None of the lookups have started yet, so this is safe.
+			addInsights(req, v.(*Response))
+		}
+		send(event, v)
+	})
+	if err != nil {
+		send("error", &ErrResponse{err.Error()})
+		return
+	}
+	send("done", struct{}{})
+}
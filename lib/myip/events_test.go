@@ -0,0 +1,91 @@
+package myip
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestEventsHandler(t *testing.T) {
+	fakeLookups(t)
+
+	s := NewServer(&conf.Config{DisallowedHeaders: []string{"X-Secret"}})
+
+	req := httptest.NewRequest("GET", "http://localhost/events", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("X-Secret", "hunter2")
+	w := httptest.NewRecorder()
+
+	s.EventsHandler(w, req)
+
+	if got, want := w.Header().Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("EventsHandler() Content-Type = %q, want %q", got, want)
+	}
+
+	var events []string
+	data := make(map[string]string)
+	for _, block := range strings.Split(strings.TrimSpace(w.Body.String()), "\n\n") {
+		lines := strings.Split(block, "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "event: ") || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("EventsHandler() returned malformed event %q", block)
+		}
+		event := strings.TrimPrefix(lines[0], "event: ")
+		events = append(events, event)
+		data[event] = strings.TrimPrefix(lines[1], "data: ")
+	}
+
+	if len(events) < 2 || events[0] != "response" || events[len(events)-1] != "done" {
+		t.Fatalf("EventsHandler() events = %q, want response first, and done last", events)
+	}
+
+	got := append([]string(nil), events[1:len(events)-1]...)
+	sort.Strings(got)
+	if diff := pretty.Compare(got, []string{"cache", "location", "rdap", "reverse", "ua", "whois"}); diff != "" {
+		t.Errorf("EventsHandler() events diff (-got +want)\n%s", diff)
+	}
+
+	resp := &Response{}
+	if err := json.Unmarshal([]byte(data["response"]), resp); err != nil {
+		t.Fatalf("EventsHandler() response event is invalid JSON: %s", err)
+	}
+	if resp.RemoteAddr != "192.0.2.1" || resp.RemoteAddrRDAP != nil || resp.Header.Get("X-Secret") != "" {
+		t.Errorf("EventsHandler() response event = %s, want the address, without lookups or disallowed headers", pretty.Sprint(resp))
+	}
+	if req.Header.Get("X-Secret") == "" {
+		t.Errorf("EventsHandler() removed the disallowed header from the request")
+	}
+
+	if !strings.Contains(data["rdap"], `"NET-192.0.2"`) {
+		t.Errorf("EventsHandler() rdap event = %s, want the NET-192.0.2 network", data["rdap"])
+	}
+}
+
+func TestMyIPHandler(t *testing.T) {
+	fakeLookups(t)
+
+	s := NewServer(&conf.Config{})
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	resp, err := s.myIP(req, nil)
+	if err != nil {
+		t.Fatalf("myIP() err = %s", err)
+	}
+	if resp.RemoteAddrRDAP == nil || resp.RemoteAddrWhois == nil || resp.RemoteAddrReverse == nil {
+		t.Errorf("myIP() = %s, want all the lookups", pretty.Sprint(resp))
+	}
+
+	w := httptest.NewRecorder()
+	s.ResponseHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("ResponseHandler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// IPResponse is just the client's address, without any lookups.
+type IPResponse struct {
+	RemoteAddr       string
+	RemoteAddrFamily string
+}
+
+// IPHandler returns only the client's address, for scripts that poll it. Unlike MyIPHandler, it
+// doesn't do any lookups, so is cheap to call.
+//
+// It is served as /ip, /ip4 and /ip6, optionally with a format suffix, e.g. /ip.txt or /ip4.json.
+// Without one, it defaults to text. /ip4 and /ip6 only return an address of that family, and if the
+// client connected with the other, it is redirected to Host4 or Host6.
+//
+// The response carries an ETag, so pollers can make a conditional request and get a 304 Not
+// Modified until their address changes.
+func (s *DefaultServer) IPHandler(w http.ResponseWriter, req *http.Request) {
+	host, _, err := s.remoteAddr(req)
+	if err != nil {
+		s.respondWithDefault(w, req, "txt", http.StatusInternalServerError, &ErrResponse{err.Error()})
+		return
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		s.respondWithDefault(w, req, "txt", http.StatusBadRequest, &ErrResponse{"invalid remote address: " + err.Error()})
+		return
+	}
+	addr = addr.Unmap()
+
+	resp := &IPResponse{
+		RemoteAddr:       addr.String(),
+		RemoteAddrFamily: "IPv4",
+	}
+	if addr.Is6() {
+		resp.RemoteAddrFamily = "IPv6"
+	}
+
+	if want := mux.Vars(req)["family"]; want != "" && want != resp.RemoteAddrFamily[3:] {
+		other := s.Config.Host4
+		if want == "6" {
+			other = s.Config.Host6
+		}
+		if other == "" || strings.EqualFold(other, req.Host) {
+			s.respondWithDefault(w, req, "txt", http.StatusNotFound, &ErrResponse{fmt.Sprintf("no IPv%s address", want)})
+			return
+		}
+
+		// The other host name only resolves to addresses of the wanted family.
+		u := *req.URL
+		u.Host = other
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, req, u.String(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	// The answer is specific to the client, so must only be cached by it, and it must check back
+	// with us each time. That's cheap thanks to the ETag.
+	format := negotiate(req)
+	etag := ipETag(format, resp.RemoteAddr)
+
+	h := w.Header()
+	h.Set("Cache-Control", "private, no-cache")
+	h.Set("ETag", etag)
+
+	if etagMatch(req.Header.Get("If-None-Match"), etag) {
+		h.Add("Vary", "Accept")
+		h.Add("Vary", "User-Agent")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.respondWithDefault(w, req, "txt", http.StatusOK, resp)
+}
+
+// ipETag returns a strong ETag for the address rendered in the format.
+func ipETag(format, addr string) string {
+	h := fnv.New64a()
+	h.Write([]byte(format))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// etagMatch returns true if the If-None-Match header matches the etag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package myip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"github.com/gorilla/mux"
+)
+
+func TestIPHandler(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Debug: true, // Allows ?host=, and disables the HTTPS redirect
+		Host:  "ip.example.com",
+		Host4: "ip4.example.com",
+		Host6: "ip6.example.com",
+	})
+	r := mux.NewRouter()
+	s.Register(r)
+
+	data := []struct {
+		url         string
+		accept      string
+		want        int
+		contentType string
+		wantBody    string
+		location    string
+	}{
+		{url: "/ip?host=192.0.2.1", want: http.StatusOK, contentType: "text/plain; charset=utf-8", wantBody: "192.0.2.1\n"},
+		{url: "/ip.txt?host=2001:db8::1", want: http.StatusOK, contentType: "text/plain; charset=utf-8", wantBody: "2001:db8::1\n"},
+		{url: "/ip.json?host=192.0.2.1", want: http.StatusOK, contentType: "application/json", wantBody: `{"RemoteAddr":"192.0.2.1","RemoteAddrFamily":"IPv4"}` + "\n"},
+		{url: "/ip?host=192.0.2.1", accept: "application/json", want: http.StatusOK, contentType: "application/json", wantBody: `{"RemoteAddr":"192.0.2.1","RemoteAddrFamily":"IPv4"}` + "\n"},
+		{url: "/ip?host=::ffff:192.0.2.1", want: http.StatusOK, contentType: "text/plain; charset=utf-8", wantBody: "192.0.2.1\n"},
+		{url: "/ip4?host=192.0.2.1", want: http.StatusOK, contentType: "text/plain; charset=utf-8", wantBody: "192.0.2.1\n"},
+		{url: "/ip6.txt?host=2001:db8::1", want: http.StatusOK, contentType: "text/plain; charset=utf-8", wantBody: "2001:db8::1\n"},
+		{url: "/ip6?host=192.0.2.1", want: http.StatusTemporaryRedirect, location: "http://ip6.example.com/ip6?host=192.0.2.1"},
+		{url: "/ip.bogus?host=192.0.2.1", want: http.StatusNotAcceptable, contentType: "application/json"},
+		{url: "/ip?host=bogus", want: http.StatusBadRequest, contentType: "text/plain; charset=utf-8", wantBody: "Error: invalid remote address"},
+	}
+
+	for _, test := range data {
+		req := httptest.NewRequest("GET", "http://ip.example.com"+test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+
+		r.ServeHTTP(w, req)
+
+		if w.Code != test.want {
+			t.Errorf("GET %s status = %d, want %d", test.url, w.Code, test.want)
+		}
+		if test.contentType != "" {
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("GET %s Content-Type = %q, want %q", test.url, got, test.contentType)
+			}
+		}
+		if test.wantBody != "" {
+			if body := w.Body.String(); len(body) < len(test.wantBody) || body[:len(test.wantBody)] != test.wantBody {
+				t.Errorf("GET %s body = %q, want %q", test.url, body, test.wantBody)
+			}
+		}
+		if got := w.Header().Get("Location"); got != test.location {
+			t.Errorf("GET %s Location = %q, want %q", test.url, got, test.location)
+		}
+	}
+}
+
+func TestIPHandlerNotModified(t *testing.T) {
+	s := NewServer(&conf.Config{Debug: true})
+	r := mux.NewRouter()
+	s.Register(r)
+
+	get := func(url, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("http://localhost/ip?host=192.0.2.1", "")
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("GET /ip returned no ETag")
+	}
+	if got, want := w.Header().Get("Cache-Control"), "private, no-cache"; got != want {
+		t.Errorf("GET /ip Cache-Control = %q, want %q", got, want)
+	}
+
+	if w := get("http://localhost/ip?host=192.0.2.1", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("GET /ip with matching ETag = %d %q, want %d and no body", w.Code, w.Body.String(), http.StatusNotModified)
+	}
+
+	// A new address, or format, is a new ETag.
+	if w := get("http://localhost/ip?host=192.0.2.2", etag); w.Code != http.StatusOK {
+		t.Errorf("GET /ip with a different address = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := get("http://localhost/ip.json?host=192.0.2.1", etag); w.Code != http.StatusOK {
+		t.Errorf("GET /ip.json with the /ip ETag = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestEtagMatch(t *testing.T) {
+	for header, want := range map[string]bool{
+		``:                 false,
+		`"abc"`:            true,
+		`W/"abc"`:          true,
+		`"xyz", "abc"`:     true,
+		`*`:                true,
+		`"abcd"`:           false,
+		`"xyz",W/"abc"   `: true,
+	} {
+		if got := etagMatch(header, `"abc"`); got != want {
+			t.Errorf("etagMatch(%q) = %t, want %t", header, got, want)
+		}
+	}
+}
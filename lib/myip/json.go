@@ -2,7 +2,7 @@ package myip
 
 import (
 	"encoding/json"
-	"net/http"
+	"io"
 )
 
 // ErrResponse is returned in the case of a error.
@@ -10,32 +10,13 @@ type ErrResponse struct {
 	Error string `json:"error,omitempty"`
 }
 
-// JSONHandler does the lookups and returns the results as a JSON object.
-func (s *DefaultServer) JSONHandler(w http.ResponseWriter, req *http.Request) {
-	response, err := s.MyIPHandler(req)
-	if err != nil {
-		response = addInsights(req, response)
-	}
+// jsonRenderer renders responses as JSON.
+type jsonRenderer struct{}
 
-	if err != nil {
-		w.WriteHeader(500)
-		s.writeJSON(w, req, &ErrResponse{err.Error()})
-		return
-	}
-
-	s.writeJSON(w, req, response)
+func (jsonRenderer) ContentType() string {
+	return "application/json"
 }
 
-func (s *DefaultServer) writeJSON(w http.ResponseWriter, req *http.Request, obj interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if origin := req.Header.Get("Origin"); origin != "" {
-		if s.Config.MatchOrigin(origin) {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Vary", "Origin")
-		}
-	}
-
-	// TODO Do something with the returned err
-	json.NewEncoder(w).Encode(obj)
+func (jsonRenderer) Render(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
 }
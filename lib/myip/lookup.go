@@ -0,0 +1,428 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bramp.net/myip/lib/cache"
+	"bramp.net/myip/lib/dns"
+	"bramp.net/myip/lib/rdap"
+	"bramp.net/myip/lib/whois"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// The lookups, replaced in tests.
+var (
+	lookupReverse = dns.HandleReverseDNS
+	lookupRDAP    = rdap.Handle
+	lookupWhois   = whois.Handle
+	lookupASN     = rdap.HandleASN
+)
+
+// Cache kinds.
+const (
+	cacheRDAP  = "rdap"
+	cacheWhois = "whois"
+	cacheASN   = "asn" // Keyed by AS number, rather than range
+)
+
+// errTooManyLookups is the error for a lookup over the client's rate limit.
+const errTooManyLookups = "too many lookups, try again later"
+
+// Timeouts are the deadlines for the lookups. Zero means no deadline, other than the context's.
+type Timeouts struct {
+	Total time.Duration // For all the lookups together
+
+	Reverse time.Duration
+	RDAP    time.Duration
+	Whois   time.Duration
+}
+
+// LookupOptions controls which lookups Lookup does.
+type LookupOptions struct {
+	NoReverse bool // Skip the reverse DNS lookup
+	NoWhois   bool // Skip the RDAP and WHOIS lookups
+
+	// Timeouts limit how long the lookups may take. Any that run out are reported as TimedOut.
+	Timeouts Timeouts
+
+	// Cache, if set, stores the RDAP and WHOIS results by the network RDAP returns, so any later
+	// lookup of an address in it is answered locally. The origin AS's registration is cached too.
+	Cache *cache.RangeCache
+
+	// Allow, if set, is called before asking the registries, i.e. unless the RDAP and WHOIS
+	// results are cached. If it returns false, they're reported as errors instead.
+	Allow func() bool
+
+	// Origins, if set, finds the prefix and AS announcing the address, which is then looked up
+	// with RDAP. This is done even with NoWhois, as the prefix comes from the local table.
+	Origins PrefixTable
+
+	// Progress, if set, is called with each result as soon as it's ready, named "reverse", "rdap",
+	// "whois", then "origin", "abuse" and "cache" once they're all done. It may be called
+	// concurrently.
+	Progress func(event string, v interface{})
+}
+
+func (opts LookupOptions) progress(event string, v interface{}) {
+	if opts.Progress != nil {
+		opts.Progress(event, v)
+	}
+}
+
+// lookupOptions returns the LookupOptions from the reverse=false and whois=false query params.
+func (s *DefaultServer) lookupOptions(req *http.Request) LookupOptions {
+	query := req.URL.Query()
+	opts := LookupOptions{
+		NoReverse: query.Get("reverse") == "false",
+		NoWhois:   query.Get("whois") == "false",
+		Timeouts:  s.timeouts,
+		Cache:     s.Cache,
+	}
+	if s.Origins != nil {
+		opts.Origins = s.Origins
+	}
+	return opts
+}
+
+// withTimeout is context.WithTimeout, except zero means no timeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// CacheStatus describes if the RDAP and WHOIS results came from the cache.
+type CacheStatus struct {
+	Hit bool
+
+	// Age is how long ago, in seconds, the results were looked up.
+	Age int `json:",omitempty"`
+
+	// Start and End are the range of addresses the results are cached for.
+	Start string `json:",omitempty"`
+	End   string `json:",omitempty"`
+}
+
+// LookupResponse is the result of looking up an address, or network.
+type LookupResponse struct {
+	Query  string
+	Family string `json:",omitempty"`
+
+	// Error is set if the query wasn't a valid address or network.
+	Error string `json:",omitempty"`
+
+	Reverse *dns.Response   `json:",omitempty"`
+	RDAP    *rdap.Response  `json:",omitempty"`
+	Whois   *whois.Response `json:",omitempty"`
+
+	// Origin is the AS announcing the address, if there's an OriginTable.
+	Origin *Origin `json:",omitempty"`
+
+	// AbuseContact is who to report abuse to, from the RDAP or WHOIS results.
+	AbuseContact *AbuseContact `json:",omitempty"`
+
+	// Cache is set if the lookups used a cache.
+	Cache *CacheStatus `json:",omitempty"`
+}
+
+// Lookup does the reverse DNS, RDAP, WHOIS and origin AS lookups for query in parallel. The query
+// is an address, or a network in CIDR notation, in which case there is no reverse DNS or origin AS
+// lookup.
+func Lookup(ctx context.Context, query string, opts LookupOptions) *LookupResponse {
+	ctx, cancel := withTimeout(ctx, opts.Timeouts.Total)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	resp := &LookupResponse{
+		Query:  query,
+		Family: addressFamily(strings.SplitN(query, "/", 2)[0]),
+	}
+
+	if !opts.NoReverse && !strings.Contains(query, "/") {
+		addToWg(wg, func() {
+			ctx, cancel := withTimeout(ctx, opts.Timeouts.Reverse)
+			defer cancel()
+			resp.Reverse = lookupReverse(ctx, query)
+			opts.progress("reverse", resp.Reverse)
+		})
+	}
+
+	if !opts.NoWhois {
+		if resp.fromCache(ctx, opts.Cache) {
+			opts.progress("rdap", resp.RDAP)
+			opts.progress("whois", resp.Whois)
+		} else if opts.Allow != nil && !opts.Allow() {
+			resp.RDAP = &rdap.Response{Query: query, Error: errTooManyLookups}
+			resp.Whois = &whois.Response{Query: query, Error: errTooManyLookups}
+			opts.progress("rdap", resp.RDAP)
+			opts.progress("whois", resp.Whois)
+		} else {
+			addToWg(wg, func() {
+				ctx, cancel := withTimeout(ctx, opts.Timeouts.RDAP)
+				defer cancel()
+				resp.RDAP = lookupRDAP(ctx, query)
+				opts.progress("rdap", resp.RDAP)
+			})
+			addToWg(wg, func() {
+				ctx, cancel := withTimeout(ctx, opts.Timeouts.Whois)
+				defer cancel()
+				resp.Whois = lookupWhois(ctx, query)
+				opts.progress("whois", resp.Whois)
+			})
+		}
+	}
+
+	if opts.Origins != nil && !strings.Contains(query, "/") {
+		addToWg(wg, func() {
+			ctx, cancel := withTimeout(ctx, opts.Timeouts.RDAP)
+			defer cancel()
+			resp.Origin = findOrigin(ctx, opts.Origins, opts.Cache, query)
+		})
+	}
+
+	wg.Wait()
+
+	if resp.Origin != nil {
+		resp.Origin.compareRDAP(resp.RDAP)
+		opts.progress("origin", resp.Origin)
+	}
+	if !opts.NoWhois {
+		if resp.AbuseContact = findAbuse(resp.RDAP, resp.Whois); resp.AbuseContact != nil {
+			opts.progress("abuse", resp.AbuseContact)
+		}
+		if resp.Cache == nil {
+			resp.toCache(ctx, opts.Cache)
+		}
+	}
+	if resp.Cache != nil {
+		opts.progress("cache", resp.Cache)
+	}
+	return resp
+}
+
+// fromCache fills in the RDAP and WHOIS results from the cache, returning true if both were found.
+// Networks (rather than addresses) are never cached.
+func (resp *LookupResponse) fromCache(ctx context.Context, c *cache.RangeCache) bool {
+	addr, err := netip.ParseAddr(resp.Query)
+	if c == nil || err != nil {
+		return false
+	}
+
+	rdapEntry, found := c.Get(ctx, cacheRDAP, addr)
+	if !found {
+		return false
+	}
+	whoisEntry, found := c.Get(ctx, cacheWhois, addr)
+	if !found || rdapEntry.Start.Less(whoisEntry.Start) || whoisEntry.End.Less(rdapEntry.End) {
+		// The WHOIS result is for a different network.
+		return false
+	}
+
+	rdapResp, whoisResp := &rdap.Response{}, &whois.Response{}
+	if json.Unmarshal(rdapEntry.Value, rdapResp) != nil || json.Unmarshal(whoisEntry.Value, whoisResp) != nil {
+		return false
+	}
+	rdapResp.Query, whoisResp.Query = resp.Query, resp.Query
+	rdapResp.Duration, whoisResp.Duration = 0, 0
+
+	resp.RDAP, resp.Whois = rdapResp, whoisResp
+	resp.Cache = &CacheStatus{
+		Hit:   true,
+		Age:   int(time.Since(rdapEntry.Stored).Seconds()),
+		Start: rdapEntry.Start.String(),
+		End:   rdapEntry.End.String(),
+	}
+	return true
+}
+
+// toCache stores successful RDAP and WHOIS results in the cache, each for the network it's the
+// registration for. Nothing is stored if the WHOIS result is for a smaller network than RDAP's, as
+// it wouldn't be right for the rest of it.
+func (resp *LookupResponse) toCache(ctx context.Context, c *cache.RangeCache) {
+	addr, err := netip.ParseAddr(resp.Query)
+	if c == nil || err != nil {
+		return
+	}
+	resp.Cache = &CacheStatus{Hit: false}
+
+	start, end, ok := resp.network()
+	if !ok || addr.Less(start) || end.Less(addr) {
+		// Don't trust a network that doesn't contain the address.
+		return
+	}
+	whoisStart, whoisEnd, ok := whoisRange(resp.Whois, start, end)
+	if !ok {
+		return
+	}
+
+	if err := c.Put(ctx, cacheRDAP, start, end, resp.RDAP); err != nil {
+		log.Warningf("caching %s for %q failed: %s", cacheRDAP, resp.Query, err)
+		return
+	}
+	if err := c.Put(ctx, cacheWhois, whoisStart, whoisEnd, resp.Whois); err != nil {
+		log.Warningf("caching %s for %q failed: %s", cacheWhois, resp.Query, err)
+		return
+	}
+	resp.Cache.Start, resp.Cache.End = start.String(), end.String()
+}
+
+// network returns the range of the network RDAP returned, if the RDAP and WHOIS lookups succeeded.
+func (resp *LookupResponse) network() (start, end netip.Addr, ok bool) {
+	if resp.RDAP == nil || resp.RDAP.Error != "" || resp.Whois == nil || resp.Whois.Error != "" {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	return parseRange(resp.RDAP.StartAddress, resp.RDAP.EndAddress)
+}
+
+// parseRange parses the first and last addresses of a range.
+func parseRange(first, last string) (start, end netip.Addr, ok bool) {
+	start, err1 := netip.ParseAddr(first)
+	end, err2 := netip.ParseAddr(last)
+	if err1 != nil || err2 != nil {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	start, end = start.Unmap(), end.Unmap()
+	if start.BitLen() != end.BitLen() || end.Less(start) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	return start, end, true
+}
+
+// whoisRange returns the range of addresses the WHOIS result is the registration for, if it
+// includes all of RDAP's network, start to end. That's the range of its parsed Record, or if
+// there isn't one, RDAP's, as the registry's WHOIS has the same networks as its RDAP. It returns
+// false if the result is from a RWhois server, whose registrations are often an ISP's customers'.
+func whoisRange(w *whois.Response, start, end netip.Addr) (netip.Addr, netip.Addr, bool) {
+	source := w.Source()
+	if strings.HasPrefix(source, "rwhois://") {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	if w.Record == nil || source != "whois://"+w.Record.Port43 {
+		return start, end, true
+	}
+
+	whoisStart, whoisEnd, ok := parseRange(w.Record.StartAddress, w.Record.EndAddress)
+	if !ok || start.Less(whoisStart) || whoisEnd.Less(end) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	return whoisStart, whoisEnd, true
+}
+
+// parseLookupQuery returns the canonical form of an address, or network in CIDR notation.
+func parseLookupQuery(query string) (string, error) {
+	if strings.Contains(query, "/") {
+		prefix, err := netip.ParsePrefix(query)
+		if err != nil {
+			return "", err
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		if !prefix.IsValid() {
+			return "", fmt.Errorf("invalid network %q", query)
+		}
+		return prefix.Masked().String(), nil
+	}
+
+	addr, err := netip.ParseAddr(query)
+	if err != nil {
+		return "", err
+	}
+	if addr.Zone() != "" {
+		return "", fmt.Errorf("address %q must not have a zone", query)
+	}
+	return addr.Unmap().String(), nil
+}
+
+// LookupHandler looks up the address, or network, given in the path as /lookup/{query}, for
+// investigating addresses other than the client's. It can be disabled with Config.DisableLookup,
+// and each client is limited to Config.LookupRateLimit requests a minute.
+func (s *DefaultServer) LookupHandler(w http.ResponseWriter, req *http.Request) {
+	query, ok := s.lookupQuery(w, req)
+	if !ok {
+		return
+	}
+
+	s.respond(w, req, http.StatusOK, Lookup(req.Context(), query, s.lookupOptions(req)))
+}
+
+// lookupQuery returns the canonical {query} from the path, if lookups are enabled and the client
+// isn't over its limit. Otherwise it responds with the error, and returns false.
+func (s *DefaultServer) lookupQuery(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if s.Config.DisableLookup {
+		s.respond(w, req, http.StatusNotFound, &ErrResponse{"lookup is disabled"})
+		return "", false
+	}
+
+	host, _, err := s.remoteAddr(req)
+	if err != nil {
+		s.respond(w, req, http.StatusInternalServerError, &ErrResponse{err.Error()})
+		return "", false
+	}
+	if client, err := netip.ParseAddr(host); err == nil {
+		if ok, wait := s.lookupLimiter.Allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.respond(w, req, http.StatusTooManyRequests, &ErrResponse{errTooManyLookups})
+			return "", false
+		}
+	}
+
+	query, err := parseLookupQuery(mux.Vars(req)["query"])
+	if err != nil {
+		s.respond(w, req, http.StatusBadRequest, &ErrResponse{"invalid address or network: " + err.Error()})
+		return "", false
+	}
+	return query, true
+}
+
+// WhoisLookup looks up ip for the WHOIS server's client, returning the reverse DNS names and RDAP
+// response. It has the same limits as /lookup/, so looking up any address other than the client's
+// own is refused if Config.DisableLookup is set, and counts against its rate limit. The results are
+// cached in the same way.
+func (s *DefaultServer) WhoisLookup(ctx context.Context, client, ip string) ([]string, *rdap.Response, error) {
+	addr, err := netip.ParseAddr(client)
+	if err != nil || addr.Unmap().String() != ip {
+		if s.Config.DisableLookup {
+			return nil, nil, errors.New("lookup is disabled")
+		}
+		if err == nil {
+			if ok, wait := s.lookupLimiter.Allow(addr.Unmap()); !ok {
+				return nil, nil, fmt.Errorf("too many lookups, try again in %d seconds", int(math.Ceil(wait.Seconds())))
+			}
+		}
+	}
+
+	resp := Lookup(ctx, ip, LookupOptions{Timeouts: s.timeouts, Cache: s.Cache})
+
+	var names []string
+	if resp.Reverse != nil {
+		names = resp.Reverse.Names
+	}
+	return names, resp.RDAP, nil
+}
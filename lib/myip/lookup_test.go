@@ -0,0 +1,388 @@
+package myip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bramp.net/myip/lib/cache"
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/dns"
+	"bramp.net/myip/lib/rdap"
+	"bramp.net/myip/lib/whois"
+	"github.com/gorilla/mux"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseLookupQuery(t *testing.T) {
+	data := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "192.0.2.1", want: "192.0.2.1"},
+		{query: "::ffff:192.0.2.1", want: "192.0.2.1"},
+		{query: "2001:DB8::1", want: "2001:db8::1"},
+		{query: "192.0.2.1/24", want: "192.0.2.0/24"},
+		{query: "2001:db8::/32", want: "2001:db8::/32"},
+		{query: "::ffff:192.0.2.0/120", want: "192.0.2.0/24"},
+		{query: "::ffff:0.0.0.0/64", wantErr: true},
+		{query: "fe80::1%eth0", wantErr: true},
+		{query: "192.0.2.1/33", wantErr: true},
+		{query: "example.com", wantErr: true},
+		{query: "", wantErr: true},
+	}
+
+	for _, test := range data {
+		got, err := parseLookupQuery(test.query)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseLookupQuery(%q) err = %v, want err %t", test.query, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseLookupQuery(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestLookupHandler(t *testing.T) {
+	data := []struct {
+		name     string
+		config   *conf.Config
+		query    string
+		want     int
+		wantBody string
+	}{
+		{
+			name:     "disabled",
+			config:   &conf.Config{DisableLookup: true},
+			query:    "192.0.2.1",
+			want:     http.StatusNotFound,
+			wantBody: "lookup is disabled",
+		},
+		{
+			name:     "invalid",
+			config:   &conf.Config{},
+			query:    "example.com",
+			want:     http.StatusBadRequest,
+			wantBody: "invalid address or network",
+		},
+		{
+			name:     "address",
+			config:   &conf.Config{},
+			query:    "192.0.2.1",
+			want:     http.StatusOK,
+			wantBody: `{"Query":"192.0.2.1","Family":"IPv4"}`,
+		},
+		{
+			name:     "network",
+			config:   &conf.Config{},
+			query:    "2001:db8::1/32",
+			want:     http.StatusOK,
+			wantBody: `{"Query":"2001:db8::/32","Family":"IPv6"}`,
+		},
+	}
+
+	for _, test := range data {
+		s := NewServer(test.config)
+
+		// Skip the lookups, so we don't hit the network.
+		req := httptest.NewRequest("GET", "http://localhost/lookup/"+test.query+"?reverse=false&whois=false", nil)
+		req = mux.SetURLVars(req, map[string]string{"query": test.query})
+		w := httptest.NewRecorder()
+
+		s.LookupHandler(w, req)
+
+		if w.Code != test.want {
+			t.Errorf("%s: LookupHandler() status = %d, want %d", test.name, w.Code, test.want)
+		}
+		if body := w.Body.String(); !strings.Contains(body, test.wantBody) {
+			t.Errorf("%s: LookupHandler() body = %q, want it to contain %q", test.name, body, test.wantBody)
+		}
+	}
+}
+
+func TestLookupHandlerRateLimit(t *testing.T) {
+	s := NewServer(&conf.Config{LookupRateLimit: 2})
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/lookup/192.0.2.1?reverse=false&whois=false", nil)
+		req = mux.SetURLVars(req, map[string]string{"query": "192.0.2.1"})
+		w := httptest.NewRecorder()
+		s.LookupHandler(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get(); w.Code != http.StatusOK {
+			t.Errorf("LookupHandler() request %d status = %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+
+	w := get()
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("LookupHandler() over the limit status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got, want := w.Header().Get("Retry-After"), "30"; got != want {
+		t.Errorf("LookupHandler() over the limit Retry-After = %q, want %q", got, want)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := newRateLimiter(60) // One a second
+	r.now = func() time.Time { return now }
+
+	a := netip.MustParseAddr("2001:db8::1")
+	b := netip.MustParseAddr("2001:db8::2")   // Same /64 as a
+	c := netip.MustParseAddr("2001:db8:1::1") // Different /64
+
+	for i := 0; i < 60; i++ {
+		if ok, _ := r.Allow(a); !ok {
+			t.Fatalf("Allow(a) request %d = false, want true", i)
+		}
+	}
+	if ok, wait := r.Allow(b); ok || wait != time.Second {
+		t.Errorf("Allow(b) = %t, %s, want false, 1s", ok, wait)
+	}
+	if ok, _ := r.Allow(c); !ok {
+		t.Errorf("Allow(c) = false, want true")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := r.Allow(a); !ok {
+		t.Errorf("Allow(a) after 1s = false, want true")
+	}
+
+	if ok, _ := newRateLimiter(-1).Allow(a); !ok {
+		t.Errorf("unlimited Allow(a) = false, want true")
+	}
+}
+
+func TestRateLimiterFull(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := newRateLimiter(2)
+	r.now = func() time.Time { return now }
+
+	victim := netip.MustParseAddr("192.0.2.1")
+	r.Allow(victim)
+	r.Allow(victim)
+
+	// Fill the rest of the table with active clients, e.g. /64s from the same /48.
+	for i := 1; i < maxRateLimitClients; i++ {
+		addr := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, byte(i >> 8), byte(i)})
+		r.Allow(addr)
+	}
+
+	// The existing clients still have their limits.
+	if ok, _ := r.Allow(victim); ok {
+		t.Errorf("Allow(victim) with a full table = true, want false")
+	}
+
+	// New clients share a limit while the table is full.
+	for i, want := range []bool{true, true, false} {
+		addr := netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})
+		if ok, _ := r.Allow(addr); ok != want {
+			t.Errorf("Allow(%s) with a full table = %t, want %t", addr, ok, want)
+		}
+	}
+
+	// Once the clients are idle, they're forgotten, and new clients get their own limit again.
+	now = now.Add(time.Minute)
+	if ok, _ := r.Allow(netip.MustParseAddr("203.0.113.1")); !ok {
+		t.Errorf("Allow(203.0.113.1) after a minute = false, want true")
+	}
+	if got := len(r.clients); got != 1 {
+		t.Errorf("rateLimiter has %d clients after a minute, want 1", got)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	rdapCalls := fakeLookups(t)
+
+	c := cache.New(cache.NewLRU(100), time.Hour)
+	allowed := 0
+	opts := LookupOptions{NoReverse: true, Cache: c, Allow: func() bool {
+		allowed++
+		return true
+	}}
+
+	first := Lookup(context.Background(), "192.0.2.1", opts)
+	if want := (&CacheStatus{Hit: false, Start: "192.0.2.0", End: "192.0.2.255"}); pretty.Compare(first.Cache, want) != "" {
+		t.Errorf("Lookup(192.0.2.1) Cache = %s, want %s", pretty.Sprint(first.Cache), pretty.Sprint(want))
+	}
+
+	// Another address in the same network.
+	second := Lookup(context.Background(), "192.0.2.200", opts)
+	if second.Cache == nil || !second.Cache.Hit || second.Cache.Start != "192.0.2.0" {
+		t.Errorf("Lookup(192.0.2.200) Cache = %s, want a hit", pretty.Sprint(second.Cache))
+	}
+	if second.RDAP == nil || second.RDAP.Name != "NET-192.0.2" || second.RDAP.Query != "192.0.2.200" {
+		t.Errorf("Lookup(192.0.2.200) RDAP = %s, want the cached network", pretty.Sprint(second.RDAP))
+	}
+	if second.Whois == nil || second.Whois.Body != "whois 192.0.2.1" || second.Whois.Query != "192.0.2.200" {
+		t.Errorf("Lookup(192.0.2.200) Whois = %s, want the cached response", pretty.Sprint(second.Whois))
+	}
+
+	Lookup(context.Background(), "198.51.100.1", opts)
+	if *rdapCalls != 2 {
+		t.Errorf("Lookup() made %d RDAP queries, want 2", *rdapCalls)
+	}
+	// Cache hits aren't counted.
+	if allowed != 2 {
+		t.Errorf("Lookup() called Allow %d times, want 2", allowed)
+	}
+
+	// Over the limit, the registries aren't asked.
+	opts.Allow = func() bool { return false }
+	if resp := Lookup(context.Background(), "203.0.113.1", opts); resp.RDAP.Error != errTooManyLookups || resp.Whois.Error != errTooManyLookups {
+		t.Errorf("Lookup(203.0.113.1) over the limit = %s, want too many lookups errors", pretty.Sprint(resp))
+	}
+	if *rdapCalls != 2 {
+		t.Errorf("Lookup() over the limit made %d RDAP queries, want 2", *rdapCalls)
+	}
+}
+
+func TestLookupCacheWhoisRange(t *testing.T) {
+	data := []struct {
+		name  string
+		whois *whois.Response
+		want  int // RDAP queries for two addresses in the same network
+	}{
+		{
+			name: "registry",
+			whois: &whois.Response{
+				Hops:   []whois.Hop{{Server: "whois://whois.iana.org"}, {Server: "whois://whois.arin.net", Body: "NetName: EXAMPLE"}},
+				Record: &rdap.Response{Port43: "whois.arin.net", StartAddress: "192.0.0.0", EndAddress: "192.0.3.255"},
+			},
+			want: 1,
+		},
+		{
+			name: "smaller network",
+			whois: &whois.Response{
+				Hops:   []whois.Hop{{Server: "whois://whois.iana.org"}, {Server: "whois://whois.arin.net", Body: "NetName: CUSTOMER"}},
+				Record: &rdap.Response{Port43: "whois.arin.net", StartAddress: "192.0.2.0", EndAddress: "192.0.2.127"},
+			},
+			want: 2,
+		},
+		{
+			name: "rwhois",
+			whois: &whois.Response{
+				Hops: []whois.Hop{
+					{Server: "whois://whois.iana.org"},
+					{Server: "whois://whois.arin.net", Body: "NetName: ISP"},
+					{Server: "rwhois://rwhois.example.net", Body: "network:Network-Name:CUSTOMER"},
+				},
+				Record: &rdap.Response{Port43: "whois.arin.net", StartAddress: "192.0.2.0", EndAddress: "192.0.2.255"},
+			},
+			want: 2,
+		},
+	}
+
+	for _, test := range data {
+		fakeWhois := func(_ context.Context, addr string) *whois.Response {
+			resp := *test.whois
+			resp.Query = addr
+			return &resp
+		}
+		rdapCalls := fakeLookups(t)
+		lookupWhois = fakeWhois
+
+		c := cache.New(cache.NewLRU(100), time.Hour)
+		for _, query := range []string{"192.0.2.1", "192.0.2.200"} {
+			Lookup(context.Background(), query, LookupOptions{NoReverse: true, Cache: c})
+		}
+		if got := int(*rdapCalls); got != test.want {
+			t.Errorf("%s: Lookup() made %d RDAP queries, want %d", test.name, got, test.want)
+		}
+
+		// Bulk lookups reuse the results in the same way.
+		rdapCalls = fakeLookups(t)
+		lookupWhois = fakeWhois
+		BulkLookup(context.Background(), []string{"192.0.2.1", "192.0.2.200"}, 1, LookupOptions{NoReverse: true}, func(*LookupResponse) {})
+		if got := int(*rdapCalls); got != test.want {
+			t.Errorf("%s: BulkLookup() made %d RDAP queries, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLookupTimeouts(t *testing.T) {
+	fakeLookups(t)
+
+	deadlines := make(map[string]time.Time)
+	var mu sync.Mutex
+	record := func(name string, ctx context.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		deadlines[name], _ = ctx.Deadline()
+	}
+
+	oldReverse, oldRDAP := lookupReverse, lookupRDAP
+	defer func() { lookupReverse, lookupRDAP = oldReverse, oldRDAP }()
+
+	lookupReverse = func(ctx context.Context, addr string) *dns.Response {
+		record("reverse", ctx)
+		return &dns.Response{Query: addr}
+	}
+	lookupRDAP = func(ctx context.Context, addr string) *rdap.Response {
+		record("rdap", ctx)
+		<-ctx.Done()
+		return &rdap.Response{Query: addr, Error: ctx.Err().Error(), TimedOut: true}
+	}
+
+	start := time.Now()
+	resp := Lookup(context.Background(), "192.0.2.1", LookupOptions{
+		Timeouts: Timeouts{Total: time.Minute, RDAP: 10 * time.Millisecond},
+	})
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("Lookup() took %s, want about 10ms", took)
+	}
+
+	if resp.RDAP == nil || !resp.RDAP.TimedOut {
+		t.Errorf("Lookup() RDAP = %s, want it to have timed out", pretty.Sprint(resp.RDAP))
+	}
+	if resp.Whois == nil || resp.Whois.TimedOut || resp.Whois.Body == "" {
+		t.Errorf("Lookup() Whois = %s, want it to have finished", pretty.Sprint(resp.Whois))
+	}
+
+	if deadlines["reverse"].IsZero() || deadlines["rdap"].IsZero() || !deadlines["rdap"].Before(deadlines["reverse"]) {
+		t.Errorf("Lookup() deadlines = %v, want reverse limited by Total, and rdap by the shorter RDAP timeout", deadlines)
+	}
+}
+
+func TestWhoisLookup(t *testing.T) {
+	rdapCalls := fakeLookups(t)
+	s := NewServer(&conf.Config{LookupRateLimit: 1})
+	ctx := context.Background()
+
+	// The client's own address doesn't count against the limit.
+	for i := 0; i < 2; i++ {
+		if _, resp, err := s.WhoisLookup(ctx, "192.0.2.99", "192.0.2.99"); err != nil || resp == nil {
+			t.Errorf("WhoisLookup(me) = %v, %v, want a response", resp, err)
+		}
+	}
+	if _, _, err := s.WhoisLookup(ctx, "192.0.2.99", "198.51.100.1"); err != nil {
+		t.Errorf("WhoisLookup(198.51.100.1) err: %s, want nil", err)
+	}
+	if _, _, err := s.WhoisLookup(ctx, "192.0.2.99", "198.51.100.2"); err == nil || !strings.Contains(err.Error(), "too many lookups") {
+		t.Errorf("WhoisLookup(198.51.100.2) over the limit err = %v, want too many lookups", err)
+	}
+
+	// The second lookup of the client's network came from the cache.
+	if *rdapCalls != 2 {
+		t.Errorf("WhoisLookup() made %d RDAP queries, want 2", *rdapCalls)
+	}
+
+	s = NewServer(&conf.Config{DisableLookup: true})
+	if _, _, err := s.WhoisLookup(ctx, "192.0.2.99", "198.51.100.1"); err == nil {
+		t.Errorf("WhoisLookup() with lookups disabled err = nil, want an error")
+	}
+	if _, _, err := s.WhoisLookup(ctx, "192.0.2.99", "192.0.2.99"); err != nil {
+		t.Errorf("WhoisLookup(me) with lookups disabled err: %s, want nil", err)
+	}
+}
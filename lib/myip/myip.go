@@ -25,6 +25,7 @@ import (
 
 	"bramp.net/myip/lib/dns"
 	"bramp.net/myip/lib/location"
+	"bramp.net/myip/lib/proxyproto"
 	"bramp.net/myip/lib/rdap"
 	"bramp.net/myip/lib/ua"
 	"bramp.net/myip/lib/whois"
@@ -40,8 +41,24 @@ type Response struct {
 	RemoteAddrRDAP    *rdap.Response  `json:",omitempty"`
 	RemoteAddrWhois   *whois.Response `json:",omitempty"`
 
+	// RemoteAddrOrigin is the AS announcing RemoteAddr.
+	RemoteAddrOrigin *Origin `json:",omitempty"`
+
+	// RemoteAddrAbuseContact is who to report abuse from RemoteAddr to.
+	RemoteAddrAbuseContact *AbuseContact `json:",omitempty"`
+
+	// RemoteAddrCache is if the RDAP and WHOIS results came from the cache.
+	RemoteAddrCache *CacheStatus `json:",omitempty"`
+
 	ActualRemoteAddr string `json:",omitempty"` // The actual one we observed
 
+	// ProxyChain is every hop the request passed through, starting with the client, according
+	// to the proxy headers. Only hops after the last trusted proxy can be believed.
+	ProxyChain []Hop `json:",omitempty"`
+
+	// ProxyProtocol is the PROXY protocol header sent by our load balancer (if any).
+	ProxyProtocol *proxyproto.Header `json:",omitempty"`
+
 	Method string
 	URL    string
 	Proto  string
@@ -56,10 +73,22 @@ type Response struct {
 
 // MyIPHandler is the main code to handle a IP lookup.
 func (s *DefaultServer) MyIPHandler(req *http.Request) (*Response, error) {
+	return s.myIP(req, nil)
+}
+
+// myIP does the lookups for MyIPHandler. If progress is set, it's first called with the Response
+// before any lookups finish, as "response", then with each result as it's ready, named "reverse",
+// "rdap", "whois", "origin", "abuse", "cache", "location" and "ua". After the first, it may be called
+// concurrently.
+func (s *DefaultServer) myIP(req *http.Request, progress func(event string, v interface{})) (*Response, error) {
 	ctx := req.Context()
 	wg := &sync.WaitGroup{}
 
-	host, err := s.GetRemoteAddr(req)
+	if progress == nil {
+		progress = func(string, interface{}) {}
+	}
+
+	host, chain, err := s.remoteAddr(req)
 	if err != nil {
 		return nil, fmt.Errorf("getting remote addr: %s", err)
 	}
@@ -70,70 +99,63 @@ func (s *DefaultServer) MyIPHandler(req *http.Request) (*Response, error) {
 		family = f
 	}
 
-	var dnsResp *dns.Response
-	var rdapResp *rdap.Response
-	var whoisResp *whois.Response
-	var locationResponse *location.Response
-	var userAgentClient *uaparser.Client // TODO change this to be a ua.Response
+	// Remove all headers we don't want to display to the user. This is done on a copy, as the
+	// location lookup may still need them.
+	header := req.Header.Clone()
+	for _, remove := range s.Config.DisallowedHeaders {
+		header.Del(remove)
+	}
 
-	if host != "" {
-		if req.URL.Query().Get("reverse") != "false" {
-			addToWg(wg, func() {
-				dnsResp = dns.HandleReverseDNS(ctx, host)
-			})
-		}
+	resp := &Response{
+		RequestID: req.Header.Get(s.Config.RequestIDHeader),
 
-		if req.URL.Query().Get("whois") != "false" {
-			addToWg(wg, func() {
-				rdapResp = rdap.Handle(ctx, host)
-			})
-			addToWg(wg, func() {
-				whoisResp = whois.Handle(ctx, host)
-			})
-		}
+		RemoteAddr:       host,
+		RemoteAddrFamily: family,
+
+		ActualRemoteAddr: req.RemoteAddr,
+		ProxyChain:       chain,
+		ProxyProtocol:    proxyproto.FromContext(req.Context()),
+
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Proto:  req.Proto,
+		Header: header,
+	}
+	progress("response", resp)
+
+	// Each goroutine sets a different field of resp.
+	if host != "" {
+		opts := s.lookupOptions(req)
+		opts.Progress = progress
+		addToWg(wg, func() {
+			lookup := Lookup(ctx, host, opts)
+			resp.RemoteAddrReverse = lookup.Reverse
+			resp.RemoteAddrRDAP = lookup.RDAP
+			resp.RemoteAddrWhois = lookup.Whois
+			resp.RemoteAddrOrigin = lookup.Origin
+			resp.RemoteAddrAbuseContact = lookup.AbuseContact
+			resp.RemoteAddrCache = lookup.Cache
+		})
 	}
 
 	if req.URL.Query().Get("ua") != "false" {
 		if useragent := req.Header.Get("User-Agent"); useragent != "" {
 			addToWg(wg, func() {
-				userAgentClient = ua.DetermineUA(useragent)
+				resp.UserAgent = ua.DetermineUA(useragent)
+				progress("ua", resp.UserAgent)
 			})
 		}
 	}
 
 	addToWg(wg, func() {
-		locationResponse = location.Handle(s.Config, req)
+		resp.Location = location.Handle(s.Config, req)
+		progress("location", resp.Location)
 	})
 
-	requestID := req.Header.Get(s.Config.RequestIDHeader)
-
-	// Remove all headers we don't want to display to the user
-	for _, remove := range s.Config.DisallowedHeaders {
-		req.Header.Del(remove)
-	}
-
 	// Wait for all the responses to come back
 	wg.Wait()
 
-	return &Response{
-		RequestID: requestID,
-
-		RemoteAddr:        host,
-		RemoteAddrFamily:  family,
-		RemoteAddrReverse: dnsResp,
-		RemoteAddrRDAP:    rdapResp,
-		RemoteAddrWhois:   whoisResp,
-
-		ActualRemoteAddr: req.RemoteAddr,
-
-		UserAgent: userAgentClient,
-		Location:  locationResponse,
-
-		Method: req.Method,
-		URL:    req.URL.String(),
-		Proto:  req.Proto,
-		Header: req.Header,
-	}, nil
+	return resp, nil
 }
 
 // addToWg executes the function in a new gorountine and adds it to the WaitGroup, calling wg.Done
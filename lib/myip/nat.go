@@ -0,0 +1,78 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"bramp.net/myip/lib/stun"
+)
+
+// NATResponse describes the client's NAT, as seen by the STUN server.
+type NATResponse struct {
+	RemoteAddr string
+
+	// Mapping and Filtering are the NAT's behaviours (RFC 4787), e.g. "endpoint-independent".
+	Mapping   string
+	Filtering string
+
+	// Observations are the recent Binding requests the STUN server received from RemoteAddr.
+	Observations []stun.Observation
+}
+
+// NATHandler classifies the client's NAT from the Binding requests it recently sent to our STUN
+// server. The client must query this from the same IP address it used for STUN.
+//
+// The mapping behaviour is worked out from the requests. The filtering behaviour can only be
+// known by the client, so it passes the results of its CHANGE-REQUEST tests as the change_addr
+// and change_port query parameters (true if the response arrived).
+func (s *DefaultServer) NATHandler(w http.ResponseWriter, req *http.Request) {
+	if s.STUN == nil {
+		s.respond(w, req, http.StatusNotFound, &ErrResponse{"STUN server is not enabled"})
+		return
+	}
+
+	host, _, err := s.remoteAddr(req)
+	if err != nil {
+		s.respond(w, req, http.StatusInternalServerError, &ErrResponse{err.Error()})
+		return
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		s.respond(w, req, http.StatusBadRequest, &ErrResponse{"invalid remote address: " + err.Error()})
+		return
+	}
+
+	observations := s.STUN.Observations(addr)
+	resp := &NATResponse{
+		RemoteAddr:   addr.String(),
+		Mapping:      stun.Mapping(observations),
+		Filtering:    stun.Unknown,
+		Observations: observations,
+	}
+
+	query := req.URL.Query()
+	if query.Has("change_addr") || query.Has("change_port") {
+		changeAddr, _ := strconv.ParseBool(query.Get("change_addr"))
+		changePort, _ := strconv.ParseBool(query.Get("change_port"))
+		resp.Filtering = stun.Filtering(changeAddr, changePort)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.respond(w, req, http.StatusOK, resp)
+}
@@ -0,0 +1,58 @@
+package myip
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/stun"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestNATHandler(t *testing.T) {
+	s := NewServer(&conf.Config{})
+
+	req := httptest.NewRequest("GET", "http://localhost/nat", nil)
+	w := httptest.NewRecorder()
+	s.NATHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("NATHandler() without STUN status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	s.STUN, _ = stun.Listen("127.0.0.1:0", "")
+	if s.STUN == nil {
+		t.Skip("Unable to listen")
+	}
+	defer s.STUN.Close()
+
+	data := []struct {
+		query string
+		want  *NATResponse
+	}{
+		{
+			query: "",
+			want:  &NATResponse{RemoteAddr: "192.0.2.1", Mapping: stun.Unknown, Filtering: stun.Unknown},
+		},
+		{
+			query: "?change_addr=false&change_port=true",
+			want:  &NATResponse{RemoteAddr: "192.0.2.1", Mapping: stun.Unknown, Filtering: stun.AddressDependent},
+		},
+	}
+
+	for _, test := range data {
+		req := httptest.NewRequest("GET", "http://localhost/nat"+test.query, nil)
+		w := httptest.NewRecorder()
+		s.NATHandler(w, req)
+
+		got := &NATResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+			t.Errorf("NATHandler(%q) returned invalid JSON: %s", test.query, err)
+			continue
+		}
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("NATHandler(%q) diff (-got +want)\n%s", test.query, diff)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"strconv"
+
+	"bramp.net/myip/lib/cache"
+	"bramp.net/myip/lib/rdap"
+	log "github.com/sirupsen/logrus"
+)
+
+// Origin is the autonomous system announcing the network an address is in.
+type Origin struct {
+	// Prefix is the most specific announced prefix containing the address.
+	Prefix string
+
+	// ASNs are the origin AS numbers. There is more than one if the prefix is announced by
+	// several, or from an AS set.
+	ASNs []uint32
+
+	// Name is who the first AS is registered to, from its RDAP registration.
+	Name string `json:",omitempty"`
+
+	// AS is the RDAP registration of the first of the ASNs.
+	AS *rdap.ASResponse `json:",omitempty"`
+
+	// Mismatch is set if the announced Prefix isn't the network RDAP has registered. It's
+	// "less-specific" if the Prefix covers more than the network, as when a provider announces
+	// one aggregate for its customers' networks, "more-specific" if it covers less, or
+	// "overlapping" if the network isn't a CIDR block, and neither contains the other.
+	Mismatch string `json:",omitempty"`
+}
+
+// Origin mismatches.
+const (
+	mismatchLessSpecific = "less-specific"
+	mismatchMoreSpecific = "more-specific"
+	mismatchOverlapping  = "overlapping"
+)
+
+// String returns the first origin AS and who it's registered to, e.g. "AS15169 Google LLC".
+func (o *Origin) String() string {
+	if len(o.ASNs) == 0 {
+		return ""
+	}
+	s := "AS" + strconv.FormatUint(uint64(o.ASNs[0]), 10)
+	if o.Name != "" {
+		s += " " + o.Name
+	}
+	return s
+}
+
+// PrefixTable finds the announced prefix containing an address, and its origin AS numbers. It's
+// implemented by *bgp.Table, and *bgp.Source.
+type PrefixTable interface {
+	Lookup(addr netip.Addr) (netip.Prefix, []uint32)
+}
+
+// findOrigin returns the AS announcing the address, with its RDAP registration, or nil if the
+// address isn't in the table. The registration is cached in c, if not nil.
+func findOrigin(ctx context.Context, t PrefixTable, c *cache.RangeCache, query string) *Origin {
+	addr, err := netip.ParseAddr(query)
+	if err != nil {
+		return nil
+	}
+
+	prefix, asns := t.Lookup(addr)
+	if !prefix.IsValid() || len(asns) == 0 {
+		return nil
+	}
+
+	origin := &Origin{
+		Prefix: prefix.String(),
+		ASNs:   asns,
+		AS:     cachedASN(ctx, c, asns[0]),
+	}
+	if origin.AS != nil && origin.AS.Error == "" {
+		origin.Name = origin.AS.Org()
+	}
+	return origin
+}
+
+// cachedASN returns the RDAP registration of the AS from the cache, or if it's not there, looks it
+// up, and caches it if successful. Busy ASes are the origin for many clients, so this saves asking
+// the registry each time.
+func cachedASN(ctx context.Context, c *cache.RangeCache, asn uint32) *rdap.ASResponse {
+	if c == nil {
+		return lookupASN(ctx, asn)
+	}
+
+	key := cacheASN + "/" + strconv.FormatUint(uint64(asn), 10)
+	if data, found := c.Store.Get(ctx, key); found {
+		resp := &rdap.ASResponse{}
+		if err := json.Unmarshal(data, resp); err == nil {
+			resp.Duration = 0
+			return resp
+		}
+	}
+
+	resp := lookupASN(ctx, asn)
+	if resp != nil && resp.Error == "" {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			log.Warningf("caching AS%d failed: %s", asn, err)
+			return resp
+		}
+		c.Store.Set(ctx, key, data, c.TTL)
+	}
+	return resp
+}
+
+// compareRDAP sets Mismatch if the announced prefix isn't the network in the RDAP response. It's
+// left unset if the RDAP response has no network.
+func (o *Origin) compareRDAP(resp *rdap.Response) {
+	if resp == nil || resp.Error != "" {
+		return
+	}
+	start, err1 := netip.ParseAddr(resp.StartAddress)
+	end, err2 := netip.ParseAddr(resp.EndAddress)
+	prefix, err3 := netip.ParsePrefix(o.Prefix)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return
+	}
+	start, end = start.Unmap(), end.Unmap()
+	first, last := prefix.Addr(), cache.LastAddr(prefix)
+	if start.Is4() != first.Is4() {
+		return
+	}
+
+	switch {
+	case first == start && last == end:
+		o.Mismatch = ""
+	case first.Compare(start) <= 0 && last.Compare(end) >= 0:
+		o.Mismatch = mismatchLessSpecific
+	case first.Compare(start) >= 0 && last.Compare(end) <= 0:
+		o.Mismatch = mismatchMoreSpecific
+	default:
+		o.Mismatch = mismatchOverlapping
+	}
+}
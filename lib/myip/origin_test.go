@@ -0,0 +1,179 @@
+package myip
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"bramp.net/myip/lib/bgp"
+	"bramp.net/myip/lib/cache"
+	"bramp.net/myip/lib/rdap"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const testPfx2as = `8.0.0.0	9	3356
+8.8.8.0	24	15169
+192.0.2.0	24	64496_64497
+198.51.100.0	23	64498
+`
+
+func TestLookupOrigin(t *testing.T) {
+	fakeLookups(t)
+
+	table, err := bgp.ParsePfx2as(strings.NewReader(testPfx2as))
+	if err != nil {
+		t.Fatalf("ParsePfx2as() err = %s", err)
+	}
+	lookupASN = func(_ context.Context, asn uint32) *rdap.ASResponse {
+		return &rdap.ASResponse{
+			ASN:      asn,
+			Name:     "EXAMPLE",
+			Entities: []rdap.Entity{{Name: "Example Inc.", Roles: []string{"registrant"}}},
+		}
+	}
+
+	var events []string
+	opts := LookupOptions{
+		NoReverse: true,
+		Origins:   table,
+		Progress: func(event string, _ interface{}) {
+			if event == "origin" {
+				events = append(events, event)
+			}
+		},
+	}
+
+	resp := Lookup(context.Background(), "192.0.2.1", opts)
+	if resp.Origin == nil {
+		t.Fatalf("Lookup(192.0.2.1) Origin = nil, want AS64496")
+	}
+	if got, want := resp.Origin.String(), "AS64496 Example Inc."; got != want {
+		t.Errorf("Lookup(192.0.2.1) Origin = %q, want %q", got, want)
+	}
+	// The fake RDAP returns the /24, which matches the announcement.
+	if resp.Origin.Prefix != "192.0.2.0/24" || len(resp.Origin.ASNs) != 2 || resp.Origin.Mismatch != "" {
+		t.Errorf("Lookup(192.0.2.1) Origin = %s, want 192.0.2.0/24 from two ASes", pretty.Sprint(resp.Origin))
+	}
+	if len(events) != 1 {
+		t.Errorf("Lookup(192.0.2.1) origin events = %d, want 1", len(events))
+	}
+
+	// The /23 announcement covers more than the /24 RDAP returns.
+	if resp := Lookup(context.Background(), "198.51.100.1", opts); resp.Origin == nil || resp.Origin.Mismatch != mismatchLessSpecific {
+		t.Errorf("Lookup(198.51.100.1) Origin = %s, want a less-specific mismatch", pretty.Sprint(resp.Origin))
+	}
+
+	// Not announced, or a network, have no origin.
+	for _, query := range []string{"203.0.113.1", "192.0.2.0/24"} {
+		if resp := Lookup(context.Background(), query, opts); resp.Origin != nil {
+			t.Errorf("Lookup(%q) Origin = %s, want nil", query, pretty.Sprint(resp.Origin))
+		}
+	}
+}
+
+func TestLookupOriginCache(t *testing.T) {
+	fakeLookups(t)
+
+	table, err := bgp.ParsePfx2as(strings.NewReader(testPfx2as))
+	if err != nil {
+		t.Fatalf("ParsePfx2as() err = %s", err)
+	}
+
+	asnCalls := 0
+	lookupASN = func(_ context.Context, asn uint32) *rdap.ASResponse {
+		asnCalls++
+		return &rdap.ASResponse{
+			ASN:      asn,
+			Name:     "GOOGLE",
+			Entities: []rdap.Entity{{Name: "Google LLC", Roles: []string{"registrant"}}},
+		}
+	}
+
+	// Two addresses announced by the same AS.
+	opts := LookupOptions{NoReverse: true, Origins: table, Cache: cache.New(cache.NewLRU(100), time.Hour)}
+	for _, query := range []string{"8.8.8.8", "8.8.8.4"} {
+		resp := Lookup(context.Background(), query, opts)
+		if resp.Origin == nil || resp.Origin.String() != "AS15169 Google LLC" {
+			t.Errorf("Lookup(%q) Origin = %s, want AS15169 Google LLC", query, pretty.Sprint(resp.Origin))
+		}
+	}
+	if asnCalls != 1 {
+		t.Errorf("Lookup() made %d AS queries, want 1", asnCalls)
+	}
+}
+
+func TestBulkLookupOrigin(t *testing.T) {
+	fakeLookups(t)
+
+	table, err := bgp.ParsePfx2as(strings.NewReader(testPfx2as))
+	if err != nil {
+		t.Fatalf("ParsePfx2as() err = %s", err)
+	}
+
+	// The second address reuses the first's network, so Lookup doesn't do its RDAP lookup.
+	var got []*LookupResponse
+	opts := LookupOptions{NoReverse: true, Origins: table}
+	BulkLookup(context.Background(), []string{"198.51.100.1", "198.51.100.2"}, 1, opts, func(resp *LookupResponse) {
+		got = append(got, resp)
+	})
+
+	if len(got) != 2 {
+		t.Fatalf("BulkLookup() returned %d results, want 2", len(got))
+	}
+	for _, resp := range got {
+		if resp.Origin == nil || resp.Origin.Prefix != "198.51.100.0/23" || resp.Origin.Mismatch != mismatchLessSpecific {
+			t.Errorf("BulkLookup() %s Origin = %s, want 198.51.100.0/23, with a less-specific mismatch", resp.Query, pretty.Sprint(resp.Origin))
+		}
+	}
+
+	// The origin comes from the local table, so is found without the RDAP and WHOIS lookups.
+	opts.NoWhois = true
+	if resp := Lookup(context.Background(), "192.0.2.1", opts); resp.Origin == nil || resp.Origin.Prefix != "192.0.2.0/24" {
+		t.Errorf("Lookup(192.0.2.1) with NoWhois Origin = %s, want 192.0.2.0/24", pretty.Sprint(resp.Origin))
+	}
+}
+
+func TestOriginCompareRDAP(t *testing.T) {
+	data := []struct {
+		prefix string
+		rdap   *rdap.Response
+		want   string
+	}{
+		{prefix: "8.8.8.0/24", rdap: &rdap.Response{StartAddress: "8.8.8.0", EndAddress: "8.8.8.255"}, want: ""},
+		{prefix: "8.0.0.0/9", rdap: &rdap.Response{StartAddress: "8.8.8.0", EndAddress: "8.8.8.255"}, want: mismatchLessSpecific},
+		{prefix: "8.8.8.0/25", rdap: &rdap.Response{StartAddress: "8.8.8.0", EndAddress: "8.8.8.255"}, want: mismatchMoreSpecific},
+		{prefix: "8.8.8.0/24", rdap: &rdap.Response{StartAddress: "8.8.8.128", EndAddress: "8.8.9.127"}, want: mismatchOverlapping},
+		{prefix: "2001:4860::/32", rdap: &rdap.Response{StartAddress: "2001:4860::", EndAddress: "2001:4860:ffff:ffff:ffff:ffff:ffff:ffff"}, want: ""},
+		{prefix: "2001:4860::/33", rdap: &rdap.Response{StartAddress: "2001:4860::", EndAddress: "2001:4860:ffff:ffff:ffff:ffff:ffff:ffff"}, want: mismatchMoreSpecific},
+
+		// Nothing to compare with.
+		{prefix: "8.8.8.0/25", rdap: nil, want: ""},
+		{prefix: "8.8.8.0/25", rdap: &rdap.Response{Error: "timeout"}, want: ""},
+		{prefix: "8.8.8.0/25", rdap: &rdap.Response{StartAddress: "2001:4860::", EndAddress: "2001:4860::ff"}, want: ""},
+	}
+
+	for _, test := range data {
+		o := &Origin{Prefix: test.prefix, ASNs: []uint32{15169}}
+		if o.compareRDAP(test.rdap); o.Mismatch != test.want {
+			t.Errorf("Origin{Prefix: %q}.compareRDAP(%+v) Mismatch = %q, want %q", test.prefix, test.rdap, o.Mismatch, test.want)
+		}
+	}
+}
+
+func TestOriginString(t *testing.T) {
+	data := []struct {
+		origin *Origin
+		want   string
+	}{
+		{origin: &Origin{}, want: ""},
+		{origin: &Origin{ASNs: []uint32{15169}}, want: "AS15169"},
+		{origin: &Origin{ASNs: []uint32{15169, 36040}, Name: "Google LLC"}, want: "AS15169 Google LLC"},
+	}
+
+	for _, test := range data {
+		if got := test.origin.String(); got != test.want {
+			t.Errorf("%+v.String() = %q, want %q", test.origin, got, test.want)
+		}
+	}
+}
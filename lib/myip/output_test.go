@@ -57,6 +57,13 @@ func fullResponse() *Response {
 			},
 			Body: "Name:            EN-139\nHandle:          NET-198-212-194-0-1\nRange:           198.212.194.0 - 198.212.195.255\nCIDR:            198.212.194.0/23\nIP Version:      v4\nType:            DIRECT ALLOCATION\nStatus:          active",
 		},
+		RemoteAddrOrigin: &Origin{
+			Prefix: "198.212.194.0/23",
+			ASNs:   []uint32{400219},
+			Name:   "ESpace Networks",
+
+			Mismatch: mismatchLessSpecific,
+		},
 		RemoteAddrWhois: &whois.Response{
 			Query: "198.212.195.91",
 			Body:  "NetRange:       198.212.194.0 - 198.212.195.255\nNetName:        EN-139\nOrgName:        ESpace Networks",
@@ -92,6 +99,7 @@ func TestCLITemplateFullResponse(t *testing.T) {
 		"EN-139",
 		"NET-198-212-194-0-1",
 		"198.212.194.0/23",
+		"Origin: AS400219 ESpace Networks (198.212.194.0/23, RDAP mismatch: less-specific)",
 		"WHOIS:",
 		"NetRange:",
 		"ESpace Networks",
@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Hop is a single address the request passed through on its way to this server.
+type Hop struct {
+	Addr string
+
+	// Source is where the address came from, e.g. "RemoteAddr" or "X-Forwarded-For".
+	Source string
+
+	// Trusted is true if this hop is a trusted proxy, and thus what it told us can be believed.
+	Trusted bool `json:",omitempty"`
+}
+
+// proxyHops returns the addresses the proxy headers claim the request passed through, with the
+// client first. If header is set, only it is used, as it's the one the nearest trusted proxy
+// appends to. Otherwise X-Forwarded-For is used if present, then the Forwarded header (RFC 7239), and
+// then Cf-Connecting-Ip. X-Forwarded-For is preferred because it's what most load balancers
+// append, so a Forwarded header sent by the client can't override it.
+func proxyHops(req *http.Request, header string) []Hop {
+	switch header {
+	case "Forwarded":
+		return forwardedHops(req)
+	case "X-Forwarded-For":
+		return xForwardedForHops(req)
+	case "Cf-Connecting-Ip":
+		return cfConnectingIPHops(req)
+	}
+
+	if hops := xForwardedForHops(req); len(hops) > 0 {
+		return hops
+	}
+	if hops := forwardedHops(req); len(hops) > 0 {
+		return hops
+	}
+	return cfConnectingIPHops(req)
+}
+
+// forwardedHops returns the "for" addresses from the Forwarded headers.
+func forwardedHops(req *http.Request) []Hop {
+	var hops []Hop
+	for _, element := range splitList(req.Header.Values("Forwarded")) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(key, "for") {
+				hops = append(hops, Hop{Addr: forwardedAddr(value), Source: "Forwarded"})
+			}
+		}
+	}
+	return hops
+}
+
+// xForwardedForHops returns the addresses from the X-Forwarded-For headers.
+func xForwardedForHops(req *http.Request) []Hop {
+	var hops []Hop
+	for _, addr := range splitList(req.Header.Values("X-Forwarded-For")) {
+		hops = append(hops, Hop{Addr: forwardedAddr(addr), Source: "X-Forwarded-For"})
+	}
+	return hops
+}
+
+// cfConnectingIPHops returns the address from the Cf-Connecting-Ip header.
+func cfConnectingIPHops(req *http.Request) []Hop {
+	if addr := req.Header.Get("Cf-Connecting-Ip"); addr != "" {
+		return []Hop{{Addr: forwardedAddr(addr), Source: "Cf-Connecting-Ip"}}
+	}
+	return nil
+}
+
+// splitList splits the comma separated header values into a single list.
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// forwardedAddr normalises an address from a proxy header, removing any quotes, brackets, or
+// port. Obfuscated identifiers (such as "unknown" or "_hidden") are returned as is.
+func forwardedAddr(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.Trim(s, "[]")
+}
+
+// resolveProxyChain walks the chain from right (closest to us) to left, skipping over trusted
+// proxies, and returns the index of the first hop that is not a trusted proxy. This is the client.
+// The Trusted field is filled in for each hop.
+func resolveProxyChain(chain []Hop, trusted []netip.Prefix) int {
+	for i := range chain {
+		chain[i].Trusted = isTrusted(chain[i].Addr, trusted)
+	}
+
+	i := len(chain) - 1
+	for i > 0 && chain[i].Trusted {
+		if _, err := netip.ParseAddr(chain[i-1].Addr); err != nil {
+			// The next hop is obfuscated or garbage, so we can't go any further.
+			break
+		}
+		i--
+	}
+	return i
+}
+
+// isTrusted returns true if addr is inside one of the trusted networks.
+func isTrusted(addr string, trusted []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package myip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestRemoteAddrProxyChain(t *testing.T) {
+	data := []struct {
+		name        string
+		proxyHeader string
+		remoteAddr  string
+		header      http.Header
+		want        string
+		wantChain   []Hop
+	}{
+		{
+			name:       "no headers",
+			remoteAddr: "1.2.3.4:1234",
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "untrusted peer",
+			remoteAddr: "1.2.3.4:1234",
+			header:     http.Header{"X-Forwarded-For": {"5.6.7.8"}},
+			want:       "1.2.3.4",
+			wantChain: []Hop{
+				{Addr: "5.6.7.8", Source: "X-Forwarded-For"},
+				{Addr: "1.2.3.4", Source: "RemoteAddr"},
+			},
+		},
+		{
+			name:       "cloudflare and load balancer",
+			remoteAddr: "10.1.2.3:1234",
+			header:     http.Header{"X-Forwarded-For": {"6.6.6.6, 5.6.7.8, 173.245.48.1"}},
+			want:       "5.6.7.8",
+			wantChain: []Hop{
+				{Addr: "6.6.6.6", Source: "X-Forwarded-For"},
+				{Addr: "5.6.7.8", Source: "X-Forwarded-For"},
+				{Addr: "173.245.48.1", Source: "X-Forwarded-For", Trusted: true},
+				{Addr: "10.1.2.3", Source: "RemoteAddr", Trusted: true},
+			},
+		},
+		{
+			name:       "multiple X-Forwarded-For headers",
+			remoteAddr: "10.1.2.3:1234",
+			header:     http.Header{"X-Forwarded-For": {"5.6.7.8", "10.9.9.9"}},
+			want:       "5.6.7.8",
+			wantChain: []Hop{
+				{Addr: "5.6.7.8", Source: "X-Forwarded-For"},
+				{Addr: "10.9.9.9", Source: "X-Forwarded-For", Trusted: true},
+				{Addr: "10.1.2.3", Source: "RemoteAddr", Trusted: true},
+			},
+		},
+		{
+			// The load balancer only appends X-Forwarded-For, so the client's Forwarded is ignored.
+			name:       "forged forwarded",
+			remoteAddr: "10.1.2.3:1234",
+			header: http.Header{
+				"Forwarded":       {"for=1.2.3.4"},
+				"X-Forwarded-For": {"6.6.6.6, 5.6.7.8"},
+			},
+			want: "5.6.7.8",
+			wantChain: []Hop{
+				{Addr: "6.6.6.6", Source: "X-Forwarded-For"},
+				{Addr: "5.6.7.8", Source: "X-Forwarded-For"},
+				{Addr: "10.1.2.3", Source: "RemoteAddr", Trusted: true},
+			},
+		},
+		{
+			name:        "forged forwarded with proxy header",
+			proxyHeader: "x-forwarded-for",
+			remoteAddr:  "10.1.2.3:1234",
+			header: http.Header{
+				"Forwarded":       {"for=1.2.3.4, for=10.9.9.9"},
+				"X-Forwarded-For": {"5.6.7.8"},
+			},
+			want: "5.6.7.8",
+			wantChain: []Hop{
+				{Addr: "5.6.7.8", Source: "X-Forwarded-For"},
+				{Addr: "10.1.2.3", Source: "RemoteAddr", Trusted: true},
+			},
+		},
+		{
+			name:        "forged X-Forwarded-For with proxy header",
+			proxyHeader: "Forwarded",
+			remoteAddr:  "10.1.2.3:1234",
+			header: http.Header{
+				"Forwarded":       {`for="[2001:db8:cafe::17]:4711";proto=https, for=10.9.9.9`},
+				"X-Forwarded-For": {"6.6.6.6"},
+			},
+			want: "2001:db8:cafe::17",
+			wantChain: []Hop{
+				{Addr: "2001:db8:cafe::17", Source: "Forwarded"},
+				{Addr: "10.9.9.9", Source: "Forwarded", Trusted: true},
+				{Addr: "10.1.2.3", Source: "RemoteAddr", Trusted: true},
+			},
+		},
+		{
+			name:       "obfuscated forwarded",
+			remoteAddr: "10.1.2.3:1234",
+			header:     http.Header{"Forwarded": {"for=_hidden, for=10.9.9.9"}},
+			want:       "10.9.9.9",
+			wantChain: []Hop{
+				{Addr: "_hidden", Source: "Forwarded"},
+				{Addr: "10.9.9.9", Source: "Forwarded", Trusted: true},
+				{Addr: "10.1.2.3", Source: "RemoteAddr", Trusted: true},
+			},
+		},
+		{
+			name:       "cf-connecting-ip",
+			remoteAddr: "173.245.48.1:1234",
+			header:     http.Header{"Cf-Connecting-Ip": {"5.6.7.8"}},
+			want:       "5.6.7.8",
+			wantChain: []Hop{
+				{Addr: "5.6.7.8", Source: "Cf-Connecting-Ip"},
+				{Addr: "173.245.48.1", Source: "RemoteAddr", Trusted: true},
+			},
+		},
+	}
+
+	for _, test := range data {
+		// The load balancer is 10.0.0.0/8, and CloudFlare is 173.245.48.0/20.
+		s := NewServer(&conf.Config{
+			TrustedProxies: []string{"10.0.0.0/8", "173.245.48.0/20"},
+			ProxyHeader:    test.proxyHeader,
+		})
+
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for key, values := range test.header {
+			req.Header[key] = values
+		}
+
+		got, chain, err := s.remoteAddr(req)
+		if err != nil {
+			t.Errorf("%s: remoteAddr() err: %s, want nil", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: remoteAddr() = %q, want %q", test.name, got, test.want)
+		}
+		if diff := pretty.Compare(chain, test.wantChain); diff != "" {
+			t.Errorf("%s: remoteAddr() chain diff (-got +want)\n%s", test.name, diff)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitClients is the most clients a rateLimiter remembers.
+const maxRateLimitClients = 10000
+
+// rateLimiter limits the number of requests each client can make per minute.
+type rateLimiter struct {
+	perMinute int
+
+	mu      sync.Mutex
+	clients map[netip.Prefix]*rate.Limiter
+
+	// overflow is shared by new clients while clients is full of active ones.
+	overflow *rate.Limiter
+
+	now func() time.Time // for testing
+}
+
+// newRateLimiter returns a rateLimiter allowing perMinute requests per minute per client, or
+// nil if perMinute is negative (i.e. unlimited).
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute < 0 {
+		return nil
+	}
+	return &rateLimiter{
+		perMinute: perMinute,
+		clients:   make(map[netip.Prefix]*rate.Limiter),
+	}
+}
+
+func (r *rateLimiter) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// Allow returns true if the client at addr may make another request. If not, it also returns how
+// long until it can. A nil rateLimiter allows everything.
+func (r *rateLimiter) Allow(addr netip.Addr) (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+
+	now := r.timeNow()
+	key := clientPrefix(addr)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limiter, found := r.clients[key]
+	if !found {
+		if len(r.clients) >= maxRateLimitClients {
+			r.expire(now)
+		}
+		if len(r.clients) < maxRateLimitClients {
+			limiter = r.newLimiter()
+			r.clients[key] = limiter
+		} else {
+			// Forgetting an active client would reset its limit, so new ones share one instead,
+			// until some become idle.
+			if r.overflow == nil {
+				r.overflow = r.newLimiter()
+			}
+			limiter = r.overflow
+		}
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		// Only possible if the limit is zero.
+		return false, time.Minute
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// newLimiter returns a limiter allowing a minute's worth of requests at once, then refilling
+// evenly over the minute.
+func (r *rateLimiter) newLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(float64(r.perMinute)/time.Minute.Seconds()), r.perMinute)
+}
+
+// expire forgets clients that have been idle long enough to have a full bucket again, as they're
+// no different to a new client. Must be called with the lock held.
+func (r *rateLimiter) expire(now time.Time) {
+	for key, limiter := range r.clients {
+		if limiter.TokensAt(now) >= float64(r.perMinute) {
+			delete(r.clients, key)
+		}
+	}
+}
+
+// clientPrefix returns the network a client is limited by. IPv6 clients usually have a whole /64
+// to themselves, so are limited by that, rather than each address.
+func clientPrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	if addr.Is6() {
+		p, _ := addr.Prefix(64)
+		return p
+	}
+	return netip.PrefixFrom(addr, 32)
+}
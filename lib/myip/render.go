@@ -0,0 +1,274 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultFormat is used when the client doesn't ask for a particular format.
+const defaultFormat = "json"
+
+// Renderer writes a response in a particular format.
+type Renderer interface {
+	// ContentType returns the Content-Type of the rendered output.
+	ContentType() string
+
+	// Render writes v to w.
+	Render(w io.Writer, v interface{}) error
+}
+
+var (
+	renderersMu sync.RWMutex
+	renderers   = make(map[string]Renderer) // By format name
+	mediaTypes  = make(map[string]string)   // Media type to format name
+)
+
+func init() {
+	RegisterRenderer("json", jsonRenderer{}, "application/json")
+	RegisterRenderer("txt", textRenderer{}, "text/plain")
+	RegisterRenderer("yaml", yamlRenderer{}, "application/yaml", "application/x-yaml", "text/yaml")
+	RegisterRenderer("xml", xmlRenderer{}, "application/xml", "text/xml")
+}
+
+// RegisterRenderer makes a Renderer available as the format name, which can then be requested
+// with the /{name} path, the ?format={name} parameter, or by one of the media types in the
+// Accept header. Registering an existing name replaces it.
+func RegisterRenderer(name string, r Renderer, types ...string) {
+	renderersMu.Lock()
+	defer renderersMu.Unlock()
+
+	renderers[name] = r
+	for _, t := range types {
+		mediaTypes[t] = name
+	}
+}
+
+func rendererFor(name string) (Renderer, bool) {
+	renderersMu.RLock()
+	defer renderersMu.RUnlock()
+
+	r, found := renderers[name]
+	return r, found
+}
+
+func formatForMediaType(t string) (string, bool) {
+	renderersMu.RLock()
+	defer renderersMu.RUnlock()
+
+	name, found := mediaTypes[t]
+	return name, found
+}
+
+// negotiate returns the name of the format the client asked for, or "" if it didn't express a
+// preference. In order, it looks at the path suffix (e.g. /json), the ?format= parameter, the
+// Accept header, and finally if the client is a CLI tool, which gets text.
+func negotiate(req *http.Request) string {
+	if name := mux.Vars(req)["format"]; name != "" {
+		return name
+	}
+	if name := req.URL.Query().Get("format"); name != "" {
+		return name
+	}
+	if name := acceptFormat(req.Header.Get("Accept")); name != "" {
+		return name
+	}
+	if isCLI(req) {
+		return "txt"
+	}
+	return ""
+}
+
+// acceptFormat returns the format most preferred by the Accept header, or "" if the client
+// prefers HTML (or anything at all) at least as much, as browsers do.
+func acceptFormat(accept string) string {
+	best, bestQ := "", 0.0
+	htmlQ := 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if s, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		switch mediaType {
+		case "text/html", "application/xhtml+xml", "text/*", "*/*":
+			htmlQ = max(htmlQ, q)
+			continue
+		}
+
+		if name, found := formatForMediaType(mediaType); found && q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+
+	if best == "" || htmlQ >= bestQ {
+		return ""
+	}
+	return best
+}
+
+// isFormat matches requests for /{format} where format is a registered renderer.
+func isFormat(req *http.Request, _ *mux.RouteMatch) bool {
+	// The route's vars aren't set until all its matchers pass, so use the path.
+	_, found := rendererFor(strings.TrimPrefix(req.URL.Path, "/"))
+	return found
+}
+
+// isNegotiated matches requests that asked for a particular format.
+func isNegotiated(req *http.Request, _ *mux.RouteMatch) bool {
+	return negotiate(req) != ""
+}
+
+// ResponseHandler does the lookups and returns the results in the format the client asked for.
+func (s *DefaultServer) ResponseHandler(w http.ResponseWriter, req *http.Request) {
+	response, err := s.MyIPHandler(req)
+	if err != nil {
+		s.respond(w, req, http.StatusInternalServerError, &ErrResponse{err.Error()})
+		return
+	}
+
+	s.respond(w, req, http.StatusOK, addInsights(req, response))
+}
+
+// respond writes v with the status code, in the format the client asked for (defaulting to JSON).
+func (s *DefaultServer) respond(w http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	s.respondWithDefault(w, req, defaultFormat, status, v)
+}
+
+// respondWithDefault is respond, but with def used if the client didn't ask for a format.
+func (s *DefaultServer) respondWithDefault(w http.ResponseWriter, req *http.Request, def string, status int, v interface{}) {
+	name := negotiate(req)
+	if name == "" {
+		name = def
+	}
+
+	r, found := rendererFor(name)
+	if !found {
+		status, v = http.StatusNotAcceptable, &ErrResponse{fmt.Sprintf("unknown format %q", name)}
+		r, _ = rendererFor(defaultFormat)
+	}
+
+	// Render to a buffer first, so an error can still be reported with the right status.
+	var buf bytes.Buffer
+	if err := r.Render(&buf, v); err != nil {
+		log.Warningf("rendering %T as %q failed: %s", v, name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", r.ContentType())
+	// The format depends on these headers, so caches must keep them apart.
+	h.Add("Vary", "Accept")
+	h.Add("Vary", "User-Agent")
+	s.allowOrigin(w, req)
+
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// allowOrigin lets the request's Origin read the response, if it's one of the allowed origins.
+func (s *DefaultServer) allowOrigin(w http.ResponseWriter, req *http.Request) {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if s.Config.MatchOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+	}
+}
+
+// field is a single member of an object.
+type field struct {
+	Key   string
+	Value interface{}
+}
+
+// object is a JSON object that keeps the order of its members.
+type object []field
+
+// toOrdered converts v to the generic values (object, []interface{}, string, json.Number, bool,
+// and nil) of its JSON encoding, keeping the order of struct fields. This lets the other formats
+// honour the json tags, and omit empty fields, the same as the JSON output.
+func toOrdered(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case json.Delim('{'):
+		obj := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, field{key.(string), value})
+		}
+		_, err := dec.Token() // }
+		return obj, err
+
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err := dec.Token() // ]
+		return arr, err
+	}
+
+	return t, nil
+}
@@ -0,0 +1,219 @@
+package myip
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/dns"
+	"github.com/gorilla/mux"
+)
+
+func TestAcceptFormat(t *testing.T) {
+	data := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: ""},
+		{accept: "*/*", want: ""},
+		{accept: "application/json", want: "json"},
+		{accept: "application/json; charset=utf-8", want: "json"},
+		{accept: "text/plain", want: "txt"},
+		{accept: "application/x-yaml", want: "yaml"},
+		{accept: "text/xml", want: "xml"},
+		{accept: "application/json, */*;q=0.8", want: "json"},
+		{accept: "application/json;q=0.5, application/yaml", want: "yaml"},
+		{accept: "application/json;q=0, text/plain;q=0.1", want: "txt"},
+		{accept: "image/png", want: ""},
+
+		// Browsers
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: ""},
+		{accept: "application/json, text/html", want: ""},
+	}
+
+	for _, test := range data {
+		if got := acceptFormat(test.accept); got != test.want {
+			t.Errorf("acceptFormat(%q) = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	data := []struct {
+		url    string
+		vars   map[string]string
+		ua     string
+		accept string
+		want   string
+	}{
+		{url: "/", ua: "Mozilla/5.0 (X11; Linux x86_64) Chrome/120.0", accept: "text/html,*/*;q=0.8", want: ""},
+		{url: "/", ua: "curl/8.0", accept: "*/*", want: "txt"},
+		{url: "/", ua: "Wget/1.21", want: "txt"},
+		{url: "/", ua: "HTTPie/3.2.2", accept: "application/json, */*;q=0.5", want: "json"},
+		{url: "/", ua: "HTTPie/3.2.2", accept: "*/*", want: "txt"},
+		{url: "/", ua: "Mozilla/5.0 (Windows NT; Windows NT 10.0; en-US) WindowsPowerShell/5.1.19041.1", want: "txt"},
+		{url: "/", ua: "Mozilla/5.0 (Windows NT 10.0; Microsoft Windows 10.0.19045; en-US) PowerShell/7.4.0", want: "txt"},
+		{url: "/", ua: "aria2/1.36.0", want: "txt"},
+		{url: "/", ua: "fetch libfetch/2.0", want: "txt"},
+		{url: "/", accept: "application/yaml", want: "yaml"},
+		{url: "/?format=xml", ua: "curl/8.0", accept: "application/json", want: "xml"},
+		{url: "/json?format=xml", vars: map[string]string{"format": "json"}, ua: "curl/8.0", want: "json"},
+	}
+
+	for _, test := range data {
+		req := httptest.NewRequest("GET", "http://localhost"+test.url, nil)
+		req.Header.Set("User-Agent", test.ua)
+		req.Header.Set("Accept", test.accept)
+		if test.vars != nil {
+			req = mux.SetURLVars(req, test.vars)
+		}
+
+		if got := negotiate(req); got != test.want {
+			t.Errorf("negotiate(%q, UA %q, Accept %q) = %q, want %q", test.url, test.ua, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestIsFormat(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/json":       true,
+		"/txt":        true,
+		"/yaml":       true,
+		"/xml":        true,
+		"/":           false,
+		"/index.html": false,
+		"/json/":      false,
+	} {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		if got := isFormat(req, &mux.RouteMatch{}); got != want {
+			t.Errorf("isFormat(%q) = %t, want %t", path, got, want)
+		}
+	}
+}
+
+func TestRenderers(t *testing.T) {
+	resp := &ResolverResponse{
+		Nonce: "0123456789abcdef",
+		Resolvers: []*Resolver{
+			{Addr: "192.0.2.53", Reverse: &dns.Response{Query: "192.0.2.53", Names: []string{"a.example.", "b.example."}}, Org: "Example & Co"},
+			{Addr: "2001:db8::53"},
+		},
+	}
+
+	data := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: "json",
+			want:   `{"Nonce":"0123456789abcdef","Resolvers":[{"Addr":"192.0.2.53","Reverse":{"Query":"192.0.2.53","Names":["a.example.","b.example."]},"Org":"Example \u0026 Co"},{"Addr":"2001:db8::53"}]}` + "\n",
+		},
+		{
+			format: "txt",
+			want: "Resolver: 192.0.2.53 a.example. b.example. (Example & Co)\n" +
+				"Resolver: 2001:db8::53\n",
+		},
+		{
+			format: "yaml",
+			want: "Nonce: 0123456789abcdef\n" +
+				"Resolvers:\n" +
+				"  - Addr: 192.0.2.53\n" +
+				"    Reverse:\n" +
+				"      Query: 192.0.2.53\n" +
+				"      Names:\n" +
+				"        - a.example.\n" +
+				"        - b.example.\n" +
+				"    Org: Example & Co\n" +
+				"  - Addr: 2001:db8::53\n",
+		},
+		{
+			format: "xml",
+			want: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				"<ResolverResponse>\n" +
+				"  <Nonce>0123456789abcdef</Nonce>\n" +
+				"  <Resolvers>\n" +
+				"    <Addr>192.0.2.53</Addr>\n" +
+				"    <Reverse>\n" +
+				"      <Query>192.0.2.53</Query>\n" +
+				"      <Names>a.example.</Names>\n" +
+				"      <Names>b.example.</Names>\n" +
+				"    </Reverse>\n" +
+				"    <Org>Example &amp; Co</Org>\n" +
+				"  </Resolvers>\n" +
+				"  <Resolvers>\n" +
+				"    <Addr>2001:db8::53</Addr>\n" +
+				"  </Resolvers>\n" +
+				"</ResolverResponse>\n",
+		},
+	}
+
+	for _, test := range data {
+		r, found := rendererFor(test.format)
+		if !found {
+			t.Errorf("rendererFor(%q) not found", test.format)
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := r.Render(&buf, resp); err != nil {
+			t.Errorf("%s: Render() err: %s", test.format, err)
+			continue
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s: Render() =\n%s\nwant:\n%s", test.format, got, test.want)
+		}
+	}
+}
+
+func TestRenderFullResponse(t *testing.T) {
+	// Every format must cope with maps, multi-line strings, and header names.
+	for _, format := range []string{"json", "txt", "yaml", "xml"} {
+		r, _ := rendererFor(format)
+
+		var buf bytes.Buffer
+		if err := r.Render(&buf, fullResponse()); err != nil {
+			t.Errorf("%s: Render(fullResponse()) err: %s", format, err)
+			continue
+		}
+		if !strings.Contains(buf.String(), "198.212.195.91") {
+			t.Errorf("%s: Render(fullResponse()) missing the IP:\n%s", format, buf.String())
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	data := []struct {
+		url         string
+		accept      string
+		want        int
+		contentType string
+		wantBody    string
+	}{
+		{url: "/resolver/x", want: http.StatusOK, contentType: "application/json", wantBody: `"Nonce":"x"`},
+		{url: "/resolver/x?format=yaml", want: http.StatusOK, contentType: "application/yaml", wantBody: "Nonce: x\n"},
+		{url: "/resolver/x", accept: "text/plain", want: http.StatusOK, contentType: "text/plain; charset=utf-8", wantBody: "No resolvers have looked up x yet."},
+		{url: "/resolver/x?format=bogus", want: http.StatusNotAcceptable, contentType: "application/json", wantBody: `unknown format \"bogus\"`},
+	}
+
+	s := NewServer(&conf.Config{})
+	for _, test := range data {
+		req := httptest.NewRequest("GET", "http://localhost"+test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+
+		s.respond(w, req, http.StatusOK, &ResolverResponse{Nonce: "x"})
+
+		if w.Code != test.want {
+			t.Errorf("respond(%q, %q) status = %d, want %d", test.url, test.accept, w.Code, test.want)
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("respond(%q, %q) Content-Type = %q, want %q", test.url, test.accept, got, test.contentType)
+		}
+		if body := w.Body.String(); !strings.Contains(body, test.wantBody) {
+			t.Errorf("respond(%q, %q) body = %q, want it to contain %q", test.url, test.accept, body, test.wantBody)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"bramp.net/myip/lib/dns"
+	"bramp.net/myip/lib/rdap"
+	"github.com/gorilla/mux"
+)
+
+// ResolverResponse lists the recursive resolvers that looked up a leak test name.
+type ResolverResponse struct {
+	Nonce     string
+	Resolvers []*Resolver
+}
+
+// Resolver is a single recursive resolver, and who owns it.
+type Resolver struct {
+	Addr    string
+	Reverse *dns.Response `json:",omitempty"`
+
+	// Org is the name of the organisation the resolver's network is registered to.
+	Org     string `json:",omitempty"`
+	Country string `json:",omitempty"`
+}
+
+// ResolverHandler returns the resolvers that looked up the leak test name <nonce>.leak.<zone>.
+// The web-app looks up that name, and then asks us which resolvers it went through.
+func (s *DefaultServer) ResolverHandler(w http.ResponseWriter, req *http.Request) {
+	if s.Resolvers == nil {
+		s.respond(w, req, http.StatusNotFound, &ErrResponse{"resolver leak test is not enabled"})
+		return
+	}
+
+	nonce := mux.Vars(req)["nonce"]
+	if !dns.ValidNonce(nonce) {
+		s.respond(w, req, http.StatusBadRequest, &ErrResponse{"invalid nonce"})
+		return
+	}
+
+	// Annotating resolvers that aren't cached counts against the client's lookup rate limit, as
+	// anyone can make up resolvers for their nonce.
+	var client netip.Addr
+	if host, _, err := s.remoteAddr(req); err == nil {
+		client, _ = netip.ParseAddr(host)
+	}
+
+	ctx := req.Context()
+	wg := &sync.WaitGroup{}
+
+	resp := &ResolverResponse{
+		Nonce:     nonce,
+		Resolvers: []*Resolver{},
+	}
+	for _, addr := range s.Resolvers.Get(nonce) {
+		resolver := &Resolver{Addr: addr.String()}
+		resp.Resolvers = append(resp.Resolvers, resolver)
+
+		addToWg(wg, func() {
+			resolver.Reverse = lookupReverse(ctx, resolver.Addr)
+		})
+		addToWg(wg, func() {
+			if r := s.resolverRDAP(ctx, client, resolver.Addr); r != nil && r.Error == "" {
+				resolver.Org = r.Org()
+				resolver.Country = r.Country
+			}
+		})
+	}
+	wg.Wait()
+
+	// The answer changes as more resolvers ask, so it must not be cached.
+	w.Header().Set("Cache-Control", "no-store")
+	s.respond(w, req, http.StatusOK, resp)
+}
+
+// resolverRDAP returns the RDAP response for the resolver at addr, from the cache if possible.
+// Otherwise it's looked up, and cached, if the client is within its lookup rate limit, or nil is
+// returned.
+func (s *DefaultServer) resolverRDAP(ctx context.Context, client netip.Addr, addr string) *rdap.Response {
+	cached := &LookupResponse{Query: addr}
+	if cached.fromCache(ctx, s.Cache) {
+		return cached.RDAP
+	}
+
+	if client.IsValid() {
+		if ok, _ := s.lookupLimiter.Allow(client); !ok {
+			return nil
+		}
+	}
+	return Lookup(ctx, addr, LookupOptions{NoReverse: true, Timeouts: s.timeouts, Cache: s.Cache}).RDAP
+}
+
+// DNSLookup looks up the resolver asking the DNS server, returning its reverse DNS names and RDAP
+// response, to annotate its TXT answer. The queries are UDP, so can come from spoofed addresses,
+// and must not be able to flood the registries. So the results are cached, and asking the
+// registries counts against the resolver's lookup rate limit. Over it, only the names are returned.
+func (s *DefaultServer) DNSLookup(ctx context.Context, resolver netip.Addr) ([]string, *rdap.Response) {
+	resp := Lookup(ctx, resolver.String(), LookupOptions{
+		Timeouts: s.timeouts,
+		Cache:    s.Cache,
+		Allow: func() bool {
+			ok, _ := s.lookupLimiter.Allow(resolver)
+			return ok
+		},
+	})
+
+	var names []string
+	if resp.Reverse != nil {
+		names = resp.Reverse.Names
+	}
+	if resp.RDAP != nil && resp.RDAP.Error != "" {
+		return names, nil
+	}
+	return names, resp.RDAP
+}
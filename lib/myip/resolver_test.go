@@ -0,0 +1,120 @@
+package myip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/dns"
+	"github.com/gorilla/mux"
+)
+
+func TestResolverHandler(t *testing.T) {
+	data := []struct {
+		name      string
+		resolvers *dns.ResolverLog
+		nonce     string
+		want      int
+		wantBody  string
+	}{
+		{
+			name:     "disabled",
+			nonce:    "0123456789abcdef",
+			want:     http.StatusNotFound,
+			wantBody: "not enabled",
+		},
+		{
+			name:      "invalid nonce",
+			resolvers: &dns.ResolverLog{},
+			nonce:     "short",
+			want:      http.StatusBadRequest,
+			wantBody:  "invalid nonce",
+		},
+		{
+			name:      "no resolvers yet",
+			resolvers: &dns.ResolverLog{},
+			nonce:     "0123456789abcdef",
+			want:      http.StatusOK,
+			wantBody:  `{"Nonce":"0123456789abcdef","Resolvers":[]}`,
+		},
+	}
+
+	for _, test := range data {
+		s := NewServer(&conf.Config{})
+		s.Resolvers = test.resolvers
+
+		req := httptest.NewRequest("GET", "http://localhost/resolver/"+test.nonce, nil)
+		req = mux.SetURLVars(req, map[string]string{"nonce": test.nonce})
+		w := httptest.NewRecorder()
+
+		s.ResolverHandler(w, req)
+
+		if w.Code != test.want {
+			t.Errorf("%s: ResolverHandler() status = %d, want %d", test.name, w.Code, test.want)
+		}
+		if body := w.Body.String(); !strings.Contains(body, test.wantBody) {
+			t.Errorf("%s: ResolverHandler() body = %q, want it to contain %q", test.name, body, test.wantBody)
+		}
+	}
+}
+
+func TestResolverHandlerLimits(t *testing.T) {
+	rdapCalls := fakeLookups(t)
+	s := NewServer(&conf.Config{LookupRateLimit: 1})
+	s.Resolvers = &dns.ResolverLog{}
+
+	// The first resolver's network is already cached.
+	Lookup(context.Background(), "192.0.2.1", LookupOptions{NoReverse: true, Cache: s.Cache})
+
+	nonce := "0123456789abcdef"
+	for _, r := range []string{"192.0.2.53", "198.51.100.53", "203.0.113.53"} {
+		s.Resolvers.Add(nonce, netip.MustParseAddr(r))
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/resolver/"+nonce, nil)
+	req = mux.SetURLVars(req, map[string]string{"nonce": nonce})
+	w := httptest.NewRecorder()
+
+	s.ResolverHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("ResolverHandler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); strings.Count(body, `"Addr"`) != 3 {
+		t.Errorf("ResolverHandler() body = %q, want three resolvers", body)
+	}
+
+	// One to fill the cache, and one for the only other resolver within the limit.
+	if *rdapCalls != 2 {
+		t.Errorf("ResolverHandler() made %d RDAP queries, want 2", *rdapCalls)
+	}
+}
+
+func TestDNSLookup(t *testing.T) {
+	rdapCalls := fakeLookups(t)
+	resolver := netip.MustParseAddr("192.0.2.53")
+
+	// Only the first asks the registries, the rest are cached.
+	s := NewServer(&conf.Config{LookupRateLimit: 1})
+	for i := 0; i < 3; i++ {
+		if _, r := s.DNSLookup(context.Background(), resolver); r == nil || r.Name != "NET-192.0.2" {
+			t.Errorf("DNSLookup(%s) request %d RDAP = %v, want NET-192.0.2", resolver, i, r)
+		}
+	}
+	if *rdapCalls != 1 {
+		t.Errorf("DNSLookup() made %d RDAP queries, want 1", *rdapCalls)
+	}
+
+	// Over the limit, the registries aren't asked.
+	s.lookupLimiter = newRateLimiter(0)
+	if _, r := s.DNSLookup(context.Background(), netip.MustParseAddr("198.51.100.53")); r != nil {
+		t.Errorf("DNSLookup() over the limit RDAP = %v, want nil", r)
+	}
+	if *rdapCalls != 1 {
+		t.Errorf("DNSLookup() over the limit made %d RDAP queries, want 1", *rdapCalls)
+	}
+}
@@ -3,9 +3,16 @@ package myip
 import (
 	"net"
 	"net/http"
+	"net/netip"
+	"time"
 
+	"bramp.net/myip/lib/bgp"
+	"bramp.net/myip/lib/cache"
 	"bramp.net/myip/lib/conf"
+	"bramp.net/myip/lib/dns"
+	"bramp.net/myip/lib/stun"
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"github.com/unrolled/secure"
 )
 
@@ -15,20 +22,115 @@ type Server interface {
 
 	MyIPHandler(req *http.Request) (*Response, error)
 
-	// TODO Merge CLI and JSON together, and use a different marshallers.
-	// CLI index page
-	CLIHandler(w http.ResponseWriter, req *http.Request)
+	// Just the client's address, without any lookups
+	IPHandler(w http.ResponseWriter, req *http.Request)
 
-	// JSON index page
-	JSONHandler(w http.ResponseWriter, req *http.Request)
+	// Index page, in the format the client asked for (e.g. JSON, or text for CLI tools)
+	ResponseHandler(w http.ResponseWriter, req *http.Request)
+
+	// Index page streamed as Server-Sent Events, as each lookup finishes
+	EventsHandler(w http.ResponseWriter, req *http.Request)
+
+	// Lookup of any address or network
+	LookupHandler(w http.ResponseWriter, req *http.Request)
+
+	// Just the abuse contact of any address or network
+	AbuseHandler(w http.ResponseWriter, req *http.Request)
+
+	// Lookup of many addresses or networks at once
+	BulkLookupHandler(w http.ResponseWriter, req *http.Request)
 
 	// Web-app config
 	ConfigJSHandler(w http.ResponseWriter, _ *http.Request)
+
+	// Resolver leak test results
+	ResolverHandler(w http.ResponseWriter, req *http.Request)
+
+	// NAT behaviour, from the STUN server
+	NATHandler(w http.ResponseWriter, req *http.Request)
 }
 
 // DefaultServer is a default implementation of Server with some good defaults.
 type DefaultServer struct {
 	Config *conf.Config
+
+	// Resolvers is the log of resolvers that looked up leak test names, filled in by the DNS
+	// server. The resolver leak test is disabled if nil.
+	Resolvers *dns.ResolverLog
+
+	// STUN is the STUN server, used to classify the client's NAT. The /nat endpoint is disabled
+	// if nil.
+	STUN *stun.Server
+
+	// Cache stores RDAP and WHOIS results by network. Lookups aren't cached if nil.
+	Cache *cache.RangeCache
+
+	// Origins maps addresses to the prefix and AS announcing them, reloading the table when its
+	// file changes, once Origins.Run is called. The origin AS isn't shown if nil.
+	Origins *bgp.Source
+
+	// trustedProxies is the parsed Config.TrustedProxies.
+	trustedProxies []netip.Prefix
+
+	// proxyHeader is the canonical Config.ProxyHeader.
+	proxyHeader string
+
+	// lookupLimiter limits the /lookup/ requests per client.
+	lookupLimiter *rateLimiter
+
+	// timeouts are the lookup deadlines from the Config.
+	timeouts Timeouts
+}
+
+// NewServer returns a new DefaultServer for this config.
+func NewServer(config *conf.Config) *DefaultServer {
+	trustedProxies, err := conf.ParsePrefixes(config.TrustedProxies)
+	if err != nil {
+		// The config should have been validated, so just log it and trust nothing.
+		log.Errorf("invalid TrustedProxies: %s", err)
+	}
+
+	lookupRateLimit := config.LookupRateLimit
+	if lookupRateLimit == 0 {
+		lookupRateLimit = conf.DefaultLookupRateLimit
+	}
+
+	s := &DefaultServer{
+		Config:         config,
+		trustedProxies: trustedProxies,
+		proxyHeader:    http.CanonicalHeaderKey(config.ProxyHeader),
+		lookupLimiter:  newRateLimiter(lookupRateLimit),
+		timeouts: Timeouts{
+			Total:   time.Duration(config.LookupTimeout),
+			Reverse: time.Duration(config.ReverseTimeout),
+			RDAP:    time.Duration(config.RDAPTimeout),
+			Whois:   time.Duration(config.WhoisTimeout),
+		},
+	}
+	if s.timeouts.Total == 0 {
+		s.timeouts.Total = time.Duration(conf.DefaultLookupTimeout)
+	}
+
+	if config.CacheSize >= 0 {
+		size, ttl := config.CacheSize, config.CacheTTL
+		if size == 0 {
+			size = conf.DefaultCacheSize
+		}
+		if ttl == 0 {
+			ttl = conf.DefaultCacheTTL
+		}
+		s.Cache = cache.New(cache.NewLRU(size), time.Duration(ttl))
+	}
+
+	if config.PrefixToASFile != "" {
+		// If it fails, it's tried again once the file changes.
+		s.Origins = bgp.NewSource(config.PrefixToASFile)
+		if err := s.Origins.Load(); err != nil {
+			log.Errorf("failed to load prefix_to_as_file: %s", err)
+		}
+	}
+
+	return s
 }
 
 // URLHeaders sets both the scheme and host in the Request.URL
@@ -69,11 +171,14 @@ func DebugHeaders(config *conf.Config) func(http.Handler) http.Handler {
 	}
 }
 
+// Register a new DefaultServer for this config. Should only be called once.
+func Register(r *mux.Router, config *conf.Config) {
+	NewServer(config).Register(r)
+}
+
 // Register this myip.Server. Should only be called once.
-func Register(r *mux.Router, config *conf.Config) { // TODO Refactor so we don't need config here
-	app := &DefaultServer{
-		Config: config,
-	}
+func (s *DefaultServer) Register(r *mux.Router) {
+	config := s.Config
 
 	// TODO Find CSP generator to make the next line shorter, and less error prone
 	csp := "default-src 'self';" +
@@ -103,11 +208,21 @@ func Register(r *mux.Router, config *conf.Config) { // TODO Refactor so we don't
 	r.Use(DebugHeaders(config))
 	r.Use(secure.New(secureConfig).Handler)
 
-	// Fetching with `curl`
-	r.MatcherFunc(isCLI).HandlerFunc(app.CLIHandler)
+	r.HandleFunc("/config.js", s.ConfigJSHandler)
+	r.HandleFunc("/ip{family:[46]?}", s.IPHandler)
+	r.HandleFunc("/ip{family:[46]?}.{format}", s.IPHandler)
+	r.HandleFunc("/events", s.EventsHandler)
+	r.HandleFunc("/lookup", s.BulkLookupHandler).Methods("POST")
+	r.HandleFunc("/lookup/{query:.+}", s.LookupHandler)
+	r.HandleFunc("/abuse/{query:.+}", s.AbuseHandler)
+	r.HandleFunc("/resolver/{nonce}", s.ResolverHandler)
+	r.HandleFunc("/nat", s.NATHandler)
+
+	// /json, /txt, etc
+	r.Path("/{format}").MatcherFunc(isFormat).HandlerFunc(s.ResponseHandler)
 
-	r.HandleFunc("/json", app.JSONHandler)
-	r.HandleFunc("/config.js", app.ConfigJSHandler)
+	// Fetching with `curl`, or asking for a format with ?format= or the Accept header
+	r.MatcherFunc(isNegotiated).HandlerFunc(s.ResponseHandler)
 
 	// Serve the static content
 	fs := http.FileServer(http.Dir("./static/"))
@@ -116,9 +231,16 @@ func Register(r *mux.Router, config *conf.Config) { // TODO Refactor so we don't
 
 // GetRemoteAddr returns the remote address, either the real one, or if in debug mode one passed as a query param.
 func (s *DefaultServer) GetRemoteAddr(req *http.Request) (string, error) {
+	host, _, err := s.remoteAddr(req)
+	return host, err
+}
+
+// remoteAddr returns the remote address, and the chain of hops the request passed through (if any
+// proxy headers were present). Proxy headers are only believed if sent by a trusted proxy.
+func (s *DefaultServer) remoteAddr(req *http.Request) (string, []Hop, error) {
 	// If debug allow replacing the host
 	if host := req.URL.Query().Get("host"); host != "" && s.Config.Debug {
-		return host, nil
+		return host, nil, nil
 	}
 
 	// Some systems (namely App Engine Flex) encode the remoteAddr with a port
@@ -126,8 +248,16 @@ func (s *DefaultServer) GetRemoteAddr(req *http.Request) (string, error) {
 	if err != nil {
 		// For now assume the RemoteAddr was just a addr (with no port)
 		// TODO check if remoteAddr is a valid IPv6/IPv4 address
-		return req.RemoteAddr, nil
+		host = req.RemoteAddr
 	}
 
-	return host, err
+	hops := proxyHops(req, s.proxyHeader)
+	if len(hops) == 0 {
+		return host, nil, nil
+	}
+
+	chain := append(hops, Hop{Addr: host, Source: "RemoteAddr"})
+	client := resolveProxyChain(chain, s.trustedProxies)
+
+	return chain[client].Addr, chain, nil
 }
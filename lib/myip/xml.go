@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package myip
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// xmlRenderer renders responses as XML, with the same field names as the JSON. encoding/xml can't
+// marshal maps (such as Response.Header), so the JSON encoding is converted instead.
+//
+// Each field becomes an element, and arrays repeat the element, as encoding/xml does. Keys that
+// aren't valid element names (and nested arrays) use <item key="..."> instead.
+type xmlRenderer struct{}
+
+func (xmlRenderer) ContentType() string {
+	return "application/xml; charset=utf-8"
+}
+
+func (xmlRenderer) Render(w io.Writer, v interface{}) error {
+	ordered, err := toOrdered(v)
+	if err != nil {
+		return err
+	}
+
+	name := "Response"
+	if t := reflect.TypeOf(v); t != nil {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Name() != "" {
+			name = t.Name()
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := encodeXML(enc, xmlStart(name), ordered); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// xmlStart returns the start element for the key.
+func xmlStart(key string) xml.StartElement {
+	if validXMLName(key) {
+		return xml.StartElement{Name: xml.Name{Local: key}}
+	}
+	return xml.StartElement{
+		Name: xml.Name{Local: "item"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+	}
+}
+
+// encodeXML writes the output of toOrdered as the element start.
+func encodeXML(enc *xml.Encoder, start xml.StartElement, v interface{}) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case object:
+		for _, f := range v {
+			if err := encodeXMLField(enc, xmlStart(f.Key), f.Value); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		// Only reached for arrays of arrays.
+		for _, e := range v {
+			if err := encodeXML(enc, xml.StartElement{Name: xml.Name{Local: "item"}}, e); err != nil {
+				return err
+			}
+		}
+
+	case string:
+		if err := enc.EncodeToken(xml.CharData(v)); err != nil {
+			return err
+		}
+
+	case json.Number:
+		if err := enc.EncodeToken(xml.CharData(v)); err != nil {
+			return err
+		}
+
+	case bool:
+		if err := enc.EncodeToken(xml.CharData(strconv.FormatBool(v))); err != nil {
+			return err
+		}
+
+	case nil:
+		// Empty element
+
+	default:
+		return fmt.Errorf("unexpected type %T", v)
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// encodeXMLField writes a field, repeating the element for each value if it's an array.
+func encodeXMLField(enc *xml.Encoder, start xml.StartElement, v interface{}) error {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return encodeXML(enc, start, v)
+	}
+
+	for _, e := range arr {
+		if err := encodeXML(enc, start, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validXMLName returns true if s can be used as an element name. It's stricter than the XML spec,
+// only allowing ASCII, and no colons (which would be a namespace).
+func validXMLName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	// Names starting with "xml" are reserved.
+	return len(s) < 3 || !(s[0]|0x20 == 'x' && s[1]|0x20 == 'm' && s[2]|0x20 == 'l')
+}
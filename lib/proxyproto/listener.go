@@ -0,0 +1,168 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long to wait for the PROXY header, if Listener.Timeout is not set.
+const DefaultTimeout = 10 * time.Second
+
+// Listener wraps a net.Listener, decoding the PROXY header sent by trusted upstream proxies.
+//
+// Connections from Upstreams must start with a PROXY header, and the returned net.Conn's
+// RemoteAddr and LocalAddr are replaced with the addresses it contains. Connections from any
+// other address are passed through untouched.
+type Listener struct {
+	net.Listener
+
+	// Upstreams are the networks allowed to send a PROXY header.
+	Upstreams []netip.Prefix
+
+	// Timeout is how long to wait for the header to arrive.
+	Timeout time.Duration
+}
+
+// Accept waits for and returns the next connection. The PROXY header is read lazily, on the
+// first call to Read, RemoteAddr or LocalAddr, so a slow client does not block Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isUpstream(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &Conn{
+		Conn:    c,
+		r:       bufio.NewReader(c),
+		timeout: timeout,
+	}, nil
+}
+
+func (l *Listener) isUpstream(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, prefix := range l.Upstreams {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted upstream, that started with a PROXY header.
+type Conn struct {
+	net.Conn
+
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// readHeader reads the header, if it hasn't already been read.
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = Read(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			// Without a valid header, we can't trust anything on this connection.
+			c.Conn.Close()
+		}
+	})
+}
+
+// Header returns the connection's PROXY header, reading it if necessary.
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+// Read reads data from the connection, after the PROXY header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client's address from the PROXY header, or the proxy's address if
+// the header did not contain one.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && !c.header.Local && c.header.Source.IsValid() {
+		return net.TCPAddrFromAddrPort(c.header.Source)
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, from the PROXY header, or our address
+// if the header did not contain one.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && !c.header.Local && c.header.Destination.IsValid() {
+		return net.TCPAddrFromAddrPort(c.header.Destination)
+	}
+	return c.Conn.LocalAddr()
+}
+
+type contextKey struct{}
+
+// ConnContext stores the connection in the context, so its PROXY header can later be retrieved
+// with FromContext. It is designed to be used as a http.Server's ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*Conn); ok {
+		// Don't read the header here, as this is called from the http.Server's accept loop.
+		return context.WithValue(ctx, contextKey{}, pc)
+	}
+	return ctx
+}
+
+// FromContext returns the PROXY header of the connection stored by ConnContext, or nil.
+func FromContext(ctx context.Context) *Header {
+	pc, ok := ctx.Value(contextKey{}).(*Conn)
+	if !ok {
+		return nil
+	}
+	h, _ := pc.Header()
+	return h
+}
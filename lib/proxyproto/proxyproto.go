@@ -0,0 +1,395 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyproto decodes the HAProxy PROXY protocol (v1 and v2), which TCP load balancers
+// use to pass on the real client's address.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	// v1Prefix starts every version 1 (text) header.
+	v1Prefix = []byte("PROXY ")
+
+	// v2Signature starts every version 2 (binary) header.
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrNoHeader is returned when the connection did not start with a PROXY header.
+	ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+	// ErrInvalidHeader is returned when the PROXY header is malformed.
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
+
+const (
+	// v1MaxLen is the maximum length of a version 1 header, including the CRLF.
+	v1MaxLen = 107
+
+	// The version 2 TLV types.
+	tlvALPN      = 0x01
+	tlvAuthority = 0x02
+	tlvCRC32C    = 0x03
+	tlvNoop      = 0x04
+	tlvUniqueID  = 0x05
+	tlvSSL       = 0x20
+	tlvNetNS     = 0x30
+
+	// The SSL sub-TLV types.
+	tlvSSLVersion = 0x21
+	tlvSSLCN      = 0x22
+	tlvSSLCipher  = 0x23
+	tlvSSLSigAlg  = 0x24
+	tlvSSLKeyAlg  = 0x25
+
+	// tlvAWS is the AWS specific TLV, whose first byte is the subtype.
+	tlvAWS              = 0xEA
+	tlvAWSVPCEndpointID = 0x01
+
+	// The SSL client bit field.
+	sslClientSSL      = 0x01
+	sslClientCertConn = 0x02
+	sslClientCertSess = 0x04
+)
+
+// Header is a decoded PROXY protocol header.
+type Header struct {
+	Version int
+
+	// Local is true if the connection was made by the proxy itself (e.g. a health check), in
+	// which case the addresses should be ignored.
+	Local bool `json:",omitempty"`
+
+	// Transport is one of "TCP4", "TCP6", "UDP4", "UDP6", "UNIX", or "UNKNOWN".
+	Transport string
+
+	// Source is the client's address, and Destination is the address the client connected to.
+	// They are invalid if the addresses were not given (e.g. UNKNOWN or UNIX).
+	Source      netip.AddrPort `json:",omitempty"`
+	Destination netip.AddrPort `json:",omitempty"`
+
+	// The following are decoded from the TLVs sent with version 2 headers.
+	ALPN             string `json:",omitempty"`
+	Authority        string `json:",omitempty"`
+	UniqueID         []byte `json:",omitempty"`
+	NetNS            string `json:",omitempty"`
+	AWSVPCEndpointID string `json:",omitempty"`
+	SSL              *SSL   `json:",omitempty"`
+
+	// TLVs contains every TLV sent, including ones decoded above.
+	TLVs []TLV `json:"-"`
+}
+
+// SSL contains the details of the client's TLS connection to the proxy.
+type SSL struct {
+	// TLS is true if the client connected over TLS.
+	TLS bool
+
+	// ClientCert is true if the client presented a certificate, and Verified is true if it
+	// was successfully verified.
+	ClientCert bool `json:",omitempty"`
+	Verified   bool `json:",omitempty"`
+
+	Version string `json:",omitempty"`
+	CN      string `json:",omitempty"`
+	Cipher  string `json:",omitempty"`
+	SigAlg  string `json:",omitempty"`
+	KeyAlg  string `json:",omitempty"`
+}
+
+// TLV is a single Type-Length-Value from a version 2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Read reads a PROXY protocol header (of either version) from r. If r does not start with a
+// header, ErrNoHeader is returned and nothing is consumed.
+func Read(r *bufio.Reader) (*Header, error) {
+	// Peek the smallest amount needed to tell the versions apart.
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v1Prefix) {
+		return readV1(r)
+	}
+
+	b, err = r.Peek(len(v2Signature))
+	if err != nil {
+		if errors.Is(err, io.EOF) && bytes.HasPrefix(v2Signature, b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, ErrNoHeader
+	}
+	if bytes.Equal(b, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+// readV1 reads the human readable version 1 header, e.g:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long, or missing CRLF", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w: v1 header missing protocol", ErrInvalidHeader)
+	}
+	h.Transport = fields[1]
+
+	switch h.Transport {
+	case "UNKNOWN":
+		// The rest of the line should be ignored.
+		return h, nil
+
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("%w: v1 header has %d fields, want 6", ErrInvalidHeader, len(fields))
+		}
+
+		src, err := parseV1Addr(fields[2], fields[4], h.Transport)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := parseV1Addr(fields[3], fields[5], h.Transport)
+		if err != nil {
+			return nil, err
+		}
+		h.Source, h.Destination = src, dst
+		return h, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown v1 protocol %q", ErrInvalidHeader, h.Transport)
+}
+
+// parseV1Addr parses a textual address and port, checking it matches the protocol family.
+func parseV1Addr(addr, port, transport string) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || ip.Is4() != (transport == "TCP4") {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad %s address %q", ErrInvalidHeader, transport, addr)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+// readV2 reads the binary version 2 header.
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	verCmd, famProto := fixed[12], fixed[13]
+	length := binary.BigEndian.Uint16(fixed[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0x0F {
+	case 0x0:
+		h.Local = true
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, verCmd&0x0F)
+	}
+
+	stream := famProto&0x0F == 0x1
+	dgram := famProto&0x0F == 0x2
+
+	var addrLen int
+	switch famProto >> 4 {
+	case 0x0: // AF_UNSPEC
+		h.Transport = "UNKNOWN"
+
+	case 0x1: // AF_INET
+		addrLen = 12
+		h.Transport = transportName("4", stream, dgram)
+
+	case 0x2: // AF_INET6
+		addrLen = 36
+		h.Transport = transportName("6", stream, dgram)
+
+	case 0x3: // AF_UNIX
+		addrLen = 216
+		h.Transport = "UNIX"
+
+	default:
+		return nil, fmt.Errorf("%w: unknown address family %d", ErrInvalidHeader, famProto>>4)
+	}
+
+	if len(payload) < addrLen {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidHeader)
+	}
+
+	switch addrLen {
+	case 12:
+		h.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[0:4])), binary.BigEndian.Uint16(payload[8:10]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[4:8])), binary.BigEndian.Uint16(payload[10:12]))
+	case 36:
+		h.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[0:16])), binary.BigEndian.Uint16(payload[32:34]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[16:32])), binary.BigEndian.Uint16(payload[34:36]))
+	}
+
+	tlvs, err := parseTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+
+	if err := h.decodeTLVs(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func transportName(family string, stream, dgram bool) string {
+	switch {
+	case stream:
+		return "TCP" + family
+	case dgram:
+		return "UDP" + family
+	}
+	return "UNKNOWN"
+}
+
+// parseTLVs splits b into a list of TLVs.
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidHeader)
+		}
+		length := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+length {
+			return nil, fmt.Errorf("%w: TLV 0x%02x longer than header", ErrInvalidHeader, b[0])
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+length]})
+		b = b[3+length:]
+	}
+	return tlvs, nil
+}
+
+// decodeTLVs fills in the Header's fields from the well known TLVs.
+func (h *Header) decodeTLVs() error {
+	for _, tlv := range h.TLVs {
+		switch tlv.Type {
+		case tlvALPN:
+			h.ALPN = string(tlv.Value)
+		case tlvAuthority:
+			h.Authority = string(tlv.Value)
+		case tlvUniqueID:
+			h.UniqueID = tlv.Value
+		case tlvNetNS:
+			h.NetNS = string(tlv.Value)
+
+		case tlvAWS:
+			if len(tlv.Value) > 0 && tlv.Value[0] == tlvAWSVPCEndpointID {
+				h.AWSVPCEndpointID = string(tlv.Value[1:])
+			}
+
+		case tlvSSL:
+			ssl, err := decodeSSL(tlv.Value)
+			if err != nil {
+				return err
+			}
+			h.SSL = ssl
+
+		case tlvCRC32C, tlvNoop:
+			// We trust our upstream, so don't bother checking the CRC.
+		}
+	}
+	return nil
+}
+
+// decodeSSL decodes the PP2_TYPE_SSL TLV, and its sub-TLVs.
+func decodeSSL(b []byte) (*SSL, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("%w: SSL TLV too short", ErrInvalidHeader)
+	}
+
+	client := b[0]
+	verify := binary.BigEndian.Uint32(b[1:5])
+
+	ssl := &SSL{
+		TLS:        client&sslClientSSL != 0,
+		ClientCert: client&(sslClientCertConn|sslClientCertSess) != 0,
+		Verified:   client&(sslClientCertConn|sslClientCertSess) != 0 && verify == 0,
+	}
+
+	subs, err := parseTLVs(b[5:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		switch sub.Type {
+		case tlvSSLVersion:
+			ssl.Version = string(sub.Value)
+		case tlvSSLCN:
+			ssl.CN = string(sub.Value)
+		case tlvSSLCipher:
+			ssl.Cipher = string(sub.Value)
+		case tlvSSLSigAlg:
+			ssl.SigAlg = string(sub.Value)
+		case tlvSSLKeyAlg:
+			ssl.KeyAlg = string(sub.Value)
+		}
+	}
+
+	return ssl, nil
+}
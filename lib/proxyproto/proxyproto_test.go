@@ -0,0 +1,255 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// tlv encodes a single TLV.
+func tlv(t byte, value []byte) []byte {
+	b := []byte{t, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(value)))
+	return append(b, value...)
+}
+
+// v2 builds a version 2 header with the given command, family, addresses and TLVs.
+func v2(verCmd, famProto byte, addrs []byte, tlvs ...[]byte) []byte {
+	payload := append([]byte{}, addrs...)
+	for _, t := range tlvs {
+		payload = append(payload, t...)
+	}
+
+	b := append([]byte{}, v2Signature...)
+	b = append(b, verCmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func TestReadV1(t *testing.T) {
+	data := []struct {
+		input string
+		want  *Header
+	}{
+		{
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /",
+			want: &Header{
+				Version:     1,
+				Transport:   "TCP4",
+				Source:      netip.MustParseAddrPort("192.0.2.1:56324"),
+				Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+			},
+		},
+		{
+			input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /",
+			want: &Header{
+				Version:     1,
+				Transport:   "TCP6",
+				Source:      netip.MustParseAddrPort("[2001:db8::1]:56324"),
+				Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+			},
+		},
+		{
+			input: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\nGET /",
+			want:  &Header{Version: 1, Transport: "UNKNOWN"},
+		},
+	}
+
+	for _, test := range data {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		got, err := Read(r)
+		if err != nil {
+			t.Errorf("Read(%q) err: %s, want nil", test.input, err)
+			continue
+		}
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("Read(%q) diff (-got +want)\n%s", test.input, diff)
+		}
+
+		// The rest of the stream should be untouched.
+		if rest, _ := io.ReadAll(r); string(rest) != "GET /" {
+			t.Errorf("Read(%q) left %q, want %q", test.input, rest, "GET /")
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, input := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 056324 443\r\n",
+		"PROXY TCP5 192.0.2.1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"PROXY " + strings.Repeat("A", 200) + "\r\n",
+		string(v2(0x31, 0x11, make([]byte, 12))),                              // Version 3
+		string(v2(0x21, 0x11, make([]byte, 4))),                               // Short address
+		string(v2(0x21, 0x11, make([]byte, 12), []byte{tlvALPN, 0, 10, 'h'})), // Truncated TLV
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(input))); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("Read(%q) err = %v, want ErrInvalidHeader", input, err)
+		}
+	}
+
+	for _, input := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03",
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(input))); err != ErrNoHeader {
+			t.Errorf("Read(%q) err = %v, want ErrNoHeader", input, err)
+		}
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	ipv4 := []byte{
+		192, 0, 2, 1, // Source
+		198, 51, 100, 1, // Destination
+		0xdc, 0x04, // Source port 56324
+		0x01, 0xbb, // Destination port 443
+	}
+
+	ipv6 := append(append(
+		netip.MustParseAddr("2001:db8::1").AsSlice(),
+		netip.MustParseAddr("2001:db8::2").AsSlice()...),
+		0xdc, 0x04, 0x01, 0xbb)
+
+	ssl := append([]byte{sslClientSSL | sslClientCertConn, 0, 0, 0, 0}, bytes.Join([][]byte{
+		tlv(tlvSSLVersion, []byte("TLSv1.3")),
+		tlv(tlvSSLCN, []byte("client.example.net")),
+		tlv(tlvSSLCipher, []byte("TLS_AES_128_GCM_SHA256")),
+	}, nil)...)
+
+	data := []struct {
+		name  string
+		input []byte
+		want  *Header
+	}{
+		{
+			name:  "tcp4 with tlvs",
+			input: v2(0x21, 0x11, ipv4, tlv(tlvALPN, []byte("h2")), tlv(tlvAWS, []byte("\x01vpce-08d2bf15fac5001c9")), tlv(tlvSSL, ssl)),
+			want: &Header{
+				Version:          2,
+				Transport:        "TCP4",
+				Source:           netip.MustParseAddrPort("192.0.2.1:56324"),
+				Destination:      netip.MustParseAddrPort("198.51.100.1:443"),
+				ALPN:             "h2",
+				AWSVPCEndpointID: "vpce-08d2bf15fac5001c9",
+				SSL: &SSL{
+					TLS:        true,
+					ClientCert: true,
+					Verified:   true,
+					Version:    "TLSv1.3",
+					CN:         "client.example.net",
+					Cipher:     "TLS_AES_128_GCM_SHA256",
+				},
+			},
+		},
+		{
+			name:  "tcp6",
+			input: v2(0x21, 0x21, ipv6),
+			want: &Header{
+				Version:     2,
+				Transport:   "TCP6",
+				Source:      netip.MustParseAddrPort("[2001:db8::1]:56324"),
+				Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+			},
+		},
+		{
+			name:  "local",
+			input: v2(0x20, 0x00, nil),
+			want:  &Header{Version: 2, Local: true, Transport: "UNKNOWN"},
+		},
+	}
+
+	for _, test := range data {
+		got, err := Read(bufio.NewReader(bytes.NewReader(test.input)))
+		if err != nil {
+			t.Errorf("%s: Read() err: %s, want nil", test.name, err)
+			continue
+		}
+		got.TLVs = nil
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("%s: Read() diff (-got +want)\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Unable to listen: %s", err)
+	}
+	defer ln.Close()
+
+	data := []struct {
+		upstreams  []netip.Prefix
+		send       string
+		wantRemote string
+		wantBody   string
+	}{
+		{
+			upstreams:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			send:       "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello",
+			wantRemote: "192.0.2.1:56324",
+			wantBody:   "hello",
+		},
+		{
+			// Not from a trusted upstream, so the header is passed through untouched.
+			upstreams: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			send:      "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello",
+			wantBody:  "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello",
+		},
+	}
+
+	for _, test := range data {
+		l := &Listener{Listener: ln, Upstreams: test.upstreams}
+
+		client, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() err: %s", err)
+		}
+		client.Write([]byte(test.send))
+		client.Close()
+
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Accept() err: %s", err)
+		}
+
+		if test.wantRemote != "" {
+			if got := c.RemoteAddr().String(); got != test.wantRemote {
+				t.Errorf("RemoteAddr() = %q, want %q", got, test.wantRemote)
+			}
+		} else if got := c.RemoteAddr().String(); got != client.LocalAddr().String() {
+			t.Errorf("RemoteAddr() = %q, want %q", got, client.LocalAddr())
+		}
+
+		body, _ := io.ReadAll(c)
+		if string(body) != test.wantBody {
+			t.Errorf("Read() = %q, want %q", body, test.wantBody)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bramp.net/myip/lib/coalesce"
+	openrdap "github.com/openrdap/rdap"
+	log "github.com/sirupsen/logrus"
+)
+
+// ASResponse contains the RDAP data about an autonomous system we send to the user.
+type ASResponse struct {
+	ASN uint32
+
+	// Autnum fields. The registration may cover a block of AS numbers, from StartAutnum to
+	// EndAutnum.
+	Name        string `json:",omitempty"`
+	Handle      string `json:",omitempty"`
+	StartAutnum uint32 `json:",omitempty"`
+	EndAutnum   uint32 `json:",omitempty"`
+	Country     string `json:",omitempty"`
+	Type        string `json:",omitempty"`
+	Status      string `json:",omitempty"`
+	Port43      string `json:",omitempty"`
+
+	Events   []Event  `json:",omitempty"`
+	Remarks  []Remark `json:",omitempty"`
+	Links    []string `json:",omitempty"`
+	Entities []Entity `json:",omitempty"`
+
+	// Body is a human-readable text rendering of the RDAP data.
+	Body string `json:",omitempty"`
+
+	Error string `json:",omitempty"`
+
+	// Duration is how long the query took, in milliseconds.
+	Duration int `json:",omitempty"`
+
+	// TimedOut is set if the query was abandoned because the context's deadline passed.
+	TimedOut bool `json:",omitempty"`
+}
+
+// Org returns the name of the organisation the AS is registered to, falling back to the AS's name
+// if there is no registrant.
+func (r *ASResponse) Org() string {
+	if name := registrant(r.Entities); name != "" {
+		return name
+	}
+	return r.Name
+}
+
+// String returns the AS number and who it's registered to, e.g. "AS15169 Google LLC".
+func (r *ASResponse) String() string {
+	s := "AS" + strconv.FormatUint(uint64(r.ASN), 10)
+	if org := r.Org(); org != "" {
+		s += " " + org
+	}
+	return s
+}
+
+// asQueries coalesces concurrent queries for the same AS.
+var asQueries coalesce.Group[*ASResponse]
+
+// QueryASN performs an RDAP lookup for the autonomous system, and returns an ASResponse. Concurrent
+// queries for the same AS share a single request.
+func (c *Client) QueryASN(ctx context.Context, asn uint32) *ASResponse {
+	start := time.Now()
+	key := strconv.FormatUint(uint64(asn), 10)
+	resp, shared, err := asQueries.Do(ctx, key, func(ctx context.Context) (*ASResponse, error) {
+		return c.queryASN(ctx, asn), nil
+	})
+	if err != nil {
+		resp = &ASResponse{
+			ASN:   asn,
+			Error: err.Error(),
+		}
+	} else if shared {
+		// Give each caller their own copy.
+		r := *resp
+		resp = &r
+	}
+
+	resp.Duration = int(time.Since(start).Milliseconds())
+	resp.TimedOut = resp.Error != "" && (resp.TimedOut || errors.Is(ctx.Err(), context.DeadlineExceeded))
+	return resp
+}
+
+func (c *Client) queryASN(ctx context.Context, asn uint32) *ASResponse {
+	req := openrdap.NewAutnumRequest(asn)
+	req = req.WithContext(ctx)
+
+	log.Infof("RDAP request for AS%d", asn)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		log.Warningf("RDAP failed for AS%d: %s", asn, err)
+		return &ASResponse{
+			ASN:      asn,
+			Error:    err.Error(),
+			TimedOut: timedOut(resp, err),
+		}
+	}
+
+	autnum, ok := resp.Object.(*openrdap.Autnum)
+	if !ok {
+		log.Warningf("RDAP returned non-Autnum response for AS%d", asn)
+		return &ASResponse{
+			ASN:   asn,
+			Error: "unexpected RDAP response type",
+		}
+	}
+
+	return autnumToResponse(asn, autnum)
+}
+
+// autnumToResponse converts an openrdap.Autnum to our ASResponse type.
+func autnumToResponse(asn uint32, autnum *openrdap.Autnum) *ASResponse {
+	links := make([]string, 0, len(autnum.Links))
+	for _, l := range autnum.Links {
+		if l.Href != "" {
+			links = append(links, l.Href)
+		}
+	}
+
+	resp := &ASResponse{
+		ASN:      asn,
+		Name:     autnum.Name,
+		Handle:   autnum.Handle,
+		Country:  autnum.Country,
+		Type:     autnum.Type,
+		Status:   strings.Join(autnum.Status, ", "),
+		Port43:   autnum.Port43,
+		Events:   convertEvents(autnum.Events),
+		Remarks:  convertRemarks(autnum.Remarks),
+		Links:    links,
+		Entities: convertEntities(autnum.Entities),
+	}
+	if autnum.StartAutnum != nil {
+		resp.StartAutnum = *autnum.StartAutnum
+	}
+	if autnum.EndAutnum != nil {
+		resp.EndAutnum = *autnum.EndAutnum
+	}
+
+	resp.Body = formatASBody(resp)
+	return resp
+}
+
+// Text returns a human-readable text rendering of the response, as used for its Body.
+func (r *ASResponse) Text() string {
+	return formatASBody(r)
+}
+
+// formatASBody produces a human-readable text rendering of the RDAP autnum response, in the same
+// style as formatTextBody.
+func formatASBody(resp *ASResponse) string {
+	var b strings.Builder
+
+	writeLine := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%-16s %s\n", key+":", value)
+		}
+	}
+
+	writeLine("Name", resp.Name)
+	writeLine("Handle", resp.Handle)
+	if resp.StartAutnum != 0 && resp.EndAutnum != 0 && resp.StartAutnum != resp.EndAutnum {
+		writeLine("Range", fmt.Sprintf("AS%d - AS%d", resp.StartAutnum, resp.EndAutnum))
+	}
+	writeLine("Type", resp.Type)
+	writeLine("Country", resp.Country)
+	writeLine("Status", resp.Status)
+	writeLine("Port43", resp.Port43)
+
+	for _, ev := range resp.Events {
+		writeLine("Event", ev.Action+" @ "+ev.Date)
+	}
+
+	for _, link := range resp.Links {
+		writeLine("Link", link)
+	}
+
+	for _, r := range resp.Remarks {
+		if r.Title != "" {
+			b.WriteString("\n")
+			writeLine("Remark", r.Title)
+			for _, d := range r.Description {
+				fmt.Fprintf(&b, "  %s\n", d)
+			}
+		}
+	}
+
+	for _, e := range resp.Entities {
+		writeEntity(&b, &e, "")
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// HandleASN performs an RDAP lookup for the autonomous system using a default client. It takes as
+// long as ctx allows, or if it has no deadline, RDAPTimeout.
+func HandleASN(ctx context.Context, asn uint32) *ASResponse {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	return NewClient(0).QueryASN(ctx, asn)
+}
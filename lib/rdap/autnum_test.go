@@ -0,0 +1,133 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	openrdap "github.com/openrdap/rdap"
+)
+
+func TestAutnumToResponse(t *testing.T) {
+	start, end := uint32(15169), uint32(15169)
+	autnum := &openrdap.Autnum{
+		Handle:      "AS15169",
+		Name:        "GOOGLE",
+		StartAutnum: &start,
+		EndAutnum:   &end,
+		Status:      []string{"active"},
+		Port43:      "whois.arin.net",
+		Events: []openrdap.Event{
+			{Action: "registration", Date: "2000-03-30T00:00:00-05:00"},
+		},
+		Entities: []openrdap.Entity{
+			{Handle: "GOGL", Roles: []string{"registrant"}},
+		},
+	}
+
+	resp := autnumToResponse(15169, autnum)
+	if resp.ASN != 15169 || resp.Handle != "AS15169" || resp.Name != "GOOGLE" || resp.Status != "active" {
+		t.Errorf("autnumToResponse() = %+v, want AS15169 GOOGLE", resp)
+	}
+	if resp.StartAutnum != 15169 || resp.EndAutnum != 15169 {
+		t.Errorf("autnumToResponse() range = AS%d - AS%d, want AS15169 - AS15169", resp.StartAutnum, resp.EndAutnum)
+	}
+	if len(resp.Entities) != 1 || resp.Entities[0].Handle != "GOGL" {
+		t.Errorf("autnumToResponse() Entities = %+v, want GOGL", resp.Entities)
+	}
+
+	for _, want := range []string{"Name:            GOOGLE", "Port43:          whois.arin.net", "Entity:          GOGL"} {
+		if !strings.Contains(resp.Body, want) {
+			t.Errorf("autnumToResponse() Body = %q, want it to contain %q", resp.Body, want)
+		}
+	}
+	if strings.Contains(resp.Body, "Range:") {
+		t.Errorf("autnumToResponse() Body = %q, want no Range for a single AS", resp.Body)
+	}
+}
+
+func TestASResponseString(t *testing.T) {
+	data := []struct {
+		resp *ASResponse
+		want string
+	}{
+		{
+			resp: &ASResponse{ASN: 64496},
+			want: "AS64496",
+		},
+		{
+			resp: &ASResponse{ASN: 15169, Name: "GOOGLE"},
+			want: "AS15169 GOOGLE",
+		},
+		{
+			resp: &ASResponse{
+				ASN:      15169,
+				Name:     "GOOGLE",
+				Entities: []Entity{{Name: "Google LLC", Roles: []string{"registrant"}}},
+			},
+			want: "AS15169 Google LLC",
+		},
+	}
+
+	for _, test := range data {
+		if got := test.resp.String(); got != test.want {
+			t.Errorf("String() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestQueryASN(t *testing.T) {
+	rdapServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/autnum/64496" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rdap+json")
+		fmt.Fprint(w, `{"objectClassName": "autnum", "handle": "AS64496", "name": "EXAMPLE-AS",
+			"startAutnum": 64496, "endAutnum": 64511, "country": "US",
+			"entities": [{"objectClassName": "entity", "handle": "EX-1", "roles": ["registrant"],
+				"vcardArray": ["vcard", [["version", {}, "text", "4.0"], ["fn", {}, "text", "Example Inc."]]]}]}`)
+	}))
+	defer rdapServer.Close()
+
+	dir := t.TempDir()
+	asn := fmt.Sprintf(`{
+  "version": "1.0",
+  "publication": "2024-01-01T00:00:00Z",
+  "services": [[["64496-64511"], [%q]]]
+}`, rdapServer.URL+"/")
+	if err := os.WriteFile(filepath.Join(dir, "asn.json"), []byte(asn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{Dir: dir, Offline: true}
+	resp := b.NewClient(RDAPTimeout).QueryASN(context.Background(), 64496)
+	if resp.Error != "" {
+		t.Fatalf("QueryASN() err = %s", resp.Error)
+	}
+	if got, want := resp.String(), "AS64496 Example Inc."; got != want {
+		t.Errorf("QueryASN().String() = %q, want %q", got, want)
+	}
+	if !strings.Contains(resp.Body, "AS64496 - AS64511") || resp.Country != "US" {
+		t.Errorf("QueryASN() = %+v, want the AS64496 - AS64511 block in the US", resp)
+	}
+}
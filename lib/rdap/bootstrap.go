@@ -0,0 +1,425 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdap
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openrdap/rdap/bootstrap"
+	"github.com/openrdap/rdap/bootstrap/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBootstrapRefresh is how often the bootstrap files are refreshed, if IANA's response
+	// doesn't say.
+	DefaultBootstrapRefresh = 24 * time.Hour
+
+	// minBootstrapRefresh and maxBootstrapRefresh bound how often the files are refreshed,
+	// whatever IANA's response says.
+	minBootstrapRefresh = time.Hour
+	maxBootstrapRefresh = 7 * 24 * time.Hour
+
+	// bootstrapRetry is how long to wait after a refresh fails, before trying again.
+	bootstrapRetry = 15 * time.Minute
+
+	// maxBootstrapSize is the largest bootstrap file accepted.
+	maxBootstrapSize = 10 << 20
+)
+
+// embeddedBootstrap is a copy of IANA's bootstrap files, used until they're first downloaded.
+//
+//go:embed bootstrap/*.json
+var embeddedBootstrap embed.FS
+
+// bootstrapRegistries are the registries whose bootstrap files are kept.
+var bootstrapRegistries = []bootstrap.RegistryType{bootstrap.IPv4, bootstrap.IPv6, bootstrap.ASN}
+
+// DefaultBootstrap is the Bootstrap used by NewClient. Set its fields before the first lookup.
+var DefaultBootstrap = &Bootstrap{}
+
+// Bootstrap keeps IANA's bootstrap files, which say which RDAP server is responsible for each
+// network and AS number. They start as the copy in Dir, or failing that, the copy embedded in the
+// binary, and are kept up to date by Run.
+type Bootstrap struct {
+	// BaseURL is where the files are downloaded from. Defaults to IANA's.
+	BaseURL string
+
+	// Dir, if set, is a directory the files are read from at start up, and saved to when they're
+	// refreshed, so they survive restarts.
+	Dir string
+
+	// Offline stops the files being downloaded, so only those in Dir, or embedded, are used.
+	Offline bool
+
+	// HTTP is the client used to download the files. Defaults to one with RDAPTimeout.
+	HTTP *http.Client
+
+	once  sync.Once
+	mu    sync.Mutex
+	files map[string]*bootstrapFile // By file name, e.g. "ipv4.json"
+}
+
+type bootstrapFile struct {
+	data    []byte
+	version int // Incremented each time data changes
+	meta    bootstrapMeta
+}
+
+// bootstrapMeta is saved alongside each file in Dir, to make conditional requests, and know when
+// to refresh it.
+type bootstrapMeta struct {
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+
+	// Expires is when the file should be refreshed. Zero means as soon as possible.
+	Expires time.Time
+}
+
+// init loads the files from Dir, or the embedded copies, the first time they're needed.
+func (b *Bootstrap) init() {
+	b.once.Do(func() {
+		b.files = make(map[string]*bootstrapFile)
+		for _, r := range bootstrapRegistries {
+			name := r.Filename()
+			f := &bootstrapFile{version: 1}
+
+			data, meta, err := b.readDir(r)
+			switch {
+			case err == nil:
+				f.data, f.meta = data, meta
+			case b.Dir != "" && !os.IsNotExist(err):
+				log.Warningf("RDAP bootstrap %q is unusable, using the embedded copy: %s", filepath.Join(b.Dir, name), err)
+				fallthrough
+			default:
+				if f.data, err = embeddedBootstrap.ReadFile("bootstrap/" + name); err != nil {
+					panic(err) // The file is missing from the embed pattern
+				}
+			}
+			b.files[name] = f
+		}
+	})
+}
+
+// readDir reads a file, and its meta data (if any), from Dir.
+func (b *Bootstrap) readDir(r bootstrap.RegistryType) ([]byte, bootstrapMeta, error) {
+	var meta bootstrapMeta
+	if b.Dir == "" {
+		return nil, meta, fs.ErrNotExist
+	}
+
+	path := filepath.Join(b.Dir, r.Filename())
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, meta, err
+	}
+	if err := parseRegistry(r, data); err != nil {
+		return nil, meta, err
+	}
+
+	// Files without meta data, such as those put there by hand, are refreshed straight away.
+	if b, err := os.ReadFile(path + ".meta"); err == nil {
+		if err := json.Unmarshal(b, &meta); err != nil {
+			log.Warningf("RDAP bootstrap %q is invalid: %s", path+".meta", err)
+		}
+	}
+	return data, meta, nil
+}
+
+// parseRegistry returns an error if data isn't a valid bootstrap file for the registry.
+func parseRegistry(r bootstrap.RegistryType, data []byte) error {
+	var err error
+	switch r {
+	case bootstrap.IPv4:
+		_, err = bootstrap.NewNetRegistry(data, 4)
+	case bootstrap.IPv6:
+		_, err = bootstrap.NewNetRegistry(data, 6)
+	case bootstrap.ASN:
+		_, err = bootstrap.NewASNRegistry(data)
+	default:
+		err = fmt.Errorf("unsupported registry %s", r)
+	}
+	return err
+}
+
+// Run refreshes the files as they expire, until the context is done. It returns straight away if
+// Offline is set.
+func (b *Bootstrap) Run(ctx context.Context) {
+	b.init()
+	if b.Offline {
+		return
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(b.refreshExpired(ctx)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// refreshExpired refreshes the files that have expired, and returns when the next one will.
+func (b *Bootstrap) refreshExpired(ctx context.Context) time.Time {
+	var next time.Time
+	for _, r := range bootstrapRegistries {
+		expires := b.expires(r)
+		if !time.Now().Before(expires) {
+			if err := b.refresh(ctx, r); err != nil {
+				log.Warningf("Refreshing RDAP bootstrap %q failed, will retry in %s: %s", r.Filename(), bootstrapRetry, err)
+
+				b.mu.Lock()
+				b.files[r.Filename()].meta.Expires = time.Now().Add(bootstrapRetry)
+				b.mu.Unlock()
+			}
+			expires = b.expires(r)
+		}
+
+		if next.IsZero() || expires.Before(next) {
+			next = expires
+		}
+	}
+	return next
+}
+
+func (b *Bootstrap) expires(r bootstrap.RegistryType) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.files[r.Filename()].meta.Expires
+}
+
+// refresh downloads the registry's file, if it has changed since it was last downloaded.
+func (b *Bootstrap) refresh(ctx context.Context, r bootstrap.RegistryType) error {
+	name := r.Filename()
+
+	b.mu.Lock()
+	meta := b.files[name].meta
+	b.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url(name), nil)
+	if err != nil {
+		return err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	client := b.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: RDAPTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var data []byte
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Infof("RDAP bootstrap %q is unchanged", name)
+
+	case http.StatusOK:
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maxBootstrapSize+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > maxBootstrapSize {
+			return fmt.Errorf("%s is larger than %d bytes", req.URL, maxBootstrapSize)
+		}
+		if err := parseRegistry(r, data); err != nil {
+			return fmt.Errorf("%s is invalid: %w", req.URL, err)
+		}
+		log.Infof("RDAP bootstrap %q refreshed", name)
+
+		meta.ETag = resp.Header.Get("ETag")
+		meta.LastModified = resp.Header.Get("Last-Modified")
+
+	default:
+		return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+
+	meta.Expires = bootstrapExpiry(resp.Header, time.Now())
+	b.store(name, data, meta)
+	return nil
+}
+
+func (b *Bootstrap) url(name string) string {
+	base := b.BaseURL
+	if base == "" {
+		base = bootstrap.DefaultBaseURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + name
+}
+
+// store replaces the file's meta data, and its data unless it's nil, saving them to Dir.
+func (b *Bootstrap) store(name string, data []byte, meta bootstrapMeta) {
+	b.mu.Lock()
+	f := b.files[name]
+	f.meta = meta
+	if data != nil {
+		f.data = data
+		f.version++
+	}
+	b.mu.Unlock()
+
+	if b.Dir == "" {
+		return
+	}
+
+	metaJSON, err := json.Marshal(meta)
+	if err == nil && data != nil {
+		err = writeFile(filepath.Join(b.Dir, name), data)
+	}
+	if err == nil {
+		err = writeFile(filepath.Join(b.Dir, name+".meta"), metaJSON)
+	}
+	if err != nil {
+		log.Warningf("Saving RDAP bootstrap %q failed: %s", name, err)
+	}
+}
+
+// writeFile replaces the file atomically, so it's never seen half written.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails once it's renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// bootstrapExpiry returns when a response with the headers should be refreshed, according to its
+// Cache-Control max-age, or failing that its Expires.
+func bootstrapExpiry(h http.Header, now time.Time) time.Time {
+	ttl := DefaultBootstrapRefresh
+	if maxAge, found := cacheMaxAge(h.Get("Cache-Control")); found {
+		age, _ := strconv.Atoi(h.Get("Age"))
+		ttl = maxAge - time.Duration(age)*time.Second
+	} else if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		ttl = expires.Sub(now)
+	}
+
+	return now.Add(min(max(ttl, minBootstrapRefresh), maxBootstrapRefresh))
+}
+
+// cacheMaxAge returns the max-age of a Cache-Control header, which is zero if it says not to cache.
+func cacheMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache", directive == "no-store":
+			return 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// client returns an openrdap bootstrap client that uses the files.
+func (b *Bootstrap) client(httpClient *http.Client) *bootstrap.Client {
+	b.init()
+	return &bootstrap.Client{
+		HTTP:  httpClient,
+		Cache: &bootstrapCache{b: b, loaded: make(map[string]int), other: make(map[string][]byte)},
+	}
+}
+
+// bootstrapCache gives an openrdap bootstrap client the Bootstrap's files. It remembers the version
+// of each file the client has loaded, so the client reloads them once they're refreshed.
+type bootstrapCache struct {
+	b *Bootstrap
+
+	mu     sync.Mutex
+	loaded map[string]int    // Version loaded, by file name
+	other  map[string][]byte // Files the Bootstrap doesn't keep, which the client downloads itself
+}
+
+func (c *bootstrapCache) Load(name string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	if f, found := c.b.files[name]; found {
+		c.loaded[name] = f.version
+		return f.data, nil
+	}
+	if data, found := c.other[name]; found {
+		return data, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (c *bootstrapCache) Save(name string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.b.files[name]; !found {
+		c.other[name] = data
+	}
+	return nil
+}
+
+func (c *bootstrapCache) State(name string) cache.FileState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	if f, found := c.b.files[name]; found {
+		if c.loaded[name] < f.version {
+			return cache.ShouldReload
+		}
+		return cache.Good
+	}
+	if _, found := c.other[name]; found {
+		return cache.Good
+	}
+	return cache.Absent
+}
+
+// SetTimeout does nothing, as Run decides when the files are refreshed.
+func (c *bootstrapCache) SetTimeout(time.Duration) {}
@@ -0,0 +1,181 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openrdap/rdap/bootstrap"
+	"github.com/openrdap/rdap/bootstrap/cache"
+)
+
+// ipv4Bootstrap returns a bootstrap file that sends 192.0.2.0/24 to the server.
+func ipv4Bootstrap(server string) string {
+	return fmt.Sprintf(`{
+  "version": "1.0",
+  "publication": "2024-01-01T00:00:00Z",
+  "services": [[["192.0.2.0/24"], [%q]]]
+}`, server+"/")
+}
+
+func TestBootstrapOffline(t *testing.T) {
+	rdapServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ip/192.0.2.1" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rdap+json")
+		fmt.Fprint(w, `{"objectClassName": "ip network", "handle": "NET-192-0-2-0-1", "name": "TEST-NET-1",
+			"startAddress": "192.0.2.0", "endAddress": "192.0.2.255", "ipVersion": "v4"}`)
+	}))
+	defer rdapServer.Close()
+
+	iana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Offline bootstrap downloaded %q", req.URL)
+		http.NotFound(w, req)
+	}))
+	defer iana.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ipv4.json"), []byte(ipv4Bootstrap(rdapServer.URL)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{BaseURL: iana.URL, Dir: dir, Offline: true}
+	b.Run(context.Background()) // Returns straight away
+
+	resp := b.NewClient(RDAPTimeout).QueryIP(context.Background(), "192.0.2.1")
+	if resp.Error != "" || resp.Name != "TEST-NET-1" || resp.CIDR != "192.0.2.0/24" {
+		t.Errorf("QueryIP() = %+v, want TEST-NET-1 from the local bootstrap", resp)
+	}
+}
+
+func TestBootstrapEmbedded(t *testing.T) {
+	b := &Bootstrap{Dir: filepath.Join(t.TempDir(), "missing"), Offline: true}
+	b.init()
+
+	for _, r := range bootstrapRegistries {
+		if err := parseRegistry(r, b.files[r.Filename()].data); err != nil {
+			t.Errorf("embedded %s is invalid: %s", r.Filename(), err)
+		}
+	}
+}
+
+func TestBootstrapRefresh(t *testing.T) {
+	var notModified int32
+	body := ipv4Bootstrap("https://rdap.example.net")
+	iana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ipv4.json" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "public, max-age=7200")
+		fmt.Fprint(w, body)
+	}))
+	defer iana.Close()
+
+	dir := t.TempDir()
+	b := &Bootstrap{BaseURL: iana.URL + "/", Dir: dir}
+	client := b.client(http.DefaultClient)
+	c := client.Cache.(*bootstrapCache)
+	if _, err := c.Load("ipv4.json"); err != nil {
+		t.Fatalf("Load() err = %s", err)
+	}
+
+	start := time.Now()
+	if err := b.refresh(context.Background(), bootstrap.IPv4); err != nil {
+		t.Fatalf("refresh() err = %s", err)
+	}
+	if got := string(b.files["ipv4.json"].data); got != body {
+		t.Errorf("refresh() data = %q, want %q", got, body)
+	}
+	if expires := b.expires(bootstrap.IPv4); expires.Before(start.Add(2*time.Hour)) || expires.After(time.Now().Add(2*time.Hour)) {
+		t.Errorf("refresh() expires in %s, want 2h from the max-age", time.Until(expires))
+	}
+	if got := c.State("ipv4.json"); got != cache.ShouldReload {
+		t.Errorf("State() after refresh = %s, want the client to reload", got)
+	}
+
+	// It's saved, so a new Bootstrap starts with it.
+	saved := &Bootstrap{BaseURL: iana.URL, Dir: dir}
+	saved.init()
+	if got := string(saved.files["ipv4.json"].data); got != body {
+		t.Errorf("saved data = %q, want %q", got, body)
+	}
+	if got := saved.files["ipv4.json"].meta.ETag; got != `"v1"` {
+		t.Errorf("saved ETag = %q, want %q", got, `"v1"`)
+	}
+
+	// Refreshing again is a conditional request, which leaves the data alone.
+	version := saved.files["ipv4.json"].version
+	if err := saved.refresh(context.Background(), bootstrap.IPv4); err != nil {
+		t.Fatalf("refresh() err = %s", err)
+	}
+	if got := atomic.LoadInt32(&notModified); got != 1 {
+		t.Errorf("refresh() made %d conditional requests, want 1", got)
+	}
+	if got := saved.files["ipv4.json"].version; got != version {
+		t.Errorf("refresh() of an unchanged file version = %d, want %d", got, version)
+	}
+	if expires := saved.expires(bootstrap.IPv4); expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("refresh() expires in %s, want 1h from the 304's max-age", time.Until(expires))
+	}
+
+	// A file that's not found is an error, and the old copy is kept.
+	if err := b.refresh(context.Background(), bootstrap.ASN); err == nil {
+		t.Errorf("refresh() of a missing file err = nil, want an error")
+	}
+	if err := parseRegistry(bootstrap.ASN, b.files["asn.json"].data); err != nil {
+		t.Errorf("asn.json after a failed refresh is invalid: %s", err)
+	}
+}
+
+func TestBootstrapExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{header: http.Header{}, want: DefaultBootstrapRefresh},
+		{header: http.Header{"Cache-Control": {"max-age=7200"}}, want: 2 * time.Hour},
+		{header: http.Header{"Cache-Control": {"max-age=7200"}, "Age": {"1800"}}, want: 90 * time.Minute},
+		{header: http.Header{"Cache-Control": {"no-cache"}}, want: minBootstrapRefresh},
+		{header: http.Header{"Cache-Control": {"max-age=60"}}, want: minBootstrapRefresh},
+		{header: http.Header{"Cache-Control": {"max-age=31536000"}}, want: maxBootstrapRefresh},
+		{header: http.Header{"Expires": {"Tue, 02 Jan 2024 12:00:00 GMT"}}, want: 36 * time.Hour},
+		{header: http.Header{"Expires": {"0"}}, want: DefaultBootstrapRefresh},
+	}
+
+	for _, test := range data {
+		if got := bootstrapExpiry(test.header, now).Sub(now); got != test.want {
+			t.Errorf("bootstrapExpiry(%v) = now + %s, want now + %s", test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdap
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"slices"
+
+	openrdap "github.com/openrdap/rdap"
+	log "github.com/sirupsen/logrus"
+)
+
+// Network is one level in the hierarchy of networks containing an address.
+type Network struct {
+	Handle       string `json:",omitempty"`
+	Name         string `json:",omitempty"`
+	StartAddress string `json:",omitempty"`
+	EndAddress   string `json:",omitempty"`
+	CIDR         string `json:",omitempty"`
+	Type         string `json:",omitempty"`
+	Registrant   string `json:",omitempty"`
+}
+
+// newNetwork returns the level of the hierarchy for the openrdap.IPNetwork.
+func newNetwork(ipNet *openrdap.IPNetwork) Network {
+	return Network{
+		Handle:       ipNet.Handle,
+		Name:         ipNet.Name,
+		StartAddress: ipNet.StartAddress,
+		EndAddress:   ipNet.EndAddress,
+		CIDR:         CIDRFromRange(ipNet.StartAddress, ipNet.EndAddress),
+		Type:         ipNet.Type,
+		Registrant:   registrant(convertEntities(ipNet.Entities)),
+	}
+}
+
+// hierarchy follows each network's parent, up to the RIR's allocation or c.MaxParents, returning
+// them all, largest first, and ending with ipNet. It returns nil if ipNet has no parent. If a parent
+// can't be fetched, or HierarchyTimeout passes, the networks found so far are returned.
+func (c *Client) hierarchy(ctx context.Context, ipNet *openrdap.IPNetwork) []Network {
+	if c.MaxParents <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, HierarchyTimeout)
+	defer cancel()
+
+	networks := []Network{newNetwork(ipNet)}
+	seen := map[string]bool{ipNet.Handle: true}
+
+	for cur := ipNet; len(networks) <= c.MaxParents; {
+		req := parentRequest(cur)
+		if req == nil {
+			break
+		}
+		req = req.WithContext(ctx)
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			log.Warningf("RDAP failed for the parent of %q: %s", cur.Handle, err)
+			break
+		}
+		parent, ok := resp.Object.(*openrdap.IPNetwork)
+		if !ok || parent.Handle == "" || seen[parent.Handle] || !contains(parent, cur) {
+			// Not a network, or one we've already seen, or a network that isn't a parent.
+			break
+		}
+
+		seen[parent.Handle] = true
+		networks = append(networks, newNetwork(parent))
+		cur = parent
+	}
+
+	if len(networks) < 2 {
+		return nil
+	}
+	slices.Reverse(networks)
+	return networks
+}
+
+// parentRequest returns the request for the network's parent, or nil if it has none. The parent
+// is found from its https "up" link, or if there isn't one, but it has a parent, by asking for the
+// block twice the size of the network, which returns the smallest network containing it. Other
+// links are ignored, as they're from the registry's response, and could point anywhere.
+func parentRequest(ipNet *openrdap.IPNetwork) *openrdap.Request {
+	for _, l := range ipNet.Links {
+		if l.Rel != "up" && l.Rel != "rdap-up" {
+			continue
+		}
+		u, err := url.Parse(l.Href)
+		if err != nil || u.Scheme != "https" {
+			continue
+		}
+		return &openrdap.Request{
+			Type:   openrdap.RawRequest,
+			Server: u,
+		}
+	}
+
+	if ipNet.ParentHandle == "" {
+		return nil
+	}
+	block, ok := coveringPrefix(ipNet.StartAddress, ipNet.EndAddress)
+	if !ok || block.Bits() == 0 {
+		return nil
+	}
+	return &openrdap.Request{
+		Type:  openrdap.IPRequest,
+		Query: netip.PrefixFrom(block.Addr(), block.Bits()-1).Masked().String(),
+	}
+}
+
+// coveringPrefix returns the smallest prefix containing the range of addresses.
+func coveringPrefix(start, end string) (netip.Prefix, bool) {
+	first, err1 := netip.ParseAddr(start)
+	last, err2 := netip.ParseAddr(end)
+	if err1 != nil || err2 != nil || first.Is4() != last.Is4() {
+		return netip.Prefix{}, false
+	}
+	for bits := first.BitLen(); bits >= 0; bits-- {
+		if p, err := first.Prefix(bits); err == nil && p.Contains(last) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// contains returns true if parent's range includes all of child's, and is larger.
+func contains(parent, child *openrdap.IPNetwork) bool {
+	pStart, err1 := netip.ParseAddr(parent.StartAddress)
+	pEnd, err2 := netip.ParseAddr(parent.EndAddress)
+	cStart, err3 := netip.ParseAddr(child.StartAddress)
+	cEnd, err4 := netip.ParseAddr(child.EndAddress)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return false
+	}
+	if pStart.Is4() != cStart.Is4() || pStart.Compare(cStart) > 0 || pEnd.Compare(cEnd) < 0 {
+		return false
+	}
+	return pStart != cStart || pEnd != cEnd
+}
@@ -0,0 +1,304 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	openrdap "github.com/openrdap/rdap"
+)
+
+// testNetwork returns an RDAP ip network object.
+func testNetwork(handle, start, end, typ, parent, registrant, up string) string {
+	links := "[]"
+	if up != "" {
+		links = fmt.Sprintf(`[{"rel": "up", "href": %q, "type": "application/rdap+json"}]`, up)
+	}
+	return fmt.Sprintf(`{"objectClassName": "ip network", "handle": %q, "name": %q,
+		"startAddress": %q, "endAddress": %q, "ipVersion": "v4", "type": %q, "parentHandle": %q,
+		"links": %s,
+		"entities": [{"objectClassName": "entity", "handle": "E-%s", "roles": ["registrant"],
+			"vcardArray": ["vcard", [["version", {}, "text", "4.0"], ["fn", {}, "text", %q]]]}]}`,
+		handle, "NAME-"+handle, start, end, typ, parent, links, handle, registrant)
+}
+
+// hierarchyClient returns a client whose bootstrap sends 192.0.0.0/16 to an https server answering
+// with the networks, keyed by path.
+func hierarchyClient(t *testing.T, networks func(server string) map[string]string) *Client {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, found := networks(server.URL)[req.URL.Path]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rdap+json")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	bootstrap := fmt.Sprintf(`{
+  "version": "1.0",
+  "publication": "2024-01-01T00:00:00Z",
+  "services": [[["192.0.0.0/16"], [%q]]]
+}`, server.URL+"/")
+	if err := os.WriteFile(filepath.Join(dir, "ipv4.json"), []byte(bootstrap), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := (&Bootstrap{Dir: dir, Offline: true}).NewClient(RDAPTimeout)
+	client.client.HTTP.Transport = server.Client().Transport
+	return client
+}
+
+func TestQueryIPHierarchy(t *testing.T) {
+	client := hierarchyClient(t, func(server string) map[string]string {
+		return map[string]string{
+			// The customer's network links up to the ISP's.
+			"/ip/192.0.2.1": testNetwork("NET-192-0-2-0-1", "192.0.2.0", "192.0.2.255", "ASSIGNMENT",
+				"NET-192-0-0-0-1", "Customer Inc.", server+"/ip/192.0.0.0/22"),
+			// The ISP's only has a parent handle, so the next larger block is asked for.
+			"/ip/192.0.0.0/22": testNetwork("NET-192-0-0-0-1", "192.0.0.0", "192.0.3.255", "REALLOCATION",
+				"NET-192-0-0-0-0", "Example ISP", ""),
+			"/ip/192.0.0.0/21": testNetwork("NET-192-0-0-0-0", "192.0.0.0", "192.0.255.255", "ALLOCATION",
+				"", "Example RIR", ""),
+		}
+	})
+
+	resp := client.QueryIP(context.Background(), "192.0.2.1")
+	if resp.Error != "" {
+		t.Fatalf("QueryIP() err = %s", resp.Error)
+	}
+
+	want := []Network{
+		{Handle: "NET-192-0-0-0-0", Name: "NAME-NET-192-0-0-0-0", StartAddress: "192.0.0.0", EndAddress: "192.0.255.255",
+			CIDR: "192.0.0.0/16", Type: "ALLOCATION", Registrant: "Example RIR"},
+		{Handle: "NET-192-0-0-0-1", Name: "NAME-NET-192-0-0-0-1", StartAddress: "192.0.0.0", EndAddress: "192.0.3.255",
+			CIDR: "192.0.0.0/22", Type: "REALLOCATION", Registrant: "Example ISP"},
+		{Handle: "NET-192-0-2-0-1", Name: "NAME-NET-192-0-2-0-1", StartAddress: "192.0.2.0", EndAddress: "192.0.2.255",
+			CIDR: "192.0.2.0/24", Type: "ASSIGNMENT", Registrant: "Customer Inc."},
+	}
+	if diff := pretty.Compare(resp.Hierarchy, want); diff != "" {
+		t.Errorf("QueryIP() Hierarchy diff (-got +want)\n%s", diff)
+	}
+
+	wantBody := "Hierarchy:\n" +
+		"  192.0.0.0/16 NAME-NET-192-0-0-0-0 (ALLOCATION, Example RIR)\n" +
+		"    192.0.0.0/22 NAME-NET-192-0-0-0-1 (REALLOCATION, Example ISP)\n" +
+		"      192.0.2.0/24 NAME-NET-192-0-2-0-1 (ASSIGNMENT, Customer Inc.)\n"
+	if !strings.Contains(resp.Body, wantBody) {
+		t.Errorf("QueryIP() Body = %q, want it to contain %q", resp.Body, wantBody)
+	}
+}
+
+func TestQueryIPHierarchyStops(t *testing.T) {
+	data := map[string]func(server string) map[string]string{
+		"no parent": func(string) map[string]string {
+			return map[string]string{
+				"/ip/192.0.2.1": testNetwork("NET-1", "192.0.2.0", "192.0.2.255", "ALLOCATION", "", "RIR", ""),
+			}
+		},
+		"parent missing": func(server string) map[string]string {
+			return map[string]string{
+				"/ip/192.0.2.1": testNetwork("NET-1", "192.0.2.0", "192.0.2.255", "ASSIGNMENT", "NET-0", "Customer", server+"/ip/192.0.0.0/22"),
+			}
+		},
+		"up to itself": func(server string) map[string]string {
+			return map[string]string{
+				"/ip/192.0.2.1":    testNetwork("NET-1", "192.0.2.0", "192.0.2.255", "ASSIGNMENT", "NET-1", "Customer", server+"/ip/192.0.2.0/24"),
+				"/ip/192.0.2.0/24": testNetwork("NET-1", "192.0.2.0", "192.0.2.255", "ASSIGNMENT", "NET-1", "Customer", server+"/ip/192.0.2.0/24"),
+			}
+		},
+		"http up link": func(server string) map[string]string {
+			return map[string]string{
+				"/ip/192.0.2.1":    testNetwork("NET-1", "192.0.2.0", "192.0.2.255", "ASSIGNMENT", "", "Customer", strings.Replace(server, "https:", "http:", 1)+"/ip/192.0.0.0/22"),
+				"/ip/192.0.0.0/22": testNetwork("NET-0", "192.0.0.0", "192.0.3.255", "ALLOCATION", "", "RIR", ""),
+			}
+		},
+		"parent smaller": func(server string) map[string]string {
+			return map[string]string{
+				"/ip/192.0.2.1":    testNetwork("NET-1", "192.0.2.0", "192.0.2.255", "ASSIGNMENT", "NET-0", "Customer", ""),
+				"/ip/192.0.2.0/23": testNetwork("NET-2", "192.0.2.0", "192.0.2.127", "ASSIGNMENT", "", "Other", ""),
+			}
+		},
+	}
+
+	for name, networks := range data {
+		resp := hierarchyClient(t, networks).QueryIP(context.Background(), "192.0.2.1")
+		if resp.Error != "" || resp.Handle != "NET-1" {
+			t.Errorf("%s: QueryIP() = %+v, want NET-1", name, resp)
+		}
+		if resp.Hierarchy != nil {
+			t.Errorf("%s: QueryIP() Hierarchy = %s, want none", name, pretty.Sprint(resp.Hierarchy))
+		}
+	}
+}
+
+func TestQueryIPHierarchyLimits(t *testing.T) {
+	// Each network links up to the next larger block, up to the /16.
+	chain := []struct{ path, handle, end, up string }{
+		{"/ip/192.0.2.1", "NET-24", "192.0.2.255", "/ip/192.0.2.0/23"},
+		{"/ip/192.0.2.0/23", "NET-23", "192.0.3.255", "/ip/192.0.0.0/22"},
+		{"/ip/192.0.0.0/22", "NET-22", "192.0.3.255", "/ip/192.0.0.0/21"},
+		{"/ip/192.0.0.0/21", "NET-21", "192.0.7.255", "/ip/192.0.0.0/20"},
+		{"/ip/192.0.0.0/20", "NET-20", "192.0.15.255", "/ip/192.0.0.0/19"},
+		{"/ip/192.0.0.0/19", "NET-19", "192.0.31.255", "/ip/192.0.0.0/18"},
+		{"/ip/192.0.0.0/18", "NET-18", "192.0.63.255", ""},
+	}
+
+	data := []struct {
+		name       string
+		maxParents int
+		timeout    time.Duration
+		delay      time.Duration
+		want       int
+	}{
+		{name: "disabled", maxParents: 0, timeout: time.Second, want: 0},
+		{name: "one parent", maxParents: 1, timeout: time.Second, want: 2},
+		{name: "default", maxParents: MaxParents, timeout: time.Second, want: 6},
+		// Each parent arrives well within the deadline, but not all of them together.
+		{name: "deadline", maxParents: MaxParents, timeout: 250 * time.Millisecond, delay: 100 * time.Millisecond, want: 3},
+	}
+
+	defer func(timeout time.Duration) { HierarchyTimeout = timeout }(HierarchyTimeout)
+
+	for _, test := range data {
+		HierarchyTimeout = test.timeout
+
+		client := hierarchyClient(t, func(server string) map[string]string {
+			time.Sleep(test.delay)
+			networks := map[string]string{}
+			for i, n := range chain {
+				// The first two networks start at the /24, the rest at the /22.
+				start := "192.0.0.0"
+				if i < 2 {
+					start = "192.0.2.0"
+				}
+				up := ""
+				if n.up != "" {
+					up = server + n.up
+				}
+				networks[n.path] = testNetwork(n.handle, start, n.end, "ALLOCATION", "", "RIR", up)
+			}
+			return networks
+		})
+		client.MaxParents = test.maxParents
+
+		resp := client.QueryIP(context.Background(), "192.0.2.1")
+		if resp.Error != "" || resp.Handle != "NET-24" {
+			t.Errorf("%s: QueryIP() = %+v, want NET-24", test.name, resp)
+			continue
+		}
+		if got := len(resp.Hierarchy); got != test.want {
+			t.Errorf("%s: QueryIP() Hierarchy has %d networks, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParentRequest(t *testing.T) {
+	data := []struct {
+		href string
+		want string
+	}{
+		{href: "https://rdap.example.net/ip/192.0.0.0/22", want: "https://rdap.example.net/ip/192.0.0.0/22"},
+		// Anything else is ignored, and without a parent handle, there's no parent.
+		{href: "http://rdap.example.net/ip/192.0.0.0/22", want: ""},
+		{href: "file:///etc/passwd", want: ""},
+		{href: "gopher://rdap.example.net/", want: ""},
+	}
+
+	for _, test := range data {
+		ipNet := &openrdap.IPNetwork{
+			StartAddress: "192.0.2.0",
+			EndAddress:   "192.0.2.255",
+			Links:        []openrdap.Link{{Rel: "up", Href: test.href}},
+		}
+		got := ""
+		if req := parentRequest(ipNet); req != nil {
+			got = req.Server.String()
+		}
+		if got != test.want {
+			t.Errorf("parentRequest(up: %q) = %q, want %q", test.href, got, test.want)
+		}
+	}
+}
+
+func TestCoveringPrefix(t *testing.T) {
+	data := []struct {
+		start, end string
+		want       string
+	}{
+		{start: "192.0.2.0", end: "192.0.2.255", want: "192.0.2.0/24"},
+		{start: "192.0.2.0", end: "192.0.3.127", want: "192.0.2.0/23"},
+		{start: "192.0.2.1", end: "192.0.2.1", want: "192.0.2.1/32"},
+		{start: "0.0.0.0", end: "255.255.255.255", want: "0.0.0.0/0"},
+		{start: "2001:db8::", end: "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", want: "2001:db8::/32"},
+		{start: "192.0.2.0", end: "2001:db8::", want: ""},
+		{start: "bogus", end: "192.0.2.0", want: ""},
+	}
+
+	for _, test := range data {
+		got := ""
+		if p, ok := coveringPrefix(test.start, test.end); ok {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("coveringPrefix(%q, %q) = %q, want %q", test.start, test.end, got, test.want)
+		}
+	}
+}
+
+func TestQueryIPClientTimeout(t *testing.T) {
+	client := hierarchyClient(t, func(string) map[string]string {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	client.client.HTTP.Timeout = 10 * time.Millisecond
+
+	// The client's own timeout, rather than the context's, is still reported as timing out.
+	resp := client.QueryIP(context.Background(), "192.0.2.1")
+	if resp.Error == "" || !resp.TimedOut {
+		t.Errorf("QueryIP() past the client's timeout = %+v, want an Error and TimedOut", resp)
+	}
+}
+
+func TestWithDefaultTimeout(t *testing.T) {
+	// A deadline longer than RDAPTimeout is kept.
+	want := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), want)
+	defer cancel()
+
+	ctx, cancel = withDefaultTimeout(ctx)
+	defer cancel()
+	if got, _ := ctx.Deadline(); !got.Equal(want) {
+		t.Errorf("withDefaultTimeout() deadline = %s, want %s", got, want)
+	}
+
+	ctx, cancel = withDefaultTimeout(context.Background())
+	defer cancel()
+	if got, ok := ctx.Deadline(); !ok || time.Until(got) > RDAPTimeout {
+		t.Errorf("withDefaultTimeout() with no deadline = %s, %t, want within %s", got, ok, RDAPTimeout)
+	}
+}
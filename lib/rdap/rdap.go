@@ -2,21 +2,32 @@ package rdap
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"bramp.net/myip/lib/coalesce"
 	openrdap "github.com/openrdap/rdap"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	// RDAPTimeout is the timeout for RDAP requests.
+	// RDAPTimeout is the timeout for RDAP requests, if the context has no deadline.
 	RDAPTimeout = 10 * time.Second
 )
 
+var (
+	// MaxParents is the most parent networks a Client follows to fill in each Response's
+	// Hierarchy. Zero turns it off.
+	MaxParents = 5
+
+	// HierarchyTimeout is the deadline for fetching all of a network's parents.
+	HierarchyTimeout = RDAPTimeout
+)
+
 // Response contains the RDAP data we send to the user.
 type Response struct {
 	Query string
@@ -45,10 +56,20 @@ type Response struct {
 
 	Entities []Entity `json:",omitempty"`
 
+	// Hierarchy is the chain of networks containing this one, from the RIR's allocation down to
+	// this network, found by following each network's parent. It's empty if there is no parent.
+	Hierarchy []Network `json:",omitempty"`
+
 	// Body is a human-readable text rendering of the RDAP data.
 	Body string `json:",omitempty"`
 
 	Error string `json:",omitempty"`
+
+	// Duration is how long the query took, in milliseconds.
+	Duration int `json:",omitempty"`
+
+	// TimedOut is set if the query was abandoned because the context's deadline passed.
+	TimedOut bool `json:",omitempty"`
 }
 
 // Event represents a dated event (e.g. registration, last changed).
@@ -82,28 +103,87 @@ type Entity struct {
 	Events []Event `json:",omitempty"`
 }
 
-// Client wraps the openrdap client and provides methods for querying IP addresses.
+// Org returns the name of the organisation the network is registered to, falling back to the
+// network's name if there is no registrant.
+func (r *Response) Org() string {
+	if name := registrant(r.Entities); name != "" {
+		return name
+	}
+	return r.Name
+}
+
+// registrant returns the name of the first registrant entity, if any.
+func registrant(entities []Entity) string {
+	for _, e := range entities {
+		for _, role := range e.Roles {
+			if role == "registrant" && e.Name != "" {
+				return e.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Client wraps the openrdap client and provides methods for querying IP addresses and autonomous
+// systems.
 type Client struct {
 	client *openrdap.Client
+
+	// MaxParents is the most parent networks to follow. Defaults to MaxParents.
+	MaxParents int
 }
 
-// NewClient creates a new RDAP client with the given timeout.
+// NewClient creates a new RDAP client with the given timeout, using the DefaultBootstrap. Zero
+// means no timeout, other than the context's.
 func NewClient(timeout time.Duration) *Client {
+	return DefaultBootstrap.NewClient(timeout)
+}
+
+// NewClient creates a new RDAP client with the given timeout, which finds each registry's server
+// using the bootstrap files.
+func (b *Bootstrap) NewClient(timeout time.Duration) *Client {
+	httpClient := &http.Client{
+		Timeout: timeout,
+	}
 	return &Client{
 		client: &openrdap.Client{
-			HTTP: &http.Client{
-				Timeout: timeout,
-			},
+			HTTP:      httpClient,
+			Bootstrap: b.client(httpClient),
 		},
+		MaxParents: MaxParents,
 	}
 }
 
-// QueryIP performs an RDAP lookup for the given IP address and returns a Response.
+// queries coalesces concurrent queries for the same address.
+var queries coalesce.Group[*Response]
+
+// QueryIP performs an RDAP lookup for the given IP address and returns a Response. Concurrent
+// queries for the same address share a single request.
 func (c *Client) QueryIP(ctx context.Context, ipAddr string) *Response {
+	start := time.Now()
+	resp, shared, err := queries.Do(ctx, ipAddr, func(ctx context.Context) (*Response, error) {
+		return c.queryIP(ctx, ipAddr), nil
+	})
+	if err != nil {
+		resp = &Response{
+			Query: ipAddr,
+			Error: err.Error(),
+		}
+	} else if shared {
+		// Give each caller their own copy.
+		r := *resp
+		resp = &r
+	}
+
+	resp.Duration = int(time.Since(start).Milliseconds())
+	resp.TimedOut = resp.Error != "" && (resp.TimedOut || errors.Is(ctx.Err(), context.DeadlineExceeded))
+	return resp
+}
+
+func (c *Client) queryIP(ctx context.Context, ipAddr string) *Response {
 	req := &openrdap.Request{
-		Type:    openrdap.IPRequest,
-		Query:   ipAddr,
-		Timeout: RDAPTimeout,
+		Type:  openrdap.IPRequest,
+		Query: ipAddr,
 	}
 	req = req.WithContext(ctx)
 
@@ -113,8 +193,9 @@ func (c *Client) QueryIP(ctx context.Context, ipAddr string) *Response {
 	if err != nil {
 		log.Warningf("RDAP failed for %q: %s", ipAddr, err)
 		return &Response{
-			Query: ipAddr,
-			Error: err.Error(),
+			Query:    ipAddr,
+			Error:    err.Error(),
+			TimedOut: timedOut(resp, err),
 		}
 	}
 
@@ -127,7 +208,11 @@ func (c *Client) QueryIP(ctx context.Context, ipAddr string) *Response {
 		}
 	}
 
-	return ipNetworkToResponse(ipAddr, ipNet)
+	result := ipNetworkToResponse(ipAddr, ipNet)
+	if result.Hierarchy = c.hierarchy(ctx, ipNet); result.Hierarchy != nil {
+		result.Body = formatTextBody(result)
+	}
+	return result
 }
 
 // ipNetworkToResponse converts an openrdap.IPNetwork to our Response type.
@@ -149,7 +234,7 @@ func ipNetworkToResponse(ipAddr string, ipNet *openrdap.IPNetwork) *Response {
 		Handle:       ipNet.Handle,
 		StartAddress: ipNet.StartAddress,
 		EndAddress:   ipNet.EndAddress,
-		CIDR:         cidrFromRange(ipNet.StartAddress, ipNet.EndAddress),
+		CIDR:         CIDRFromRange(ipNet.StartAddress, ipNet.EndAddress),
 		IPVersion:    ipNet.IPVersion,
 		Country:      ipNet.Country,
 		Type:         ipNet.Type,
@@ -237,9 +322,9 @@ func buildAddress(vc *openrdap.VCard) string {
 	return strings.Join(parts, ", ")
 }
 
-// cidrFromRange attempts to compute CIDR notation from start/end addresses.
+// CIDRFromRange attempts to compute CIDR notation from start/end addresses.
 // Returns empty string if it cannot be computed.
-func cidrFromRange(start, end string) string {
+func CIDRFromRange(start, end string) string {
 	startIP := net.ParseIP(start)
 	endIP := net.ParseIP(end)
 	if startIP == nil || endIP == nil {
@@ -290,6 +375,11 @@ done:
 	return fmt.Sprintf("%s/%d", start, prefixLen)
 }
 
+// Text returns a human-readable text rendering of the response, as used for its Body.
+func (r *Response) Text() string {
+	return formatTextBody(r)
+}
+
 // formatTextBody produces a human-readable text rendering of the RDAP response,
 // similar to what a whois response looks like.
 func formatTextBody(resp *Response) string {
@@ -322,6 +412,8 @@ func formatTextBody(resp *Response) string {
 		writeLine("Link", link)
 	}
 
+	writeHierarchy(&b, resp.Hierarchy)
+
 	for _, r := range resp.Remarks {
 		if r.Title != "" {
 			b.WriteString("\n")
@@ -339,6 +431,42 @@ func formatTextBody(resp *Response) string {
 	return strings.TrimSpace(b.String())
 }
 
+// writeHierarchy writes the networks as a tree, each indented under its parent, e.g.
+//
+//	Hierarchy:
+//	  8.0.0.0/9 LVLT-ORG-8-8 (ALLOCATION, Level 3 Parent, LLC)
+//	    8.8.8.0/24 LVLT-GOGL-8-8-8 (REALLOCATION, Google LLC)
+func writeHierarchy(b *strings.Builder, networks []Network) {
+	if len(networks) == 0 {
+		return
+	}
+
+	b.WriteString("\nHierarchy:\n")
+	for i, n := range networks {
+		block := n.CIDR
+		if block == "" {
+			block = n.StartAddress + " - " + n.EndAddress
+		}
+		name := n.Name
+		if name == "" {
+			name = n.Handle
+		}
+
+		var details []string
+		for _, d := range []string{n.Type, n.Registrant} {
+			if d != "" {
+				details = append(details, d)
+			}
+		}
+
+		fmt.Fprintf(b, "%s%s %s", strings.Repeat("  ", i+1), block, name)
+		if len(details) > 0 {
+			fmt.Fprintf(b, " (%s)", strings.Join(details, ", "))
+		}
+		b.WriteString("\n")
+	}
+}
+
 // writeEntity writes a formatted entity block, recursing into nested entities.
 func writeEntity(b *strings.Builder, e *Entity, indent string) {
 	writeLine := func(key, value string) {
@@ -374,8 +502,41 @@ func writeEntity(b *strings.Builder, e *Entity, indent string) {
 }
 
 // Handle performs an RDAP lookup for the given IP address using a default client.
-// This is the main entry point, matching the signature of the old whois.Handle.
+// This is the main entry point, matching the signature of the old whois.Handle. It takes as long
+// as ctx allows, or if it has no deadline, RDAPTimeout.
 func Handle(ctx context.Context, ipAddr string) *Response {
-	client := NewClient(RDAPTimeout)
-	return client.QueryIP(ctx, ipAddr)
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	return NewClient(0).QueryIP(ctx, ipAddr)
+}
+
+// withDefaultTimeout returns ctx with a deadline of RDAPTimeout, if it doesn't already have one.
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, RDAPTimeout)
+}
+
+// timedOut returns true if the request failed because its deadline passed, or a connection timed
+// out. openrdap only says no server responded, so each server's error is checked too.
+func timedOut(resp *openrdap.Response, err error) bool {
+	if isTimeout(err) {
+		return true
+	}
+	if resp != nil {
+		for _, r := range resp.HTTP {
+			if isTimeout(r.Error) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTimeout returns true if err is from a deadline passing, or a connection timing out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
 }
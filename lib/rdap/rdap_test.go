@@ -1,8 +1,10 @@
 package rdap
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
 	openrdap "github.com/openrdap/rdap"
 )
@@ -261,9 +263,54 @@ func TestCIDRFromRange(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		got := cidrFromRange(tc.start, tc.end)
+		got := CIDRFromRange(tc.start, tc.end)
 		if got != tc.want {
-			t.Errorf("cidrFromRange(%q, %q) = %q, want %q", tc.start, tc.end, got, tc.want)
+			t.Errorf("CIDRFromRange(%q, %q) = %q, want %q", tc.start, tc.end, got, tc.want)
 		}
 	}
 }
+
+func TestOrg(t *testing.T) {
+	data := []struct {
+		resp *Response
+		want string
+	}{
+		{
+			resp: &Response{Name: "GOGL"},
+			want: "GOGL",
+		},
+		{
+			resp: &Response{
+				Name: "GOGL",
+				Entities: []Entity{
+					{Name: "Abuse", Roles: []string{"abuse"}},
+					{Name: "Google LLC", Roles: []string{"registrant"}},
+				},
+			},
+			want: "Google LLC",
+		},
+		{
+			resp: &Response{
+				Name:     "GOGL",
+				Entities: []Entity{{Handle: "GOGL", Roles: []string{"registrant"}}},
+			},
+			want: "GOGL",
+		},
+	}
+
+	for _, test := range data {
+		if got := test.resp.Org(); got != test.want {
+			t.Errorf("Org() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestQueryIPTimedOut(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	resp := NewClient(RDAPTimeout).QueryIP(ctx, "192.0.2.1")
+	if resp.Error == "" || !resp.TimedOut {
+		t.Errorf("QueryIP() with an expired deadline = %+v, want an Error and TimedOut", resp)
+	}
+}
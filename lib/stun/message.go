@@ -0,0 +1,226 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stun implements a STUN (RFC 8489) Binding server, with the RFC 5780 extensions needed to
+// discover a client's NAT mapping and filtering behaviour.
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net/netip"
+)
+
+const (
+	headerLen   = 20
+	magicCookie = 0x2112A442
+	fingerprint = 0x5354554e
+
+	// Message types (method and class).
+	typeBindingRequest = 0x0001
+	typeBindingSuccess = 0x0101
+	typeBindingError   = 0x0111
+
+	// Attribute types.
+	attrMappedAddress     = 0x0001
+	attrChangeRequest     = 0x0003
+	attrUsername          = 0x0006
+	attrMessageIntegrity  = 0x0008
+	attrErrorCode         = 0x0009
+	attrUnknownAttributes = 0x000A
+	attrMessageIntegrity2 = 0x001C
+	attrXORMappedAddress  = 0x0020
+	attrPadding           = 0x0026
+	attrSoftware          = 0x8022
+	attrFingerprint       = 0x8028
+	attrResponseOrigin    = 0x802B
+	attrOtherAddress      = 0x802C
+
+	// Attributes with a type below this must be understood, or the request rejected.
+	comprehensionOptional = 0x8000
+
+	// CHANGE-REQUEST flags.
+	changeIP   = 0x04
+	changePort = 0x02
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+// ErrInvalidMessage is returned when a packet is not a valid STUN message.
+var ErrInvalidMessage = errors.New("stun: invalid message")
+
+// attribute is a single STUN attribute.
+type attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// message is a STUN message.
+type message struct {
+	Type          uint16
+	TransactionID [12]byte
+	Attributes    []attribute
+}
+
+// get returns the value of the first attribute of type t.
+func (m *message) get(t uint16) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// add appends an attribute.
+func (m *message) add(t uint16, value []byte) {
+	m.Attributes = append(m.Attributes, attribute{Type: t, Value: value})
+}
+
+// parseMessage decodes a STUN message.
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < headerLen || b[0]&0xC0 != 0 {
+		return nil, ErrInvalidMessage
+	}
+	if binary.BigEndian.Uint32(b[4:8]) != magicCookie {
+		return nil, ErrInvalidMessage
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length%4 != 0 || headerLen+length != len(b) {
+		return nil, ErrInvalidMessage
+	}
+
+	m := &message{Type: binary.BigEndian.Uint16(b[0:2])}
+	copy(m.TransactionID[:], b[8:20])
+
+	for rest := b[headerLen:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, ErrInvalidMessage
+		}
+		t := binary.BigEndian.Uint16(rest[0:2])
+		l := int(binary.BigEndian.Uint16(rest[2:4]))
+		padded := (l + 3) &^ 3
+		if 4+padded > len(rest) {
+			return nil, ErrInvalidMessage
+		}
+		m.add(t, rest[4:4+l])
+		rest = rest[4+padded:]
+	}
+
+	if value, found := m.get(attrFingerprint); found {
+		// The fingerprint covers everything before it.
+		end := len(b) - 8
+		if len(value) != 4 || m.Attributes[len(m.Attributes)-1].Type != attrFingerprint ||
+			binary.BigEndian.Uint32(value) != crc32.ChecksumIEEE(b[:end])^fingerprint {
+			return nil, ErrInvalidMessage
+		}
+	}
+
+	return m, nil
+}
+
+// marshal encodes the message, appending a FINGERPRINT attribute.
+func (m *message) marshal() []byte {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[0:2], m.Type)
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	copy(b[8:20], m.TransactionID[:])
+
+	for _, a := range m.Attributes {
+		b = appendAttribute(b, a.Type, a.Value)
+	}
+
+	// The length must include the fingerprint, before it is calculated.
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen+8))
+	crc := crc32.ChecksumIEEE(b) ^ fingerprint
+	return appendAttribute(b, attrFingerprint, binary.BigEndian.AppendUint32(nil, crc))
+}
+
+func appendAttribute(b []byte, t uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, t)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// encodeAddress encodes a MAPPED-ADDRESS style attribute value.
+func encodeAddress(addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	family := byte(familyIPv4)
+	if ip.Is6() {
+		family = familyIPv6
+	}
+
+	b := []byte{0, family}
+	b = binary.BigEndian.AppendUint16(b, addr.Port())
+	return append(b, ip.AsSlice()...)
+}
+
+// encodeXORAddress encodes a XOR-MAPPED-ADDRESS attribute value, which is obfuscated so that
+// NATs which rewrite addresses in packets (ALGs) don't break it.
+func encodeXORAddress(addr netip.AddrPort, transactionID [12]byte) []byte {
+	b := encodeAddress(addr)
+	xorAddress(b, transactionID)
+	return b
+}
+
+// decodeXORAddress decodes a XOR-MAPPED-ADDRESS attribute value.
+func decodeXORAddress(value []byte, transactionID [12]byte) (netip.AddrPort, error) {
+	b := append([]byte(nil), value...)
+	if len(b) < 4 {
+		return netip.AddrPort{}, ErrInvalidMessage
+	}
+	xorAddress(b, transactionID)
+	return decodeAddress(b)
+}
+
+// xorAddress XORs the port and address of an encoded address in place.
+func xorAddress(b []byte, transactionID [12]byte) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], transactionID[:])
+
+	b[2] ^= key[0]
+	b[3] ^= key[1]
+	for i := 4; i < len(b) && i-4 < len(key); i++ {
+		b[i] ^= key[i-4]
+	}
+}
+
+// decodeAddress decodes a MAPPED-ADDRESS style attribute value.
+func decodeAddress(b []byte) (netip.AddrPort, error) {
+	if len(b) < 4 {
+		return netip.AddrPort{}, ErrInvalidMessage
+	}
+
+	port := binary.BigEndian.Uint16(b[2:4])
+	switch {
+	case b[1] == familyIPv4 && len(b) == 8:
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), port), nil
+	case b[1] == familyIPv6 && len(b) == 20:
+		return netip.AddrPortFrom(netip.AddrFrom16([16]byte(b[4:20])), port), nil
+	}
+	return netip.AddrPort{}, ErrInvalidMessage
+}
+
+// encodeErrorCode encodes an ERROR-CODE attribute value.
+func encodeErrorCode(code int, reason string) []byte {
+	return append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...)
+}
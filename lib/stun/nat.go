@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import "net/netip"
+
+// NAT behaviours, as defined by RFC 4787 and tested for by RFC 5780. A NAT with
+// address-and-port-dependent mapping is what is commonly called a "symmetric NAT".
+const (
+	Unknown                 = "unknown"
+	EndpointIndependent     = "endpoint-independent"
+	AddressDependent        = "address-dependent"
+	AddressAndPortDependent = "address-and-port-dependent"
+)
+
+// Mapping classifies the NAT's mapping behaviour (RFC 5780 Section 4.3) from the Binding requests
+// a client sent to the different server addresses.
+//
+// A client may have sent requests from many sockets, so rather than trying to pair them up, we
+// look for a mapped address that was seen by every server address. If there is one, that socket
+// was mapped the same regardless of destination. If not, but there is one seen by every port on
+// each server IP, the mapping depends only on the destination address.
+func Mapping(observations []Observation) string {
+	byServer := make(map[netip.AddrPort]map[netip.AddrPort]bool)
+	for _, o := range observations {
+		if byServer[o.Server] == nil {
+			byServer[o.Server] = make(map[netip.AddrPort]bool)
+		}
+		byServer[o.Server][o.Mapped] = true
+	}
+
+	if len(byServer) < 2 {
+		// The client must use at least two of our addresses.
+		return Unknown
+	}
+
+	if len(commonMapped(byServer)) > 0 {
+		return EndpointIndependent
+	}
+
+	byIP := make(map[netip.Addr]map[netip.AddrPort]map[netip.AddrPort]bool)
+	for server, mapped := range byServer {
+		ip := server.Addr()
+		if byIP[ip] == nil {
+			byIP[ip] = make(map[netip.AddrPort]map[netip.AddrPort]bool)
+		}
+		byIP[ip][server] = mapped
+	}
+	if len(byIP) < 2 {
+		// Only the port changed, so we can't tell if the IP matters.
+		return AddressAndPortDependent
+	}
+	for _, servers := range byIP {
+		if len(commonMapped(servers)) == 0 {
+			return AddressAndPortDependent
+		}
+	}
+	return AddressDependent
+}
+
+// commonMapped returns the mapped addresses seen by every server.
+func commonMapped(byServer map[netip.AddrPort]map[netip.AddrPort]bool) []netip.AddrPort {
+	var common []netip.AddrPort
+
+	first := true
+	for _, mapped := range byServer {
+		if first {
+			for m := range mapped {
+				common = append(common, m)
+			}
+			first = false
+			continue
+		}
+
+		kept := common[:0]
+		for _, m := range common {
+			if mapped[m] {
+				kept = append(kept, m)
+			}
+		}
+		common = kept
+	}
+	return common
+}
+
+// Filtering classifies the NAT's filtering behaviour (RFC 5780 Section 4.4) from the results of the
+// client's filtering tests. changedAddrReceived is whether the response to a CHANGE-REQUEST asking
+// to change both IP and port arrived (test II), and changedPortReceived is the same when asking to
+// change only the port (test III). The server can't know if its responses got through, so the client
+// must tell us.
+func Filtering(changedAddrReceived, changedPortReceived bool) string {
+	switch {
+	case changedAddrReceived:
+		return EndpointIndependent
+	case changedPortReceived:
+		return AddressDependent
+	}
+	return AddressAndPortDependent
+}
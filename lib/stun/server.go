@@ -0,0 +1,372 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPort is the standard STUN port.
+	DefaultPort = 3478
+
+	// ObservationTTL is how long each Binding request is remembered for the NAT classification.
+	ObservationTTL = time.Minute
+
+	// maxObservations is the most Binding requests remembered per client address.
+	maxObservations = 32
+
+	// maxClients is the most client addresses remembered.
+	maxClients = 10000
+
+	software = "myip"
+)
+
+// ErrServerClosed is returned by Serve after Close has been called.
+var ErrServerClosed = errors.New("stun: Server closed")
+
+// Observation is a single Binding request received by the server.
+type Observation struct {
+	// Server is the address the request was sent to.
+	Server netip.AddrPort
+
+	// Mapped is the address the request came from, i.e. the client's address on the NAT.
+	Mapped netip.AddrPort
+
+	Time time.Time
+}
+
+// Server is a STUN Binding server. Given an alternate address, it also supports the RFC 5780
+// CHANGE-REQUEST and OTHER-ADDRESS attributes, by listening on every combination of the primary
+// and alternate IPs and ports.
+//
+// Every Binding request is recorded, so the client's NAT mapping behaviour can be classified
+// afterwards with Observations and Mapping.
+type Server struct {
+	primary, alternate netip.AddrPort
+	conns              map[netip.AddrPort]*net.UDPConn
+
+	mu           sync.Mutex
+	observations map[netip.Addr][]Observation
+	closed       bool
+
+	now func() time.Time // for testing
+}
+
+// Listen returns a Server listening on the primary address, and if not empty, the alternate
+// address. The alternate address must have a different IP, port, or both, and if given, both
+// addresses must have an explicit IP so OTHER-ADDRESS can be filled in.
+func Listen(primary, alternate string) (*Server, error) {
+	p, err := parseAddr(primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary address: %s", err)
+	}
+
+	s := &Server{
+		primary:      p,
+		conns:        make(map[netip.AddrPort]*net.UDPConn),
+		observations: make(map[netip.Addr][]Observation),
+	}
+
+	addrs := []netip.AddrPort{p}
+	if alternate != "" {
+		a, err := parseAddr(alternate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alternate address: %s", err)
+		}
+		if p.Addr().IsUnspecified() || a.Addr().IsUnspecified() {
+			return nil, errors.New("primary and alternate addresses must have explicit IPs")
+		}
+		if a == p || a.Addr().Is4() != p.Addr().Is4() {
+			return nil, errors.New("alternate address must be different, and of the same family, as the primary")
+		}
+		s.alternate = a
+
+		addrs = nil
+		for _, ip := range []netip.Addr{p.Addr(), a.Addr()} {
+			for _, port := range []uint16{p.Port(), a.Port()} {
+				addrs = append(addrs, netip.AddrPortFrom(ip, port))
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		if _, found := s.conns[addr]; found {
+			continue
+		}
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns[addr] = conn
+	}
+
+	return s, nil
+}
+
+// parseAddr parses a "host:port" address, where an empty host means all addresses.
+func parseAddr(s string) (netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if host == "" {
+		host = "::"
+	}
+	return netip.ParseAddrPort(net.JoinHostPort(host, port))
+}
+
+// Addrs returns the addresses the server is listening on.
+func (s *Server) Addrs() []netip.AddrPort {
+	var addrs []netip.AddrPort
+	for _, conn := range s.conns {
+		addrs = append(addrs, conn.LocalAddr().(*net.UDPAddr).AddrPort())
+	}
+	return addrs
+}
+
+// Serve answers requests until Close is called, when it returns ErrServerClosed.
+func (s *Server) Serve() error {
+	errs := make(chan error, len(s.conns))
+	for addr, conn := range s.conns {
+		go func() {
+			errs <- s.serve(addr, conn)
+		}()
+	}
+
+	// Wait for all of them, so none are still running when we return.
+	var err error
+	for range s.conns {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) serve(local netip.AddrPort, conn *net.UDPConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		resp, out := s.handle(local, from, buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := s.conns[out].WriteToUDPAddrPort(resp, from); err != nil {
+			log.Debugf("STUN reply to %q failed: %s", from, err)
+		}
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	var err error
+	for _, conn := range s.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// handle processes a single packet received on local from the client, returning the response and
+// which of our addresses it should be sent from, or nil if there is no response.
+func (s *Server) handle(local, from netip.AddrPort, packet []byte) ([]byte, netip.AddrPort) {
+	from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+	req, err := parseMessage(packet)
+	if err != nil || req.Type != typeBindingRequest {
+		// Silently discard anything that isn't a Binding request, including indications.
+		return nil, local
+	}
+
+	resp := &message{
+		Type:          typeBindingSuccess,
+		TransactionID: req.TransactionID,
+	}
+
+	out := local
+	if value, found := req.get(attrChangeRequest); found {
+		if len(value) != 4 {
+			return errorResponse(req, 400, "Bad Request"), local
+		}
+
+		flags := binary.BigEndian.Uint32(value)
+		out = s.changed(local, flags&changeIP != 0, flags&changePort != 0)
+		if _, found := s.conns[out]; !found {
+			// We can't send from the requested address (RFC 5780 Section 6.1).
+			return errorResponse(req, 420, "Unknown Attribute", attrChangeRequest), local
+		}
+	}
+
+	var unknown []uint16
+	for _, a := range req.Attributes {
+		if a.Type >= comprehensionOptional {
+			continue
+		}
+		switch a.Type {
+		case attrChangeRequest, attrUsername, attrMessageIntegrity, attrMessageIntegrity2, attrPadding:
+			// Understood, or safe to ignore as we don't authenticate.
+		default:
+			unknown = append(unknown, a.Type)
+		}
+	}
+	if len(unknown) > 0 {
+		return errorResponse(req, 420, "Unknown Attribute", unknown...), local
+	}
+
+	s.observe(Observation{Server: local, Mapped: from, Time: s.timeNow()})
+
+	resp.add(attrXORMappedAddress, encodeXORAddress(from, req.TransactionID))
+	// For older (RFC 3489) clients.
+	resp.add(attrMappedAddress, encodeAddress(from))
+	if !out.Addr().IsUnspecified() {
+		resp.add(attrResponseOrigin, encodeAddress(out))
+	}
+	if s.alternate.IsValid() {
+		// The alternate address differs in everything it can.
+		otherAddr := s.changed(local, s.primary.Addr() != s.alternate.Addr(), s.primary.Port() != s.alternate.Port())
+		resp.add(attrOtherAddress, encodeAddress(otherAddr))
+	}
+	resp.add(attrSoftware, []byte(software))
+
+	return resp.marshal(), out
+}
+
+// changed returns the address with the IP and/or port switched to the other one, or the zero
+// AddrPort if that's not possible.
+func (s *Server) changed(addr netip.AddrPort, ip, port bool) netip.AddrPort {
+	if (ip || port) && !s.alternate.IsValid() {
+		return netip.AddrPort{}
+	}
+
+	newIP, newPort := addr.Addr(), addr.Port()
+	if ip {
+		if s.primary.Addr() == s.alternate.Addr() {
+			return netip.AddrPort{}
+		}
+		newIP = other(newIP, s.primary.Addr(), s.alternate.Addr())
+	}
+	if port {
+		if s.primary.Port() == s.alternate.Port() {
+			return netip.AddrPort{}
+		}
+		newPort = other(newPort, s.primary.Port(), s.alternate.Port())
+	}
+	return netip.AddrPortFrom(newIP, newPort)
+}
+
+// other returns b if v is a, otherwise a.
+func other[T comparable](v, a, b T) T {
+	if v == a {
+		return b
+	}
+	return a
+}
+
+func errorResponse(req *message, code int, reason string, unknown ...uint16) []byte {
+	resp := &message{
+		Type:          typeBindingError,
+		TransactionID: req.TransactionID,
+	}
+	resp.add(attrErrorCode, encodeErrorCode(code, reason))
+	if len(unknown) > 0 {
+		var value []byte
+		for _, t := range unknown {
+			value = binary.BigEndian.AppendUint16(value, t)
+		}
+		resp.add(attrUnknownAttributes, value)
+	}
+	resp.add(attrSoftware, []byte(software))
+	return resp.marshal()
+}
+
+// observe records a Binding request, dropping any that are too old.
+func (s *Server) observe(o Observation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client := o.Mapped.Addr()
+	if _, found := s.observations[client]; !found && len(s.observations) >= maxClients {
+		s.expire(o.Time)
+		if len(s.observations) >= maxClients {
+			// Under heavy load, just stop recording new clients until the old ones expire.
+			return
+		}
+	}
+
+	obs := append(s.observations[client], o)
+	if len(obs) > maxObservations {
+		obs = obs[len(obs)-maxObservations:]
+	}
+	s.observations[client] = obs
+}
+
+// expire removes the clients with no recent observations. Must be called with the lock held.
+func (s *Server) expire(now time.Time) {
+	for client, obs := range s.observations {
+		if now.Sub(obs[len(obs)-1].Time) > ObservationTTL {
+			delete(s.observations, client)
+		}
+	}
+}
+
+// Observations returns the recent Binding requests received from the client's IP address.
+func (s *Server) Observations(client netip.Addr) []Observation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.timeNow()
+	var recent []Observation
+	for _, o := range s.observations[client.Unmap()] {
+		if now.Sub(o.Time) <= ObservationTTL {
+			recent = append(recent, o)
+		}
+	}
+	return recent
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var transactionID = [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+// bindingRequest returns a Binding request with the given CHANGE-REQUEST flags (if not zero).
+func bindingRequest(change uint32) []byte {
+	req := &message{Type: typeBindingRequest, TransactionID: transactionID}
+	if change != 0 {
+		req.add(attrChangeRequest, binary.BigEndian.AppendUint32(nil, change))
+	}
+	return req.marshal()
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1:54321", "[2001:db8::1]:3478"} {
+		mapped := netip.MustParseAddrPort(addr)
+
+		m := &message{Type: typeBindingSuccess, TransactionID: transactionID}
+		m.add(attrXORMappedAddress, encodeXORAddress(mapped, transactionID))
+		m.add(attrSoftware, []byte("odd length"))
+
+		got, err := parseMessage(m.marshal())
+		if err != nil {
+			t.Fatalf("parseMessage(marshal()) err: %s", err)
+		}
+
+		value, _ := got.get(attrXORMappedAddress)
+		if addr, err := decodeXORAddress(value, got.TransactionID); err != nil || addr != mapped {
+			t.Errorf("XOR-MAPPED-ADDRESS = %s, %v, want %s", addr, err, mapped)
+		}
+		if value, _ := got.get(attrSoftware); string(value) != "odd length" {
+			t.Errorf("SOFTWARE = %q, want %q", value, "odd length")
+		}
+	}
+
+	// A corrupted message fails the fingerprint check.
+	b := bindingRequest(0)
+	b[10] ^= 0xff
+	if _, err := parseMessage(b); err != ErrInvalidMessage {
+		t.Errorf("parseMessage(corrupted) err = %v, want ErrInvalidMessage", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	primary := netip.MustParseAddrPort("192.0.2.1:3478")
+	alternate := netip.MustParseAddrPort("192.0.2.2:3479")
+
+	s := &Server{
+		primary:      primary,
+		alternate:    alternate,
+		observations: make(map[netip.Addr][]Observation),
+		conns: map[netip.AddrPort]*net.UDPConn{
+			primary:   nil,
+			alternate: nil,
+			netip.MustParseAddrPort("192.0.2.1:3479"): nil,
+			netip.MustParseAddrPort("192.0.2.2:3478"): nil,
+		},
+	}
+	client := netip.MustParseAddrPort("198.51.100.1:40000")
+
+	data := []struct {
+		change    uint32
+		wantType  uint16
+		wantOut   string
+		wantOther string
+	}{
+		{change: 0, wantType: typeBindingSuccess, wantOut: "192.0.2.1:3478", wantOther: "192.0.2.2:3479"},
+		{change: changeIP | changePort, wantType: typeBindingSuccess, wantOut: "192.0.2.2:3479", wantOther: "192.0.2.2:3479"},
+		{change: changePort, wantType: typeBindingSuccess, wantOut: "192.0.2.1:3479", wantOther: "192.0.2.2:3479"},
+	}
+
+	for _, test := range data {
+		b, out := s.handle(primary, client, bindingRequest(test.change))
+		resp, err := parseMessage(b)
+		if err != nil {
+			t.Fatalf("handle(change %d) returned invalid message: %s", test.change, err)
+		}
+		if resp.Type != test.wantType {
+			t.Errorf("handle(change %d) type = %#x, want %#x", test.change, resp.Type, test.wantType)
+		}
+		if out.String() != test.wantOut {
+			t.Errorf("handle(change %d) sent from %s, want %s", test.change, out, test.wantOut)
+		}
+
+		value, _ := resp.get(attrXORMappedAddress)
+		if mapped, _ := decodeXORAddress(value, resp.TransactionID); mapped != client {
+			t.Errorf("handle(change %d) XOR-MAPPED-ADDRESS = %s, want %s", test.change, mapped, client)
+		}
+		value, _ = resp.get(attrResponseOrigin)
+		if origin, _ := decodeAddress(value); origin.String() != test.wantOut {
+			t.Errorf("handle(change %d) RESPONSE-ORIGIN = %s, want %s", test.change, origin, test.wantOut)
+		}
+		value, _ = resp.get(attrOtherAddress)
+		if other, _ := decodeAddress(value); other.String() != test.wantOther {
+			t.Errorf("handle(change %d) OTHER-ADDRESS = %s, want %s", test.change, other, test.wantOther)
+		}
+	}
+
+	if got := len(s.Observations(client.Addr())); got != len(data) {
+		t.Errorf("Observations() returned %d, want %d", got, len(data))
+	}
+
+	// Without an alternate address, CHANGE-REQUEST is rejected.
+	s = &Server{primary: primary, observations: make(map[netip.Addr][]Observation)}
+	b, _ := s.handle(primary, client, bindingRequest(changeIP))
+	resp, err := parseMessage(b)
+	if err != nil || resp.Type != typeBindingError {
+		t.Errorf("handle(change without alternate) = %v, %v, want an error response", resp, err)
+	}
+	if value, _ := resp.get(attrErrorCode); len(value) < 4 || value[2] != 4 || value[3] != 20 {
+		t.Errorf("handle(change without alternate) ERROR-CODE = %v, want 420", value)
+	}
+
+	// Anything else is ignored.
+	if b, _ := s.handle(primary, client, []byte("GET / HTTP/1.1\r\n\r\n")); b != nil {
+		t.Errorf("handle(HTTP) = %q, want nil", b)
+	}
+}
+
+func TestMapping(t *testing.T) {
+	a1 := netip.MustParseAddrPort("192.0.2.1:3478")
+	a2 := netip.MustParseAddrPort("192.0.2.1:3479")
+	b1 := netip.MustParseAddrPort("192.0.2.2:3478")
+	b2 := netip.MustParseAddrPort("192.0.2.2:3479")
+
+	m1 := netip.MustParseAddrPort("198.51.100.1:40000")
+	m2 := netip.MustParseAddrPort("198.51.100.1:40001")
+	m3 := netip.MustParseAddrPort("198.51.100.1:40002")
+	m4 := netip.MustParseAddrPort("198.51.100.1:40003")
+
+	data := []struct {
+		name string
+		obs  []Observation
+		want string
+	}{
+		{
+			name: "one server address",
+			obs:  []Observation{{Server: a1, Mapped: m1}},
+			want: Unknown,
+		},
+		{
+			name: "endpoint independent",
+			obs: []Observation{
+				{Server: a1, Mapped: m1}, {Server: b1, Mapped: m1}, {Server: b2, Mapped: m1},
+				// Another socket, only sent to one address.
+				{Server: a1, Mapped: m2},
+			},
+			want: EndpointIndependent,
+		},
+		{
+			name: "address dependent",
+			obs: []Observation{
+				{Server: a1, Mapped: m1}, {Server: a2, Mapped: m1},
+				{Server: b1, Mapped: m2}, {Server: b2, Mapped: m2},
+			},
+			want: AddressDependent,
+		},
+		{
+			name: "symmetric",
+			obs: []Observation{
+				{Server: a1, Mapped: m1}, {Server: a2, Mapped: m2},
+				{Server: b1, Mapped: m3}, {Server: b2, Mapped: m4},
+			},
+			want: AddressAndPortDependent,
+		},
+	}
+
+	for _, test := range data {
+		if got := Mapping(test.obs); got != test.want {
+			t.Errorf("%s: Mapping() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	s, err := Listen("127.0.0.1:0", "")
+	if err != nil {
+		t.Skipf("Unable to listen: %s", err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve()
+	}()
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(s.Addrs()[0]))
+	if err != nil {
+		t.Fatalf("DialUDP() err: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(bindingRequest(0)); err != nil {
+		t.Fatalf("Write() err: %s", err)
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() err: %s", err)
+	}
+
+	resp, err := parseMessage(buf[:n])
+	if err != nil {
+		t.Fatalf("parseMessage() err: %s", err)
+	}
+	value, _ := resp.get(attrXORMappedAddress)
+	want := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	if got, _ := decodeXORAddress(value, resp.TransactionID); got != want {
+		t.Errorf("XOR-MAPPED-ADDRESS = %s, want %s", got, want)
+	}
+
+	s.Close()
+	if err := <-errs; err != ErrServerClosed {
+		t.Errorf("Serve() err = %v, want ErrServerClosed", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whois
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maxCleanupPasses bounds how many times the cleanup is repeated, in case it never settles.
+const maxCleanupPasses = 5
+
+// banners match the start of a line of each registry's legal notices, terms of use, and other
+// boilerplate. The whole block containing the line is removed.
+var banners = regexp.MustCompile(`(?i)^(?:` + strings.Join([]string{
+	// ARIN
+	`# ARIN WHOIS data and services are subject to the Terms of Use`,
+	`# If you see inaccuracies in the results, please`,
+	`# The following results may also be obtained via`,
+
+	// RIPE
+	`% This is the RIPE Database query service`,
+	`% The RIPE Database is subject to Terms and Conditions`,
+	`% Note: this output has been filtered`,
+	`% This query was served by the RIPE Database Query Service`,
+
+	// APNIC
+	`% \[whois\.apnic\.net\]`,
+	`% Whois data copyright terms`,
+	`% This query was served by the APNIC Whois Service`,
+
+	// AFRINIC
+	`% This is the AfriNIC Whois server`,
+	`% The AFRINIC whois database is subject to`,
+
+	// LACNIC
+	`% Joint Whois - whois\.lacnic\.net`,
+	`% Copyright LACNIC`,
+	`% +The use of this information is restricted`,
+	`% whois\.lacnic\.net accepts only direct match queries`,
+
+	// JPNIC
+	`\[ JPNIC database provides information`,
+	`\[ To obtain an English output`,
+
+	// KRNIC
+	`KRNIC is not an ISP`,
+	`- KISA/KRNIC WHOIS Service -$`,
+}, "|") + `)`)
+
+// blockKind is the kind of lines in a block.
+type blockKind int
+
+const (
+	blankBlock blockKind = iota
+	commentBlock
+	textBlock
+)
+
+// block is a run of lines of the same kind.
+type block struct {
+	kind  blockKind
+	lines []string
+}
+
+func lineKind(line string) blockKind {
+	switch {
+	case line == "":
+		return blankBlock
+	case strings.HasPrefix(line, "%"), strings.HasPrefix(line, "#"):
+		return commentBlock
+	}
+	return textBlock
+}
+
+// splitBlocks splits the lines into blocks.
+func splitBlocks(lines []string) []block {
+	var blocks []block
+	for _, line := range lines {
+		kind := lineKind(line)
+		if n := len(blocks); n > 0 && blocks[n-1].kind == kind {
+			blocks[n-1].lines = append(blocks[n-1].lines, line)
+			continue
+		}
+		blocks = append(blocks, block{kind, []string{line}})
+	}
+	return blocks
+}
+
+// cleanupWhois removes the boilerplate from a whois response, so only the interesting parts are
+// shown. It removes each registry's banners, repeated comments (such as ARIN's terms of use, which
+// are at the top and bottom), trailing whitespace, and runs of blank lines.
+//
+// Each pass can expose more to remove (e.g. comments that become repeated once the text between
+// them is removed), so they are repeated until nothing changes.
+func cleanupWhois(response string) string {
+	lines := strings.Split(response, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	for pass := 0; pass < maxCleanupPasses; pass++ {
+		cleaned := cleanupPass(lines)
+		if slices.Equal(cleaned, lines) {
+			break
+		}
+		lines = cleaned
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// cleanupPass does one pass of cleanupWhois, in time linear to the response's length.
+func cleanupPass(lines []string) []string {
+	seen := make(map[string]bool) // Comment blocks already kept
+	cleaned := make([]string, 0, len(lines))
+
+	for _, b := range splitBlocks(lines) {
+		switch b.kind {
+		case blankBlock:
+			// Collapse the run into one line, and drop it at the start.
+			if len(cleaned) > 0 && cleaned[len(cleaned)-1] != "" {
+				cleaned = append(cleaned, "")
+			}
+			continue
+
+		case commentBlock:
+			// Only comments are deduplicated, as the same object may be repeated for a reason, such
+			// as an organisation that holds both of the networks listed.
+			key := strings.Join(b.lines, "\n")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+
+		if slices.ContainsFunc(b.lines, banners.MatchString) {
+			continue
+		}
+		cleaned = append(cleaned, b.lines...)
+	}
+
+	// Drop the run at the end.
+	if n := len(cleaned); n > 0 && cleaned[n-1] == "" {
+		cleaned = cleaned[:n-1]
+	}
+	return cleaned
+}
@@ -0,0 +1,670 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whois
+
+import (
+	"bufio"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"bramp.net/myip/lib/cache"
+	"bramp.net/myip/lib/rdap"
+)
+
+// registryHosts maps each registry's whois server to the registry's name.
+var registryHosts = map[string]string{
+	"whois.arin.net":    "ARIN",
+	"whois.ripe.net":    "RIPE",
+	"whois.apnic.net":   "APNIC",
+	"whois.lacnic.net":  "LACNIC",
+	"whois.afrinic.net": "AFRINIC",
+	"whois.nic.ad.jp":   "JPNIC",
+	"whois.kisa.or.kr":  "KRNIC",
+	"whois.nic.or.kr":   "KRNIC",
+}
+
+// parsers parse the whois responses from each registry.
+var parsers = map[string]func(body string) *rdap.Response{
+	"ARIN":    parseARIN,
+	"RIPE":    parseRPSL,
+	"APNIC":   parseRPSL,
+	"AFRINIC": parseRPSL,
+	"LACNIC":  parseLACNIC,
+	"JPNIC":   parseJPNIC,
+	"KRNIC":   parseKRNIC,
+}
+
+// registry returns the name of the registry that sent the response, from the server it came from,
+// or failing that, the source of its objects. It returns "" if the registry isn't known.
+func registry(host, body string) string {
+	if name, found := registryHosts[strings.ToLower(host)]; found {
+		return name
+	}
+	for _, o := range parseObjects(body) {
+		if source := strings.Fields(o.get("source")); len(source) > 0 {
+			if name := strings.ToUpper(source[0]); parsers[name] != nil {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Parse returns the network registration in a whois response from the server (a host name), in
+// the same shape as an RDAP response. It returns nil if the registry isn't known, or the response
+// doesn't contain a network.
+func Parse(host, query, body string) *rdap.Response {
+	parse, found := parsers[registry(host, body)]
+	if !found {
+		return nil
+	}
+
+	record := parse(body)
+	if record == nil {
+		return nil
+	}
+	record.Query = query
+	record.Port43 = host
+	record.Body = record.Text()
+	return record
+}
+
+// parseHops parses the most specific answer from a known registry.
+func parseHops(query string, hops []Hop) *rdap.Response {
+	for i := len(hops) - 1; i > 0; i-- {
+		srv, ok := parseServer(hops[i].Server)
+		if !ok || srv.rwhois || hops[i].Error != "" {
+			continue
+		}
+		if record := Parse(srv.host, query, hops[i].Body); record != nil {
+			return record
+		}
+	}
+	return nil
+}
+
+// field is a "key: value" line of a whois response.
+type field struct {
+	key, value string
+}
+
+// object is a block of fields, such as a network, organisation or person.
+type object []field
+
+// class returns the (lower cased) key of the object's first field, which names its type in RPSL.
+func (o object) class() string {
+	if len(o) == 0 {
+		return ""
+	}
+	return strings.ToLower(o[0].key)
+}
+
+// get returns the first non-empty value for the key, which isn't case sensitive.
+func (o object) get(key string) string {
+	for _, f := range o {
+		if f.value != "" && strings.EqualFold(f.key, key) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// all returns every non-empty value for the key.
+func (o object) all(key string) []string {
+	var values []string
+	for _, f := range o {
+		if f.value != "" && strings.EqualFold(f.key, key) {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// parseObjects splits a whois response into its objects, which are separated by blank lines.
+// Comments, and lines that aren't "key: value", are skipped.
+func parseObjects(body string) []object {
+	var objects []object
+	var current object
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				objects = append(objects, current)
+				current = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "%") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if key = strings.TrimSpace(key); !found || key == "" || strings.ContainsAny(key, "[]") {
+			continue
+		}
+		current = append(current, field{key, strings.TrimSpace(value)})
+	}
+	if len(current) > 0 {
+		objects = append(objects, current)
+	}
+	return objects
+}
+
+// setRange sets the record's addresses from a network, written either as a range
+// ("192.0.2.0 - 192.0.2.255"), or in CIDR notation. Anything after the network in brackets, such as
+// KRNIC's "(/24)", is ignored. It returns false if the network isn't valid.
+func setRange(resp *rdap.Response, network string) bool {
+	network, _, _ = strings.Cut(network, "(")
+	network = strings.TrimSpace(network)
+
+	var start, end netip.Addr
+	if from, to, found := strings.Cut(network, "-"); found {
+		var err1, err2 error
+		start, err1 = netip.ParseAddr(strings.TrimSpace(from))
+		end, err2 = netip.ParseAddr(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || start.BitLen() != end.BitLen() {
+			return false
+		}
+	} else {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return false
+		}
+		start, end = prefix.Masked().Addr(), cache.LastAddr(prefix)
+	}
+
+	resp.StartAddress, resp.EndAddress = start.String(), end.String()
+	resp.CIDR = rdap.CIDRFromRange(resp.StartAddress, resp.EndAddress)
+	resp.IPVersion = "v4"
+	if start.Is6() {
+		resp.IPVersion = "v6"
+	}
+	return true
+}
+
+// addEvent adds an event to the record, if it has a date.
+func addEvent(resp *rdap.Response, action, date string) {
+	if date != "" {
+		resp.Events = append(resp.Events, rdap.Event{Action: action, Date: date})
+	}
+}
+
+// addRemark adds a remark to the record, if it has a description.
+func addRemark(resp *rdap.Response, title string, description []string) {
+	if len(description) > 0 {
+		resp.Remarks = append(resp.Remarks, rdap.Remark{Title: title, Description: description})
+	}
+}
+
+// entities collects the contacts for a record, merging the roles of contacts with the same handle.
+type entities []rdap.Entity
+
+func (es *entities) add(e rdap.Entity, role string) {
+	if e.Handle == "" && e.Name == "" && e.Email == "" {
+		return
+	}
+	if e.Handle != "" {
+		for i := range *es {
+			if existing := &(*es)[i]; strings.EqualFold(existing.Handle, e.Handle) {
+				if !slices.Contains(existing.Roles, role) {
+					existing.Roles = append(existing.Roles, role)
+				}
+				return
+			}
+		}
+	}
+	e.Roles = []string{role}
+	*es = append(*es, e)
+}
+
+// hasEmail returns true if any entity with the role has an email address.
+func (es entities) hasEmail(role string) bool {
+	for _, e := range es {
+		if e.Email != "" && slices.Contains(e.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// setEmail sets the email address of the first entity with the role, adding one if there's none.
+func (es *entities) setEmail(role, email string) {
+	for i := range *es {
+		if e := &(*es)[i]; slices.Contains(e.Roles, role) {
+			e.Email = email
+			return
+		}
+	}
+	es.add(rdap.Entity{Email: email}, role)
+}
+
+// abuseComment matches RIPE and APNIC's comment naming the abuse contact.
+var abuseComment = regexp.MustCompile(`(?m)^% Abuse contact for '[^']*' is '([^']+)'`)
+
+// parseRPSL parses the RPSL objects returned by RIPE, APNIC and AFRINIC.
+func parseRPSL(body string) *rdap.Response {
+	var network object
+	contacts := make(map[string]object) // By upper cased handle
+
+	for _, o := range parseObjects(body) {
+		switch class := o.class(); class {
+		case "inetnum", "inet6num":
+			if network == nil {
+				network = o
+			}
+		case "organisation", "irt":
+			contacts[strings.ToUpper(o.get(class))] = o
+		case "role", "person":
+			contacts[strings.ToUpper(o.get("nic-hdl"))] = o
+		}
+	}
+	if network == nil {
+		return nil
+	}
+
+	resp := &rdap.Response{
+		Name:         network.get("netname"),
+		Handle:       network[0].value,
+		Country:      network.get("country"),
+		Type:         network.get("status"),
+		ParentHandle: network.get("parent"),
+	}
+	if !setRange(resp, network[0].value) {
+		return nil
+	}
+	addEvent(resp, "registration", network.get("created"))
+	addEvent(resp, "last changed", network.get("last-modified"))
+	addRemark(resp, "description", network.all("descr"))
+	addRemark(resp, "remarks", network.all("remarks"))
+
+	var es entities
+	if handle := network.get("org"); handle != "" {
+		org := contacts[strings.ToUpper(handle)]
+		es.add(rpslEntity(org, handle), "registrant")
+
+		// The organisation's abuse contact applies, unless the network has its own.
+		if network.get("abuse-c") == "" {
+			network = append(network, field{"abuse-c", org.get("abuse-c")})
+		}
+	}
+	addRPSLContacts(&es, network, contacts)
+
+	// RIPE doesn't include the abuse contact's object, only a comment with its address.
+	if m := abuseComment.FindStringSubmatch(body); m != nil && !es.hasEmail("abuse") {
+		es.setEmail("abuse", m[1])
+	}
+
+	resp.Entities = es
+	return resp
+}
+
+// rpslContacts are the network's keys that refer to contacts, and the RDAP role they have.
+var rpslContacts = []struct {
+	key, role string
+}{
+	{"admin-c", "administrative"},
+	{"owner-c", "administrative"}, // LACNIC
+	{"tech-c", "technical"},
+	{"abuse-c", "abuse"},
+	{"mnt-irt", "abuse"}, // APNIC's Incident Response Team
+}
+
+// addRPSLContacts adds the network's contacts, looking up their details by handle.
+func addRPSLContacts(es *entities, network object, contacts map[string]object) {
+	for _, c := range rpslContacts {
+		for _, handle := range network.all(c.key) {
+			es.add(rpslEntity(contacts[strings.ToUpper(handle)], handle), c.role)
+		}
+	}
+}
+
+// rpslEntity returns the entity for an organisation, role, person or irt object, which may be nil
+// if the response didn't include it.
+func rpslEntity(o object, handle string) rdap.Entity {
+	e := rdap.Entity{
+		Handle:  handle,
+		Name:    firstOf(o, "org-name", "role", "person"),
+		Address: strings.Join(trimAll(o.all("address"), " ,-"), ", "),
+		Phone:   o.get("phone"),
+		Fax:     o.get("fax-no"),
+		Email:   firstOf(o, "abuse-mailbox", "e-mail"),
+	}
+	return e
+}
+
+// firstOf returns the value of the first key the object has.
+func firstOf(o object, keys ...string) string {
+	for _, key := range keys {
+		if value := o.get(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// arinContacts are the prefixes of ARIN's point of contact fields, and the RDAP role they have.
+var arinContacts = []struct {
+	prefix, role string
+}{
+	{"OrgAbuse", "abuse"},
+	{"OrgTech", "technical"},
+	{"OrgNOC", "noc"},
+	{"OrgRouting", "routing"},
+	{"RAbuse", "abuse"},
+	{"RTech", "technical"},
+	{"RNOC", "noc"},
+}
+
+// bracketed matches the handle in brackets at the end of ARIN's "Parent" and "Customer" values,
+// e.g. "NET192 (NET-192-0-0-0-0)".
+var bracketed = regexp.MustCompile(`\(([^()]+)\)\s*$`)
+
+// parseARIN parses ARIN's response, which may have several networks, from the least to the most
+// specific, each followed by its organisation (or customer) and contacts.
+func parseARIN(body string) *rdap.Response {
+	objects := parseObjects(body)
+
+	last := -1
+	for i, o := range objects {
+		if o.get("NetRange") != "" {
+			last = i
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	network := objects[last]
+
+	resp := &rdap.Response{
+		Name:   network.get("NetName"),
+		Handle: network.get("NetHandle"),
+		Type:   network.get("NetType"),
+	}
+	if !setRange(resp, network.get("NetRange")) {
+		return nil
+	}
+	if cidr := network.get("CIDR"); cidr != "" {
+		resp.CIDR = cidr // May be a list
+	}
+	if m := bracketed.FindStringSubmatch(network.get("Parent")); m != nil {
+		resp.ParentHandle = m[1]
+	}
+	addEvent(resp, "registration", network.get("RegDate"))
+	addEvent(resp, "last changed", network.get("Updated"))
+	addRemark(resp, "comment", network.all("Comment"))
+
+	var es entities
+	for _, o := range objects[last:] {
+		if name := firstOf(o, "OrgName", "CustName"); name != "" {
+			handle := o.get("OrgId")
+			if m := bracketed.FindStringSubmatch(network.get("Customer")); handle == "" && m != nil {
+				handle = m[1]
+			}
+
+			address := o.all("Address")
+			for _, key := range []string{"City", "StateProv", "PostalCode", "Country"} {
+				if value := o.get(key); value != "" {
+					address = append(address, value)
+				}
+			}
+
+			es.add(rdap.Entity{Handle: handle, Name: name, Address: strings.Join(address, ", ")}, "registrant")
+			resp.Country = o.get("Country")
+		}
+
+		for _, c := range arinContacts {
+			es.add(rdap.Entity{
+				Handle: o.get(c.prefix + "Handle"),
+				Name:   o.get(c.prefix + "Name"),
+				Phone:  o.get(c.prefix + "Phone"),
+				Email:  o.get(c.prefix + "Email"),
+			}, c.role)
+		}
+	}
+
+	resp.Entities = es
+	return resp
+}
+
+// parseLACNIC parses LACNIC's response, which is like RPSL, but names the owner on the network,
+// and its networks don't have names.
+func parseLACNIC(body string) *rdap.Response {
+	var network object
+	contacts := make(map[string]object)
+
+	for _, o := range parseObjects(body) {
+		switch o.class() {
+		case "inetnum", "inet6num":
+			if network == nil {
+				network = o
+			}
+		case "nic-hdl", "nic-hdl-br":
+			contacts[strings.ToUpper(o[0].value)] = o
+		}
+	}
+	if network == nil {
+		return nil
+	}
+
+	resp := &rdap.Response{
+		Handle:  network[0].value,
+		Country: network.get("country"),
+		Type:    network.get("status"),
+	}
+	if !setRange(resp, network[0].value) {
+		return nil
+	}
+	addEvent(resp, "registration", network.get("created"))
+	addEvent(resp, "last changed", network.get("changed"))
+
+	var es entities
+	es.add(rdap.Entity{
+		Handle:  network.get("ownerid"),
+		Name:    network.get("owner"),
+		Address: strings.Join(trimAll(network.all("address"), " ,-"), ", "),
+		Phone:   network.get("phone"),
+	}, "registrant")
+	addRPSLContacts(&es, network, contacts)
+
+	resp.Entities = es
+	return resp
+}
+
+// trimAll trims the cutset from both ends of each value.
+func trimAll(values []string, cutset string) []string {
+	trimmed := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.Trim(v, cutset); v != "" {
+			trimmed = append(trimmed, v)
+		}
+	}
+	return trimmed
+}
+
+// jpnicField matches JPNIC's fields, e.g. "a. [Network Number]  192.0.2.0/24".
+var jpnicField = regexp.MustCompile(`^(?:[a-z]\.\s*)?\[([^\]]+)\]\s*(.*)$`)
+
+// parseJPNIC parses JPNIC's response, in English.
+func parseJPNIC(body string) *rdap.Response {
+	var network object
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Less Specific Info") || strings.HasPrefix(line, "More Specific Info") {
+			break
+		}
+		if m := jpnicField.FindStringSubmatch(line); m != nil {
+			network = append(network, field{m[1], strings.TrimSpace(m[2])})
+		}
+	}
+
+	resp := &rdap.Response{
+		Name:    network.get("Network Name"),
+		Handle:  network.get("Network Number"),
+		Country: "JP",
+	}
+	if !setRange(resp, network.get("Network Number")) {
+		return nil
+	}
+	addEvent(resp, "registration", firstOf(network, "Assigned Date", "Allocated Date"))
+	addEvent(resp, "last changed", network.get("Last Update"))
+
+	var es entities
+	es.add(rdap.Entity{Name: network.get("Organization")}, "registrant")
+	es.add(rdap.Entity{Handle: network.get("Administrative Contact")}, "administrative")
+	es.add(rdap.Entity{Handle: network.get("Technical Contact")}, "technical")
+	es.add(rdap.Entity{Email: network.get("Abuse")}, "abuse")
+
+	resp.Entities = es
+	return resp
+}
+
+// krnicSection is a "[ Title ]" section of KRNIC's response.
+type krnicSection struct {
+	title  string
+	fields object
+}
+
+// parseKRNIC parses the English half of KRNIC's response.
+func parseKRNIC(body string) *rdap.Response {
+	if i := strings.Index(body, "# ENGLISH"); i >= 0 {
+		body = body[i:]
+	}
+
+	var sections []krnicSection
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sections = append(sections, krnicSection{title: strings.TrimSpace(strings.Trim(line, "[]"))})
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if found && len(sections) > 0 {
+			s := &sections[len(sections)-1]
+			s.fields = append(s.fields, field{strings.TrimSpace(key), strings.TrimSpace(value)})
+		}
+	}
+
+	// The ISP's network may be followed by its customer's, which is more specific.
+	last := -1
+	for i, s := range sections {
+		if s.title == "Network Information" {
+			last = i
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	network := sections[last].fields
+
+	resp := &rdap.Response{
+		Name:    network.get("Service Name"),
+		Country: "KR",
+	}
+	resp.Handle = firstOf(network, "IPv4 Address", "IPv6 Address")
+	if !setRange(resp, resp.Handle) {
+		return nil
+	}
+	resp.Handle = resp.StartAddress + " - " + resp.EndAddress
+	addEvent(resp, "registration", network.get("Registration Date"))
+
+	var es entities
+	es.add(rdap.Entity{
+		Name:    network.get("Organization Name"),
+		Address: strings.Join(trimAll([]string{network.get("Address"), network.get("Zip Code")}, " "), ", "),
+	}, "registrant")
+
+	for _, s := range sections[last+1:] {
+		role := ""
+		switch {
+		case strings.Contains(s.title, "Abuse"):
+			role = "abuse"
+		case strings.Contains(s.title, "Technical"):
+			role = "technical"
+		case strings.Contains(s.title, "Admin"):
+			role = "administrative"
+		default:
+			continue
+		}
+		es.add(rdap.Entity{
+			Name:  s.fields.get("Name"),
+			Phone: s.fields.get("Phone"),
+			Email: s.fields.get("E-Mail"),
+		}, role)
+	}
+
+	resp.Entities = es
+	return resp
+}
+
+// FindAbuse returns the abuse contact in a whois response, for when it can't be parsed into a
+// record. In order, it looks for ARIN's OrgAbuseEmail, an RPSL abuse-c (and the object it refers
+// to), any abuse-mailbox, and finally RIPE's abuse comment. It returns nil if there's none.
+func FindAbuse(body string) *rdap.Entity {
+	objects := parseObjects(body)
+	contacts := make(map[string]object) // By upper cased handle
+	for _, o := range objects {
+		if handle := firstOf(o, "nic-hdl", "nic-hdl-br", "irt"); handle != "" {
+			contacts[strings.ToUpper(handle)] = o
+		}
+	}
+
+	for _, o := range objects {
+		for _, prefix := range []string{"OrgAbuse", "RAbuse"} {
+			if email := o.get(prefix + "Email"); email != "" {
+				return &rdap.Entity{
+					Handle: o.get(prefix + "Handle"),
+					Name:   o.get(prefix + "Name"),
+					Roles:  []string{"abuse"},
+					Phone:  o.get(prefix + "Phone"),
+					Email:  email,
+				}
+			}
+		}
+	}
+
+	handle := "" // The abuse-c, in case only the comment has its address
+	for _, o := range objects {
+		for _, h := range o.all("abuse-c") {
+			if e := rpslEntity(contacts[strings.ToUpper(h)], h); e.Email != "" {
+				e.Roles = []string{"abuse"}
+				return &e
+			}
+			if handle == "" {
+				handle = h
+			}
+		}
+	}
+
+	for _, o := range objects {
+		if o.get("abuse-mailbox") != "" {
+			e := rpslEntity(o, firstOf(o, "nic-hdl", "nic-hdl-br", "irt", "organisation"))
+			e.Roles = []string{"abuse"}
+			return &e
+		}
+	}
+
+	if m := abuseComment.FindStringSubmatch(body); m != nil {
+		return &rdap.Entity{Handle: handle, Roles: []string{"abuse"}, Email: m[1]}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whois
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"bramp.net/myip/lib/rdap"
+)
+
+// parsed is the parts of a record that TestParse checks.
+type parsed struct {
+	Name, Handle, CIDR, Country, Type, Parent string
+
+	// Contacts are "handle name <email>" by role.
+	Contacts map[string][]string
+}
+
+func summarise(r *rdap.Response) *parsed {
+	if r == nil {
+		return nil
+	}
+	p := &parsed{
+		Name:     r.Name,
+		Handle:   r.Handle,
+		CIDR:     r.CIDR,
+		Country:  r.Country,
+		Type:     r.Type,
+		Parent:   r.ParentHandle,
+		Contacts: map[string][]string{},
+	}
+	for _, e := range r.Entities {
+		contact := strings.TrimSpace(e.Handle + " " + e.Name)
+		if e.Email != "" {
+			contact = strings.TrimSpace(contact + " <" + e.Email + ">")
+		}
+		for _, role := range e.Roles {
+			p.Contacts[role] = append(p.Contacts[role], contact)
+		}
+	}
+	return p
+}
+
+func TestParse(t *testing.T) {
+	data := []struct {
+		host  string
+		input string
+		want  *parsed
+	}{
+		{
+			host:  "whois.arin.net",
+			input: "arin.txt",
+			want: &parsed{
+				Name: "EXAMPLE-NET-1", Handle: "NET-192-0-2-0-1", CIDR: "192.0.2.0/24", Country: "US",
+				Type: "Reassigned", Parent: "NET-192-0-0-0-0",
+				Contacts: map[string][]string{
+					"registrant": {"C01234567 Example Hosting"},
+					"abuse":      {"ABUSE1234-ARIN Abuse Desk <abuse@example.net>"},
+					"technical":  {"NOC1234-ARIN Network Operations <noc@example.net>"},
+				},
+			},
+		},
+		{
+			host:  "whois.ripe.net",
+			input: "ripe.txt",
+			want: &parsed{
+				Name: "EXAMPLE-NL", Handle: "198.51.100.0 - 198.51.100.255", CIDR: "198.51.100.0/24",
+				Country: "NL", Type: "ASSIGNED PA",
+				Contacts: map[string][]string{
+					"registrant":     {"ORG-EBV1-RIPE Example B.V."},
+					"administrative": {"EX123-RIPE Example NOC"},
+					"technical":      {"EX123-RIPE Example NOC"},
+					"abuse":          {"AR456-RIPE <abuse@example.nl>"}, // From the comment
+				},
+			},
+		},
+		{
+			host:  "whois.apnic.net",
+			input: "apnic.txt",
+			want: &parsed{
+				Name: "EXAMPLE-AU", Handle: "203.0.113.0 - 203.0.113.255", CIDR: "203.0.113.0/24",
+				Country: "AU", Type: "ASSIGNED NON-PORTABLE",
+				Contacts: map[string][]string{
+					"administrative": {"EA1-AP Example Admin <admin@example.au>"},
+					"technical":      {"EA1-AP Example Admin <admin@example.au>"},
+					"abuse":          {"AE1-AP", "IRT-EXAMPLE-AU <irt@example.au>"},
+				},
+			},
+		},
+		{
+			host:  "whois.afrinic.net",
+			input: "afrinic.txt",
+			want: &parsed{
+				Name: "EXAMPLE-ZA-V6", Handle: "2001:db8::/32", CIDR: "2001:db8::/32", Country: "ZA",
+				Type: "ALLOCATED-BY-RIR", Parent: "2001:db8::/12",
+				Contacts: map[string][]string{
+					"registrant":     {"ORG-EN1-AFRINIC Example Networks (Pty) Ltd <abuse@example.co.za>"},
+					"administrative": {"EN1-AFRINIC"},
+					"technical":      {"EN1-AFRINIC"},
+				},
+			},
+		},
+		{
+			host:  "whois.lacnic.net",
+			input: "lacnic.txt",
+			want: &parsed{
+				Handle: "198.51.100.0/22", CIDR: "198.51.100.0/22", Country: "AR", Type: "allocated",
+				Contacts: map[string][]string{
+					"registrant":     {"AR-EJSA-LACNIC Ejemplo S.A."},
+					"administrative": {"JUP Juan Perez <noc@ejemplo.ar>"},
+					"technical":      {"JUP Juan Perez <noc@ejemplo.ar>"},
+					"abuse":          {"ABE Abuse Ejemplo <abuse@ejemplo.ar>"},
+				},
+			},
+		},
+		{
+			host:  "whois.nic.ad.jp",
+			input: "jpnic.txt",
+			want: &parsed{
+				Name: "EXAMPLE-JP-NET", Handle: "192.0.2.0/24", CIDR: "192.0.2.0/24", Country: "JP",
+				Contacts: map[string][]string{
+					"registrant":     {"Example K.K."},
+					"administrative": {"EK001JP"},
+					"technical":      {"EK002JP"},
+				},
+			},
+		},
+		{
+			host:  "whois.kisa.or.kr",
+			input: "krnic.txt",
+			want: &parsed{
+				Name: "EXAMPLENET", Handle: "198.51.100.0 - 198.51.100.255", CIDR: "198.51.100.0/24",
+				Country: "KR",
+				Contacts: map[string][]string{
+					"registrant": {"Example Co., Ltd."},
+					"technical":  {"IP Manager <ip@example.kr>"},
+					"abuse":      {"Abuse Manager <abuse@example.kr>"},
+				},
+			},
+		},
+		{
+			// The registry is found from the objects' source.
+			host:  "rr.example.net",
+			input: "ripe.txt",
+			want: &parsed{
+				Name: "EXAMPLE-NL", Handle: "198.51.100.0 - 198.51.100.255", CIDR: "198.51.100.0/24",
+				Country: "NL", Type: "ASSIGNED PA",
+				Contacts: map[string][]string{
+					"registrant":     {"ORG-EBV1-RIPE Example B.V."},
+					"administrative": {"EX123-RIPE Example NOC"},
+					"technical":      {"EX123-RIPE Example NOC"},
+					"abuse":          {"AR456-RIPE <abuse@example.nl>"},
+				},
+			},
+		},
+		{
+			// IANA's answer isn't a network.
+			host:  "whois.iana.org",
+			input: "../whois-1.txt",
+			want:  nil,
+		},
+	}
+
+	for _, test := range data {
+		input, err := os.ReadFile(path.Join("testdata", "parse", test.input))
+		if err != nil {
+			t.Fatalf("Failed to read test data %q: %s", test.input, err)
+		}
+
+		got := Parse(test.host, "192.0.2.1", string(input))
+		if diff := pretty.Compare(summarise(got), test.want); diff != "" {
+			t.Errorf("Parse(%q, %q) = -got +want:\n%s", test.host, test.input, diff)
+		}
+
+		// The hops' bodies are cleaned before they're parsed, which mustn't lose anything.
+		cleaned := Parse(test.host, "192.0.2.1", cleanupWhois(string(input)))
+		if diff := pretty.Compare(summarise(cleaned), test.want); diff != "" {
+			t.Errorf("Parse(%q, cleanupWhois(%q)) = -got +want:\n%s", test.host, test.input, diff)
+		}
+		if got != nil && (got.Port43 != test.host || got.Body == "") {
+			t.Errorf("Parse(%q, %q) = {Port43: %q, Body: %q}, want the host and a body", test.host, test.input, got.Port43, got.Body)
+		}
+	}
+}
+
+func TestFindAbuse(t *testing.T) {
+	data := []struct {
+		input string
+		want  *rdap.Entity
+	}{
+		{input: "arin.txt", want: &rdap.Entity{Handle: "ABUSE1234-ARIN", Name: "Abuse Desk", Roles: []string{"abuse"}, Phone: "+1-555-555-0100", Email: "abuse@example.net"}},
+		{input: "ripe.txt", want: &rdap.Entity{Handle: "AR456-RIPE", Roles: []string{"abuse"}, Email: "abuse@example.nl"}}, // From the comment
+		{input: "apnic.txt", want: &rdap.Entity{Handle: "IRT-EXAMPLE-AU", Roles: []string{"abuse"}, Address: "1 Example Road, Sydney", Email: "irt@example.au"}},
+		{input: "lacnic.txt", want: &rdap.Entity{Handle: "ABE", Name: "Abuse Ejemplo", Roles: []string{"abuse"}, Address: "Avenida Ejemplo, 100", Email: "abuse@ejemplo.ar"}},
+		{input: "jpnic.txt", want: nil},
+	}
+
+	for _, test := range data {
+		input, err := os.ReadFile(path.Join("testdata", "parse", test.input))
+		if err != nil {
+			t.Fatalf("Failed to read test data %q: %s", test.input, err)
+		}
+
+		if diff := pretty.Compare(FindAbuse(string(input)), test.want); diff != "" {
+			t.Errorf("FindAbuse(%q) diff (-got +want)\n%s", test.input, diff)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whois
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	whoisPort  = "43"
+	rwhoisPort = "4321"
+
+	// maxRWhoisResponse is the most bytes read from a RWhois server.
+	maxRWhoisResponse = 1 << 20
+)
+
+// Hop is the answer from one server in the chain of referrals.
+type Hop struct {
+	Server string // e.g. "whois://whois.arin.net" or "rwhois://rwhois.example.net:4321"
+
+	// One of the following
+	Body  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// server is a WHOIS, or RWhois, server.
+type server struct {
+	rwhois bool
+	host   string
+	port   string
+}
+
+// parseServer parses a referral, which is either a bare host name, or a whois:// or rwhois:// URL.
+// As referrals come from untrusted responses, only the standard WHOIS and RWhois ports are
+// allowed, and addresses that aren't public are refused.
+func parseServer(s string) (server, bool) {
+	if !strings.Contains(s, "://") {
+		if s == "" || strings.ContainsAny(s, " /") {
+			return server{}, false
+		}
+		return checkServer(server{host: strings.ToLower(s), port: whoisPort})
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Hostname() == "" {
+		return server{}, false
+	}
+
+	srv := server{host: strings.ToLower(u.Hostname()), port: u.Port()}
+	switch strings.ToLower(u.Scheme) {
+	case "whois":
+		if srv.port == "" {
+			srv.port = whoisPort
+		}
+	case "rwhois":
+		srv.rwhois = true
+		if srv.port == "" {
+			srv.port = rwhoisPort
+		}
+	default:
+		return server{}, false
+	}
+	return checkServer(srv)
+}
+
+// checkServer returns the server, and true if it's on a standard port, and isn't an address that
+// isn't public. Host names are checked once resolved, when connecting.
+func checkServer(srv server) (server, bool) {
+	if srv.port != whoisPort && srv.port != rwhoisPort {
+		return server{}, false
+	}
+	if addr, err := netip.ParseAddr(srv.host); err == nil && !isPublic(addr) {
+		return server{}, false
+	}
+	return srv, true
+}
+
+// String returns the server as a URL, omitting the port if it's the default.
+func (s server) String() string {
+	scheme, port := "whois", whoisPort
+	if s.rwhois {
+		scheme, port = "rwhois", rwhoisPort
+	}
+	if s.port == port {
+		return scheme + "://" + s.host
+	}
+	return scheme + "://" + net.JoinHostPort(s.host, s.port)
+}
+
+// referralKeys are the (lower cased) keys of the fields that refer to another server. IANA uses
+// "refer" and "whois", ARIN uses "ReferralServer", and RWhois servers use a "Referral" attribute,
+// e.g. "network:Referral:rwhois://rwhois.example.net:4321".
+var referralKeys = map[string]bool{
+	"refer":          true,
+	"whois":          true,
+	"referralserver": true,
+	"referral":       true,
+}
+
+// referral returns the first server the response refers to, if any. RWhois servers also refer
+// with "%referral" lines (RFC 2167), e.g. "%referral rwhois://rwhois.example.net:4321/auth-area=.".
+func referral(response string) (server, bool) {
+	scanner := bufio.NewScanner(strings.NewReader(response))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, found := strings.CutPrefix(line, "%referral "); found {
+			if srv, ok := parseServer(strings.TrimSpace(value)); ok {
+				return srv, true
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		if class := strings.TrimSpace(key); !strings.ContainsAny(class, " %") {
+			// An RWhois attribute, "class:attribute:value".
+			if attr, v, ok := strings.Cut(value, ":"); ok && strings.EqualFold(attr, "referral") {
+				key, value = attr, v
+			}
+		}
+		if !referralKeys[strings.ToLower(strings.TrimSpace(key))] {
+			continue
+		}
+		if srv, ok := parseServer(strings.TrimSpace(value)); ok {
+			return srv, true
+		}
+	}
+	return server{}, false
+}
+
+// QueryIP asks IANA which whois server is responsible for the address, then follows the referrals
+// from there, up to MaxReferrals, returning each server's answer. A referral back to a server
+// already asked ends the chain.
+//
+// An error is returned if IANA or the server it refers to fail, but not if any later server does,
+// as the earlier answer is still useful.
+func (c *Client) QueryIP(ctx context.Context, ipAddr string) ([]Hop, error) {
+	maxReferrals := c.MaxReferrals
+	if maxReferrals == 0 {
+		maxReferrals = DefaultMaxReferrals
+	}
+
+	next := server{host: ianaWhoisServer, port: whoisPort}
+	seen := make(map[server]bool)
+	var hops []Hop
+
+	for referrals := 0; ; referrals++ {
+		seen[next] = true
+
+		body, err := c.queryServer(ctx, ipAddr, next)
+		hops = append(hops, Hop{Server: next.String(), Body: cleanupWhois(body)})
+		if err != nil {
+			hops[len(hops)-1].Error = err.Error()
+			if referrals <= 1 {
+				return hops, err
+			}
+			return hops, nil
+		}
+
+		ref, found := referral(body)
+		switch {
+		case !found:
+			if referrals == 0 {
+				return hops, fmt.Errorf("no whois server found for %q", ipAddr)
+			}
+			return hops, nil
+
+		case seen[ref]:
+			log.Infof("Whois referral loop for %q back to %q", ipAddr, ref)
+			return hops, nil
+
+		case referrals >= maxReferrals:
+			log.Infof("Whois for %q not following referral to %q, after %d referrals", ipAddr, ref, referrals)
+			return hops, nil
+		}
+		next = ref
+	}
+}
+
+// queryServer queries the server, with whichever protocol it speaks.
+func (c *Client) queryServer(ctx context.Context, query string, srv server) (string, error) {
+	if srv.rwhois {
+		return c.QueryRWhois(ctx, query, net.JoinHostPort(srv.host, srv.port))
+	}
+	return c.Query(ctx, query, net.JoinHostPort(srv.host, srv.port))
+}
+
+// QueryRWhois issues a Referral Whois (RFC 2167) query to the address (host:port). The server's
+// banner, and the status line it ends the response with, are not included in the result.
+func (c *Client) QueryRWhois(ctx context.Context, query, address string) (string, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	log.Infof("RWhois request %q from %q", query, address)
+
+	body, err := c.queryRWhois(ctx, query, address)
+	if err != nil {
+		err = contextError(ctx, err)
+		log.Warningf("RWhois failed %q from %q: %s", query, address, err)
+		return body, err
+	}
+
+	log.Infof("RWhois response %q from %q:\n%s", query, address, body)
+	return body, nil
+}
+
+func (c *Client) queryRWhois(ctx context.Context, query, address string) (string, error) {
+	conn, err := c.dial(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(io.LimitReader(conn, maxRWhoisResponse))
+
+	// The server starts by announcing itself, e.g. "%rwhois V-1.5:003fff:00 rwhois.example.net".
+	banner, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(banner, "%rwhois") {
+		return "", errors.New("not a rwhois server")
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\r\n", query); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		switch trimmed := strings.TrimSpace(line); {
+		case strings.HasPrefix(trimmed, "%ok"):
+			return b.String(), nil
+		case strings.HasPrefix(trimmed, "%error"):
+			return b.String(), fmt.Errorf("rwhois: %s", strings.TrimSpace(strings.TrimPrefix(trimmed, "%error")))
+		}
+		b.WriteString(line)
+
+		if err == io.EOF {
+			// Some servers just hang up, rather than sending %ok.
+			return b.String(), nil
+		}
+		if err != nil {
+			return b.String(), err
+		}
+	}
+}
+
+// mostSpecific returns the body from the last server to answer, after IANA. IANA's own answer is
+// only returned if it didn't refer to anyone.
+func mostSpecific(hops []Hop) string {
+	if i := mostSpecificHop(hops); i >= 0 {
+		return hops[i].Body
+	}
+	return ""
+}
+
+// mostSpecificHop returns the index of the hop mostSpecific uses, or -1 if there isn't one.
+func mostSpecificHop(hops []Hop) int {
+	for i := len(hops) - 1; i > 0; i-- {
+		if hops[i].Error == "" && hops[i].Body != "" {
+			return i
+		}
+	}
+	if len(hops) == 1 {
+		return 0
+	}
+	return -1
+}
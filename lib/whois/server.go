@@ -0,0 +1,235 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whois
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"bramp.net/myip/lib/dns"
+	"bramp.net/myip/lib/rdap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ServerTimeout is how long a client has to send their query, and for us to answer it.
+	ServerTimeout = 30 * time.Second
+
+	// maxQueryLen is the longest query line we accept.
+	maxQueryLen = 256
+)
+
+// ErrServerClosed is returned by Serve after Close has been called.
+var ErrServerClosed = errors.New("whois: Server closed")
+
+// These are variables so they can be replaced in tests.
+var (
+	lookupAddr = dns.LookupAddr
+	queryRDAP  = rdap.Handle
+)
+
+// Server is a WHOIS (RFC 3912) server that tells clients their own IP address. The query "me"
+// (or an empty query) looks up the client's address, and any other IP address looks up that
+// address instead.
+//
+//	$ whois -h ip.example.net me
+type Server struct {
+	// Timeout is how long each connection may take. Defaults to ServerTimeout.
+	Timeout time.Duration
+
+	// Lookup, if set, returns the reverse DNS names and RDAP response for ip, queried by client,
+	// so the caller can rate limit and cache lookups. If it returns an error, that's sent to the
+	// client instead. If nil, the lookups are done directly.
+	Lookup func(ctx context.Context, client, ip string) ([]string, *rdap.Response, error)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// Serve accepts connections on the listener, answering one query per connection. It always
+// returns a non-nil error, ErrServerClosed after Close has been called.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops all listeners. Queries already in progress are allowed to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// handle answers a single query, and closes the connection.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = ServerTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	query, err := readQuery(conn)
+	if err != nil {
+		log.Debugf("Whois server failed to read query from %q: %s", client, err)
+		return
+	}
+
+	log.Infof("Whois server query %q from %q", query, client)
+
+	io.WriteString(conn, s.response(ctx, query, client))
+}
+
+// readQuery reads a single CRLF terminated query line. Some clients only send a LF, or close
+// the connection without one, so we accept those too.
+func readQuery(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(io.LimitReader(r, maxQueryLen)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if err == io.EOF && len(line) == maxQueryLen {
+		return "", errors.New("query too long")
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// response builds the reply to the query sent by client.
+func (s *Server) response(ctx context.Context, query, client string) string {
+	var b strings.Builder
+
+	b.WriteString("% myip WHOIS server\n")
+	b.WriteString("% Query \"me\" for your own IP address, or any IP address to look it up.\n\n")
+
+	ip := client
+	if query != "" && !strings.EqualFold(query, "me") {
+		addr, err := netip.ParseAddr(query)
+		if err != nil {
+			fmt.Fprintf(&b, "%% Error: %q is not an IP address\n", query)
+			return b.String()
+		}
+		ip = addr.Unmap().String()
+	}
+
+	lookup := s.Lookup
+	if lookup == nil {
+		lookup = directLookup
+	}
+	names, rdapResp, err := lookup(ctx, client, ip)
+	if err != nil {
+		fmt.Fprintf(&b, "%% Error: %s\n", err)
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "%-16s %s\n", "IP:", ip)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%-16s %s\n", "Reverse:", name)
+	}
+
+	if rdapResp != nil {
+		if rdapResp.Body != "" {
+			b.WriteString("\n" + rdapResp.Body + "\n")
+		} else if rdapResp.Error != "" {
+			fmt.Fprintf(&b, "\n%% RDAP error: %s\n", rdapResp.Error)
+		}
+	}
+
+	return b.String()
+}
+
+// directLookup does the reverse DNS and RDAP lookups for ip in parallel, without any limits.
+func directLookup(ctx context.Context, _, ip string) ([]string, *rdap.Response, error) {
+	var names []string
+	var rdapResp *rdap.Response
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		names, _ = lookupAddr(ctx, ip)
+	}()
+	go func() {
+		defer wg.Done()
+		rdapResp = queryRDAP(ctx, ip)
+	}()
+	wg.Wait()
+
+	return names, rdapResp, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whois
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"bramp.net/myip/lib/rdap"
+)
+
+// fakeLookups replaces the DNS and RDAP lookups for the duration of the test.
+func fakeLookups(t *testing.T) {
+	oldLookupAddr, oldQueryRDAP := lookupAddr, queryRDAP
+	t.Cleanup(func() {
+		lookupAddr, queryRDAP = oldLookupAddr, oldQueryRDAP
+	})
+
+	lookupAddr = func(ctx context.Context, ip string) ([]string, error) {
+		if ip == "8.8.8.8" {
+			return []string{"dns.google."}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	queryRDAP = func(ctx context.Context, ip string) *rdap.Response {
+		if ip == "8.8.8.8" {
+			return &rdap.Response{Query: ip, Body: "Name:            GOGL"}
+		}
+		return &rdap.Response{Query: ip, Error: "not found"}
+	}
+}
+
+func TestServerResponse(t *testing.T) {
+	fakeLookups(t)
+
+	data := []struct {
+		query string
+		want  []string
+	}{
+		{query: "", want: []string{"IP:              127.0.0.1\n", "% RDAP error: not found\n"}},
+		{query: "me", want: []string{"IP:              127.0.0.1\n"}},
+		{query: "ME", want: []string{"IP:              127.0.0.1\n"}},
+		{query: "8.8.8.8", want: []string{"IP:              8.8.8.8\nReverse:         dns.google.\n\nName:            GOGL\n"}},
+		{query: "::ffff:8.8.8.8", want: []string{"IP:              8.8.8.8\n"}},
+		{query: "example.com", want: []string{`% Error: "example.com" is not an IP address`}},
+	}
+
+	for _, test := range data {
+		got := (&Server{}).response(context.Background(), test.query, "127.0.0.1")
+		for _, want := range test.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("response(%q) = %q, want it to contain %q", test.query, got, want)
+			}
+		}
+	}
+}
+
+func TestServerLookup(t *testing.T) {
+	var gotClient, gotIP string
+	s := &Server{
+		Lookup: func(_ context.Context, client, ip string) ([]string, *rdap.Response, error) {
+			gotClient, gotIP = client, ip
+			if ip != client {
+				return nil, nil, errors.New("too many lookups")
+			}
+			return []string{"host.example.com."}, &rdap.Response{Body: "Name:            EXAMPLE"}, nil
+		},
+	}
+
+	got := s.response(context.Background(), "me", "192.0.2.1")
+	if want := "IP:              192.0.2.1\nReverse:         host.example.com.\n\nName:            EXAMPLE\n"; !strings.Contains(got, want) {
+		t.Errorf("response(me) = %q, want it to contain %q", got, want)
+	}
+
+	got = s.response(context.Background(), "8.8.8.8", "192.0.2.1")
+	if want := "% Error: too many lookups\n"; !strings.Contains(got, want) || strings.Contains(got, "IP:") {
+		t.Errorf("response(8.8.8.8) = %q, want only %q", got, want)
+	}
+	if gotClient != "192.0.2.1" || gotIP != "8.8.8.8" {
+		t.Errorf("Lookup(%q, %q), want Lookup(%q, %q)", gotClient, gotIP, "192.0.2.1", "8.8.8.8")
+	}
+}
+
+func TestReadQuery(t *testing.T) {
+	data := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "me\r\n", want: "me"},
+		{input: "8.8.8.8\n", want: "8.8.8.8"},
+		{input: "8.8.8.8", want: "8.8.8.8"},
+		{input: "", want: ""},
+		{input: "me\r\nignored\r\n", want: "me"},
+		{input: strings.Repeat("A", 1000), wantErr: true},
+	}
+
+	for _, test := range data {
+		got, err := readQuery(strings.NewReader(test.input))
+		if (err != nil) != test.wantErr {
+			t.Errorf("readQuery(%q) err = %v, want error %t", test.input, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("readQuery(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	fakeLookups(t)
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Unable to listen: %s", err)
+	}
+
+	s := &Server{}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(ln)
+	}()
+
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() err: %s", err)
+	}
+	io.WriteString(conn, "me\r\n")
+
+	got, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Errorf("ReadAll() err: %s", err)
+	}
+	if want := "IP:              127.0.0.1\n"; !strings.Contains(string(got), want) {
+		t.Errorf("Server response = %q, want it to contain %q", got, want)
+	}
+
+	s.Close()
+	if err := <-errs; err != ErrServerClosed {
+		t.Errorf("Serve() err = %v, want ErrServerClosed", err)
+	}
+}
@@ -15,25 +15,30 @@
 package whois
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
 	"time"
 
+	"bramp.net/myip/lib/coalesce"
+	"bramp.net/myip/lib/rdap"
 	domainr "github.com/domainr/whois"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	// TODO Strip the ':' from the key
-	whoisKey = "whois:"
-
 	// ianaWhoisServer is the address of the Internet Assigned Numbers Authority whois server.
 	ianaWhoisServer = "whois.iana.org"
 
-	// WhoisTimeout is the dial/read timeout for the whois requests.
+	// WhoisTimeout is the timeout for each whois request, if the context has no deadline.
 	WhoisTimeout = 10 * time.Second
+
+	// DefaultMaxReferrals is how many referrals are followed after asking IANA, if not configured.
+	DefaultMaxReferrals = 3
 )
 
 // Response contains the Whois data we send to the user.
@@ -43,111 +48,142 @@ type Response struct {
 	// One of the following
 	Body  string `json:",omitempty"`
 	Error string `json:",omitempty"`
-}
 
-// parseWhois takes a whois response, and splits it into key-value pairs, so fields can easily
-// be extracted.
-func parseWhois(response string) (map[string]string, error) {
-	m := map[string]string{}
+	// Hops are the servers asked, starting with IANA, and following each referral. Body is from
+	// the last one to answer, which has the most specific registration.
+	Hops []Hop `json:",omitempty"`
 
-	scanner := bufio.NewScanner(strings.NewReader(response))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "%") {
-			continue
-		}
+	// Record is the network's registration parsed from Body, if the registry's format is known.
+	Record *rdap.Response `json:",omitempty"`
 
-		row := strings.Fields(line)
-		if len(row) >= 2 {
-			m[row[0]] = row[1]
-		}
-	}
+	// Duration is how long the queries took, in milliseconds.
+	Duration int `json:",omitempty"`
 
-	return m, scanner.Err()
+	// TimedOut is set if the queries were abandoned because the context's deadline passed.
+	TimedOut bool `json:",omitempty"`
 }
 
-// longestCommonString searches the slice (element by element) to find any repeated data, and
-// returns the start/end postition of the 2nd occurence of the largest common area.
-// Runs in O(n^2) time
-//
-// This implementation was adapted from:
-//
-//		 https://en.wikibooks.org/wiki/Algorithm_Implementation/Strings/Longest_common_substring
-//	  Under the Creative Commons Attribution-ShareAlike License.
-func longestCommonString(lines []string) (int, int) {
-
-	// Matrix to keep track of the longest match found starting on each line
-	var m = make([][]int, 1+len(lines))
-	for i := 0; i < len(m); i++ {
-		m[i] = make([]int, 1+len(lines))
-	}
-
-	longest := 0
-	yLongest := 0
-	for x := 1; x < 1+len(lines); x++ {
-		for y := x + 1; y < 1+len(lines); y++ {
-			if lines[x-1] == lines[y-1] {
-				m[x][y] = m[x-1][y-1] + 1
-				if m[x][y] > longest {
-					longest = m[x][y]
-					yLongest = y
-				}
-			}
-		}
+// Source returns the server Body came from, e.g. "whois://whois.arin.net", or "" if it's not known.
+func (r *Response) Source() string {
+	if i := mostSpecificHop(r.Hops); i >= 0 {
+		return r.Hops[i].Server
 	}
+	return ""
+}
 
-	return yLongest - longest, yLongest
+// Handle generates a whois.Response
+func Handle(ctx context.Context, ipAddr string) *Response {
+	start := time.Now()
+	hops, err := QueryIPWhois(ctx, ipAddr)
+	resp := &Response{
+		Query:    ipAddr,
+		Body:     mostSpecific(hops),
+		Hops:     hops,
+		Record:   parseHops(ipAddr, hops),
+		Duration: int(time.Since(start).Milliseconds()),
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.TimedOut = errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded)
+	}
+
+	return resp
 }
 
-// cleanupWhois trims whitespace, and excessive (but useless) text from the whois response
-func cleanupWhois(response string) string {
-	lines := []string{}
+// ErrCanceled is returned when a query is abandoned because its context was canceled, for
+// example because the client that wanted it went away.
+var ErrCanceled = errors.New("whois query canceled")
 
-	scanner := bufio.NewScanner(strings.NewReader(response))
-	for scanner.Scan() {
-		line := scanner.Text()
-		lines = append(lines, line)
-	}
+// Dialer makes the connections to WHOIS servers. It's implemented by *net.Dialer, and by the SOCKS
+// dialers from golang.org/x/net/proxy.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
 
-	if scanner.Err() == nil {
-		// TODO Repeat this multiple times, until there is no change.
+// Client issues WHOIS queries.
+type Client struct {
+	// Dialer connects to the servers. Defaults to a net.Dialer that refuses to connect to
+	// loopback, private, link-local or unspecified addresses, as referrals come from untrusted
+	// responses, and mustn't be able to reach internal networks.
+	Dialer Dialer
 
-		// If we parsed successfully we now try and dedup data in the string.
-		// A good example of this, is that ARIN puts the same copyright header at the top and
-		// bottom. Thus we can remove the bottom occurence.
-		start, end := longestCommonString(lines)
+	// Timeout is the most time each query may take. If zero, the context's deadline is used, or if
+	// it has none, WhoisTimeout.
+	Timeout time.Duration
 
-		// Only delete if there is multiple lines of dup
-		if end-start > 3 {
-			response = ""
-			for i, line := range lines {
-				if i < start || i > end {
-					response += line + "\n"
-				}
-			}
-		}
+	// MaxReferrals is how many referrals QueryIP follows after asking IANA. Defaults to
+	// DefaultMaxReferrals, and a negative number only asks IANA.
+	MaxReferrals int
+}
+
+// DefaultClient is the Client used by the package's functions.
+var DefaultClient = &Client{}
+
+// dial connects to the server, and makes sure any read or write on the connection is interrupted
+// once ctx is done, as domainr only honours the context's deadline.
+func (c *Client) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer Dialer = &net.Dialer{Control: publicOnly}
+	if c.Dialer != nil {
+		dialer = c.Dialer
 	}
 
-	return strings.TrimSpace(response)
-}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
 
-// Handle generates a whois.Response
-func Handle(ctx context.Context, ipAddr string) *Response {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return &stoppableConn{Conn: conn, stop: stop}, nil
+}
 
-	body, err := QueryIPWhois(ctx, ipAddr)
-	resp := &Response{
-		Query: ipAddr,
-		Body:  cleanupWhois(body),
+// publicOnly is a net.Dialer Control function, which refuses to connect to anything but public
+// addresses. It's called after the host name is resolved, so it can't be avoided with a name that
+// resolves to an internal address.
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
 	}
+	addr, err := netip.ParseAddr(host)
 	if err != nil {
-		resp.Error = err.Error()
+		return err
+	}
+	if !isPublic(addr) {
+		return fmt.Errorf("refusing to connect to non-public address %s", addr)
 	}
+	return nil
+}
 
-	return resp
+// isPublic returns true if addr isn't a loopback, private, link-local, multicast or unspecified
+// address.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
 }
 
-// QueryWhois issues a WHOIS query to the given host.
-func queryWhoisWithClient(ctx context.Context, client *domainr.Client, query, host string) (string, error) {
+// stoppableConn stops the context.AfterFunc when closed.
+type stoppableConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *stoppableConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// Query issues a WHOIS query to the given host, which may include a port (defaulting to 43). If
+// ctx is canceled, the query is abandoned and ErrCanceled is returned, and if its deadline passes,
+// an error wrapping context.DeadlineExceeded.
+func (c *Client) Query(ctx context.Context, query, host string) (string, error) {
+	address := host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	} else {
+		address = net.JoinHostPort(host, "43")
+	}
 
 	if host == "whois.arin.net" {
 		// ARIN's whois servers will reply with "Query terms are ambiguous" if the query
@@ -163,43 +199,85 @@ func queryWhoisWithClient(ctx context.Context, client *domainr.Client, query, ho
 		return "", err
 	}
 
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	client := &domainr.Client{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return c.dial(ctx, network, address)
+		},
+	}
+
 	log.Infof("Whois request %q from %q", query, host)
 
-	response, err := client.Fetch(request)
+	response, err := client.FetchContext(ctx, request)
 	if err != nil {
+		err = contextError(ctx, err)
 		log.Warningf("Whois failed %q from %q: %s", query, host, err)
 		return "", err
 	}
 
 	log.Infof("Whois response %q from %q:\n%s", query, host, response)
-	return response.String(), err
+	return response.String(), nil
+}
+
+// withTimeout returns ctx with the Client's Timeout, or if it isn't set, and ctx has no deadline,
+// WhoisTimeout.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		if _, ok := ctx.Deadline(); ok {
+			return ctx, func() {}
+		}
+		timeout = WhoisTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError returns ErrCanceled, or context.DeadlineExceeded (with err's message), if err was
+// caused by ctx being done, or the connection timing out.
+func contextError(ctx context.Context, err error) error {
+	var netErr net.Error
+	switch ctxErr := ctx.Err(); {
+	case errors.Is(ctxErr, context.Canceled):
+		return ErrCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return err
+	case errors.Is(ctxErr, context.DeadlineExceeded) || deadlinePassed(ctx):
+		return fmt.Errorf("%s: %w", err, context.DeadlineExceeded)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%s: %w", err, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// deadlinePassed returns true if ctx's deadline has passed. The connection's deadline is set to the
+// same time, so it may time out before ctx notices.
+func deadlinePassed(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
 }
 
 // QueryWhois issues a WHOIS query to the given host.
 func QueryWhois(ctx context.Context, query, host string) (string, error) {
-	client := domainr.NewClient(WhoisTimeout)
-	return queryWhoisWithClient(ctx, client, query, host)
+	return DefaultClient.Query(ctx, query, host)
 }
 
-// QueryIPWhois issues two whois queries, the first to find the right whois server,
-// and the 2nd to that server.
-func QueryIPWhois(ctx context.Context, ipAddr string) (string, error) {
-	response, err := QueryWhois(ctx, ipAddr, ianaWhoisServer)
-	if err != nil {
-		return "", err
-	}
+// queries coalesces concurrent queries for the same address.
+var queries coalesce.Group[[]Hop]
 
-	// IANA returns a key value response with a "whois: ..." line to indicate the whois
-	// server for the owner of this IP range.
-	m, err := parseWhois(response)
+// QueryIPWhois asks IANA which whois server is responsible for the address, then follows the
+// referrals from there, with the DefaultClient. Concurrent queries for the same address share the
+// same queries.
+func QueryIPWhois(ctx context.Context, ipAddr string) ([]Hop, error) {
+	hops, shared, err := queries.Do(ctx, ipAddr, func(ctx context.Context) ([]Hop, error) {
+		return DefaultClient.QueryIP(ctx, ipAddr)
+	})
 	if err != nil {
-		return "", err
+		err = contextError(ctx, err)
 	}
-
-	host, found := m[whoisKey]
-	if !found {
-		return response, fmt.Errorf("no whois server found for %q", ipAddr)
+	if shared {
+		hops = slices.Clone(hops)
 	}
-
-	return QueryWhois(ctx, ipAddr, host)
+	return hops, err
 }
@@ -15,15 +15,25 @@
 package whois
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kylelemons/godebug/pretty"
 )
 
-func TestParseWhois(t *testing.T) {
+func TestParseObjects(t *testing.T) {
 	data := []struct {
 		query  string
 		want   string
@@ -40,48 +50,323 @@ func TestParseWhois(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to read test data %q: %s", test.result, err)
 		}
-		m, err := parseWhois(string(input))
-		if err != nil {
-			t.Errorf("parseWhois(%q) err: %q, want nil", test.result, err)
-			continue
+		got := ""
+		for _, o := range parseObjects(string(input)) {
+			if got = o.get("whois"); got != "" {
+				break
+			}
 		}
-		if m[whoisKey] != test.want {
-			t.Errorf("parseWhois(%q)[%q] = %q, want %q", test.result, whoisKey, m[whoisKey], test.want)
+		if got != test.want {
+			t.Errorf("parseObjects(%q).get(%q) = %q, want %q", test.result, "whois", got, test.want)
 		}
 	}
 
 }
 
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestCleanupWhois cleans each testdata/whois-*.txt, and compares it to the matching .golden file.
+// Run with -update to rewrite them.
 func TestCleanupWhois(t *testing.T) {
-	data := []struct {
-		input string
-		want  string
-	}{
-		{input: "whois-1.txt", want: "whois-1.txt"},
-		{input: "whois-2.txt", want: "whois-2.txt"},
-		{input: "whois-3.txt", want: "whois-3-clean.txt"},
-		{input: "whois-4.txt", want: "whois-4.txt"},
+	inputs, err := filepath.Glob(path.Join("testdata", "whois-*.txt"))
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("Failed to find test data: %v", err)
 	}
 
-	for _, test := range data {
-		input, err := os.ReadFile(path.Join("testdata", test.input))
+	for _, input := range inputs {
+		response, err := os.ReadFile(input)
 		if err != nil {
-			t.Fatalf("Failed to read test data %q: %s", test.input, err)
+			t.Fatalf("Failed to read test data %q: %s", input, err)
+		}
+
+		golden := strings.TrimSuffix(input, ".txt") + ".golden"
+		got := cleanupWhois(string(response))
+		if *update {
+			if err := os.WriteFile(golden, []byte(got+"\n"), 0644); err != nil {
+				t.Fatalf("Failed to write golden file %q: %s", golden, err)
+			}
 		}
 
-		want, err := os.ReadFile(path.Join("testdata", test.want))
+		want, err := os.ReadFile(golden)
 		if err != nil {
-			t.Fatalf("Failed to read test data %q: %s", test.want, err)
+			t.Fatalf("Failed to read golden file %q: %s", golden, err)
 		}
 
 		// A bit of a hack to trim, but avoids false positive due to IDEs adding newlines at the
 		// end of the test data.
-		wantStr := strings.TrimSpace(string(want))
+		if diff := pretty.Compare(got, strings.TrimSpace(string(want))); diff != "" {
+			t.Errorf("cleanupWhois(%q) diff (-got +want)\n%s", input, diff)
+		}
 
-		got := cleanupWhois(string(input))
-		if diff := pretty.Compare(got, wantStr); diff != "" {
-			t.Errorf("cleanupWhois(%q) diff (-got +want)\n%s", test.input, diff)
+		// It's already run until nothing changes, so running it again should do nothing.
+		if again := cleanupWhois(got); again != got {
+			t.Errorf("cleanupWhois(cleanupWhois(%q)) = %q, want %q", input, again, got)
 		}
 	}
+}
+
+func BenchmarkCleanupWhois(b *testing.B) {
+	response, err := os.ReadFile(path.Join("testdata", "whois-5.txt"))
+	if err != nil {
+		b.Fatalf("Failed to read test data: %s", err)
+	}
+	large := strings.Repeat(string(response), 1000)
 
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cleanupWhois(large)
+	}
+}
+
+// pipeDialer connects to an in-memory server, which is handled by serve.
+type pipeDialer struct {
+	serve func(address string, conn net.Conn)
+
+	mu    sync.Mutex
+	dials []string
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, address)
+	d.mu.Unlock()
+
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		d.serve(address, server)
+	}()
+	return client, nil
+}
+
+func TestClientQuery(t *testing.T) {
+	dialer := &pipeDialer{serve: func(_ string, conn net.Conn) {
+		query, _ := bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprintf(conn, "You asked for %s", query)
+	}}
+	client := &Client{Dialer: dialer}
+
+	got, err := client.Query(context.Background(), "192.0.2.1", "whois.arin.net")
+	if err != nil {
+		t.Fatalf("Query() err = %s", err)
+	}
+	if want := "You asked for n 192.0.2.1\r\n"; got != want {
+		t.Errorf("Query() = %q, want %q", got, want)
+	}
+	if diff := pretty.Compare(dialer.dials, []string{"whois.arin.net:43"}); diff != "" {
+		t.Errorf("Query() dials diff (-got +want)\n%s", diff)
+	}
+}
+
+func TestClientQueryCanceled(t *testing.T) {
+	// The server never answers.
+	hung := make(chan struct{})
+	defer close(hung)
+	client := &Client{Dialer: &pipeDialer{serve: func(_ string, conn net.Conn) {
+		io.Copy(io.Discard, conn)
+		<-hung
+	}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if _, err := client.Query(ctx, "192.0.2.1", "whois.example.net"); !errors.Is(err, ErrCanceled) {
+		t.Errorf("Query() with canceled ctx err = %v, want ErrCanceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Query(ctx, "192.0.2.1", "whois.example.net"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Query() past the deadline err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestClientWithTimeout(t *testing.T) {
+	// A deadline longer than WhoisTimeout is kept.
+	want := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), want)
+	defer cancel()
+
+	got, cancel := (&Client{}).withTimeout(ctx)
+	defer cancel()
+	if deadline, _ := got.Deadline(); !deadline.Equal(want) {
+		t.Errorf("withTimeout() deadline = %s, want %s", deadline, want)
+	}
+
+	// Unless the client has its own.
+	got, cancel = (&Client{Timeout: time.Second}).withTimeout(ctx)
+	defer cancel()
+	if deadline, _ := got.Deadline(); time.Until(deadline) > time.Second {
+		t.Errorf("withTimeout() with Timeout = 1s deadline = %s, want within 1s", deadline)
+	}
+}
+
+func TestContextErrorNetTimeout(t *testing.T) {
+	err := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	if got := contextError(context.Background(), err); !errors.Is(got, context.DeadlineExceeded) {
+		t.Errorf("contextError(%v) = %v, want context.DeadlineExceeded", err, got)
+	}
+	if got := contextError(context.Background(), io.EOF); got != io.EOF {
+		t.Errorf("contextError(io.EOF) = %v, want io.EOF", got)
+	}
+}
+
+func TestReferral(t *testing.T) {
+	data := []struct {
+		response string
+		want     string
+	}{
+		{response: "refer:        whois.apnic.net\nwhois:        whois.apnic.net\n", want: "whois://whois.apnic.net"},
+		{response: "ReferralServer:  whois://whois.ripe.net\n", want: "whois://whois.ripe.net"},
+		{response: "ReferralServer:  rwhois://rwhois.example.net:4321/\n", want: "rwhois://rwhois.example.net"},
+		{response: "ReferralServer:  whois://RWhois.Example.net:4321\n", want: "whois://rwhois.example.net:4321"},
+		{response: "ReferralServer:  rwhois://rwhois.example.net:43\n", want: "rwhois://rwhois.example.net:43"},
+		{response: "ReferralServer:  whois://203.0.113.1\n", want: "whois://203.0.113.1"},
+		{response: "%referral rwhois://rwhois.example.net:4321/auth-area=192.0.2.0/24\n", want: "rwhois://rwhois.example.net"},
+		{response: "network:Referral:rwhois://RWhois.Example.net:4321\n", want: "rwhois://rwhois.example.net"},
+		{response: "network:Network-Name:EXAMPLE\n", want: ""},
+
+		// Anything that could reach internal services is refused.
+		{response: "ReferralServer:  rwhois://rwhois.example.net:4322\n", want: ""},
+		{response: "ReferralServer:  whois://whois.example.net:6379\n", want: ""},
+		{response: "ReferralServer:  whois://127.0.0.1\n", want: ""},
+		{response: "ReferralServer:  rwhois://[::1]:4321\n", want: ""},
+		{response: "refer: 10.1.2.3\n", want: ""},
+		{response: "ReferralServer:  whois://169.254.169.254\n", want: ""},
+		{response: "ReferralServer:  whois://0.0.0.0\n", want: ""},
+		{response: "ReferralServer:  https://rdap.example.net\nwhois: whois.example.net\n", want: "whois://whois.example.net"},
+		{response: "NetName:        EXAMPLE\n", want: ""},
+	}
+
+	for _, test := range data {
+		got := ""
+		if srv, found := referral(test.response); found {
+			got = srv.String()
+		}
+		if got != test.want {
+			t.Errorf("referral(%q) = %q, want %q", test.response, got, test.want)
+		}
+	}
+}
+
+func TestClientDialPublicOnly(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() err: %s", err)
+	}
+	defer l.Close()
+
+	// Host names are checked after they're resolved.
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	for _, address := range []string{l.Addr().String(), net.JoinHostPort("localhost", port)} {
+		conn, err := (&Client{}).dial(context.Background(), "tcp", address)
+		if err == nil {
+			conn.Close()
+			t.Errorf("dial(%q) err = nil, want an error", address)
+		} else if !strings.Contains(err.Error(), "non-public") {
+			t.Errorf("dial(%q) err = %s, want a non-public address error", address, err)
+		}
+	}
+}
+
+func TestQueryRWhoisNotRWhois(t *testing.T) {
+	client := &Client{Dialer: &pipeDialer{serve: func(_ string, conn net.Conn) {
+		io.WriteString(conn, "+OK Redis secret-banner\r\n")
+	}}}
+
+	_, err := client.QueryRWhois(context.Background(), "192.0.2.1", "rwhois.example.net:4321")
+	if err == nil || strings.Contains(err.Error(), "secret-banner") {
+		t.Errorf("QueryRWhois() err = %v, want an error without the banner", err)
+	}
+}
+
+// fakeServers answers whois and rwhois queries from responses, keyed by address.
+func fakeServers(responses map[string]string) *pipeDialer {
+	return &pipeDialer{serve: func(address string, conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if strings.HasSuffix(address, ":"+rwhoisPort) {
+			fmt.Fprintf(conn, "%%rwhois V-1.5:003fff:00 %s\r\n", address)
+			r.ReadString('\n')
+			fmt.Fprintf(conn, "%s%%ok\r\n", responses[address])
+			return
+		}
+		r.ReadString('\n')
+		io.WriteString(conn, responses[address])
+	}}
+}
+
+func TestClientQueryIP(t *testing.T) {
+	dialer := fakeServers(map[string]string{
+		"whois.iana.org:43":       "refer: whois.arin.net\n",
+		"whois.arin.net:43":       "NetName: ARIN-NET\nReferralServer: rwhois://rwhois.example.net:4321\n",
+		"rwhois.example.net:4321": "network:Network-Name:CUSTOMER-NET\nnetwork:Referral:rwhois://rwhois.example.net:4321\n",
+	})
+	client := &Client{Dialer: dialer}
+
+	hops, err := client.QueryIP(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatalf("QueryIP() err = %s", err)
+	}
+
+	want := []Hop{
+		{Server: "whois://whois.iana.org", Body: "refer: whois.arin.net"},
+		{Server: "whois://whois.arin.net", Body: "NetName: ARIN-NET\nReferralServer: rwhois://rwhois.example.net:4321"},
+		// The rwhois server refers back to itself, which ends the chain.
+		{Server: "rwhois://rwhois.example.net", Body: "network:Network-Name:CUSTOMER-NET\nnetwork:Referral:rwhois://rwhois.example.net:4321"},
+	}
+	if diff := pretty.Compare(hops, want); diff != "" {
+		t.Errorf("QueryIP() diff (-got +want)\n%s", diff)
+	}
+	if got := mostSpecific(hops); !strings.Contains(got, "CUSTOMER-NET") {
+		t.Errorf("mostSpecific() = %q, want the rwhois response", got)
+	}
+
+	// Only follow one referral.
+	client.MaxReferrals = 1
+	if hops, err := client.QueryIP(context.Background(), "192.0.2.1"); err != nil || len(hops) != 2 {
+		t.Errorf("QueryIP() with MaxReferrals = 1 = %d hops, %v, want 2 hops", len(hops), err)
+	}
+}
+
+func TestClientQueryIPLoop(t *testing.T) {
+	dialer := fakeServers(map[string]string{
+		"whois.iana.org:43":         "refer: whois.arin.net\n",
+		"whois.arin.net:43":         "NetName: ARIN-NET\nReferralServer: rwhois://rwhois-a.example.net:4321\n",
+		"rwhois-a.example.net:4321": "%referral rwhois://rwhois-b.example.net:4321/auth-area=192.0.2.0/24\n",
+		"rwhois-b.example.net:4321": "%referral rwhois://rwhois-a.example.net:4321/auth-area=192.0.2.0/24\n",
+	})
+	// Enough referrals that only the loop ends the chain.
+	client := &Client{Dialer: dialer, MaxReferrals: 10}
+
+	hops, err := client.QueryIP(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatalf("QueryIP() err = %s", err)
+	}
+
+	var servers []string
+	for _, hop := range hops {
+		servers = append(servers, hop.Server)
+	}
+	want := []string{"whois://whois.iana.org", "whois://whois.arin.net", "rwhois://rwhois-a.example.net", "rwhois://rwhois-b.example.net"}
+	if diff := pretty.Compare(servers, want); diff != "" {
+		t.Errorf("QueryIP() servers diff (-got +want)\n%s", diff)
+	}
+	if got := len(dialer.dials); got != len(want) {
+		t.Errorf("QueryIP() dialed %d times, want %d", got, len(want))
+	}
+}
+
+func TestClientQueryIPNoReferral(t *testing.T) {
+	client := &Client{Dialer: fakeServers(map[string]string{
+		"whois.iana.org:43": "% no referral here\n",
+	})}
+
+	hops, err := client.QueryIP(context.Background(), "192.0.2.1")
+	if err == nil || len(hops) != 1 {
+		t.Errorf("QueryIP() = %d hops, %v, want 1 hop and an error", len(hops), err)
+	}
+	if got := mostSpecific(hops); got != "% no referral here" {
+		t.Errorf("mostSpecific() = %q, want IANA's response", got)
+	}
 }
@@ -27,14 +27,70 @@ myipApp.controller('MyIPController', function MyIPController($scope, $http, $loc
     var host = $location.search().host;
     $scope.addresses = [];
 
+    // The Response field filled in by each event from /events.
+    var EVENT_FIELDS = {
+        "reverse": "RemoteAddrReverse",
+        "rdap": "RemoteAddrRDAP",
+        "whois": "RemoteAddrWhois",
+        "origin": "RemoteAddrOrigin",
+        "abuse": "RemoteAddrAbuseContact",
+        "cache": "RemoteAddrCache",
+        "location": "Location",
+        "ua": "UserAgent"
+    };
+
     Object.keys(SERVERS).forEach(function(family) {
         var server = SERVERS[family];
-        var url = $location.protocol() + "://" + server + '/json?family=' + family;
+        var query = '?family=' + family;
 
         if (host) {
-            url = url + "&host=" + host
+            query = query + "&host=" + host
+        }
+
+        if (window.EventSource) {
+            stream($location.protocol() + "://" + server + '/events' + query, family);
+        } else {
+            load($location.protocol() + "://" + server + '/json' + query, family);
         }
+    });
+
+    // stream shows the address as soon as it's known, then fills in each lookup as it finishes.
+    // If the stream fails before the address arrives, it falls back to load.
+    function stream(url, family) {
+        var source = new EventSource(url);
+        var address = null;
+
+        source.addEventListener("response", function(e) {
+            $scope.$apply(function() {
+                address = JSON.parse(e.data);
+                $scope.addresses.push(address);
+            });
+        });
+
+        Object.keys(EVENT_FIELDS).forEach(function(event) {
+            source.addEventListener(event, function(e) {
+                if (!address) return;
+                $scope.$apply(function() {
+                    address[EVENT_FIELDS[event]] = JSON.parse(e.data);
+                });
+            });
+        });
+
+        source.addEventListener("done", function() {
+            source.close();
+        });
+
+        // Both connection errors, and the server's "error" event, end up here.
+        source.addEventListener("error", function() {
+            source.close();
+            if (!address) {
+                load(url.replace('/events?', '/json?'), family);
+            }
+        });
+    }
 
+    // load gets the whole response at once, after all the lookups have finished.
+    function load(url, family) {
         $http.get(url).then(function success(response) {
             $scope.addresses.push(response.data);
 
@@ -53,7 +109,42 @@ myipApp.controller('MyIPController', function MyIPController($scope, $http, $loc
                 "Error": errorText
             });
         });
-    });
+    }
+
+    if (LEAK_DOMAIN) {
+        leakTest();
+    }
+
+    // leakTest looks up a unique name in our DNS zone, and then asks the server which recursive
+    // resolvers looked it up. This shows if DNS queries are leaking around a VPN.
+    function leakTest() {
+        var nonce = randomNonce();
+        $scope.leak = {"Loading": true};
+
+        // The name doesn't exist, so this always fails, but only after the browser has asked
+        // its resolvers.
+        var url = $location.protocol() + "://" + nonce + "." + LEAK_DOMAIN + "/";
+        $http.get(url).catch(angular.noop).then(function() {
+            return $http.get("resolver/" + nonce);
+
+        }).then(function success(response) {
+            $scope.leak = response.data;
+
+        }, function error(response) {
+            $scope.leak = {
+                "Error": response["status"] + ": " + (response["statusText"] || "unknown error")
+            };
+        });
+    }
+
+    // randomNonce returns 32 random lower case hex digits.
+    function randomNonce() {
+        var bytes = new Uint8Array(16);
+        window.crypto.getRandomValues(bytes);
+        return Array.prototype.map.call(bytes, function(b) {
+            return ("0" + b.toString(16)).slice(-2);
+        }).join("");
+    }
 });
 
 myipApp.filter('firstWord', function firstWord($filter) {
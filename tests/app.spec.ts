@@ -26,6 +26,9 @@ test.describe('What\'s My IP App', () => {
         body: JSON.stringify(MOCK_DATA),
       });
     });
+
+    // Fail the /events stream, so the app falls back to the mocked /json.
+    await page.route(url => url.pathname.endsWith('/events'), route => route.abort('failed'));
   });
 
   test('should load the home page and show the title', async ({ page }) => {
@@ -211,6 +214,32 @@ test.describe('What\'s My IP App', () => {
     await expect(ipv6Card).toContainText('Unknown Error - This means you either do not have a IPv6 address, or something else went wrong');
   });
 
+  test('should fill in the lookups streamed from /events', async ({ page }) => {
+    const { RemoteAddrReverse, UserAgent, Location, ...base } = MOCK_DATA;
+    const event = (name: string, data: unknown) => `event: ${name}\ndata: ${JSON.stringify(data)}\n\n`;
+
+    await page.route(url => url.pathname.endsWith('/events'), async route => {
+      await route.fulfill({
+        status: 200,
+        contentType: 'text/event-stream',
+        body: event('response', base) +
+              event('reverse', RemoteAddrReverse) +
+              event('whois', { "Body": "streamed whois text" }) +
+              event('ua', UserAgent) +
+              event('location', Location) +
+              event('done', {}),
+      });
+    });
+
+    await page.goto('/');
+    const card = page.locator('.card').first();
+    await expect(card).toContainText('1.2.3.4');
+    await card.locator('button.btn-outline-light').click();
+
+    await expect(card.locator('pre', { hasText: 'streamed whois text' })).toBeVisible();
+    await expect(card).toContainText('test.example.com');
+  });
+
   test('should have a working /json endpoint (integration)', async ({ request }) => {
     // This tests the real backend (not mocked via page.route)
     const response = await request.get('/json');
@@ -218,4 +247,38 @@ test.describe('What\'s My IP App', () => {
     const data = await response.json();
     expect(data).toHaveProperty('RemoteAddr');
   });
+
+  test('should show the resolvers seen by the leak test', async ({ page }) => {
+    await page.route(url => url.pathname.endsWith('/config.js'), async route => {
+      await route.fulfill({
+        status: 200,
+        contentType: 'text/javascript',
+        body: 'var VERSION = ""; var BUILDTIME = ""; var MAIN_HOST = "127.0.0.1:8080";' +
+              ' var SERVERS = {"IPv4": "127.0.0.1:8080"}; var LEAK_DOMAIN = "leak.whoami.example.net";',
+      });
+    });
+
+    // The leak test name never resolves.
+    await page.route(url => url.hostname.endsWith('.leak.whoami.example.net'), route => route.abort('namenotresolved'));
+
+    await page.route(url => url.pathname.startsWith('/resolver/'), async route => {
+      await route.fulfill({
+        status: 200,
+        contentType: 'application/json',
+        body: JSON.stringify({
+          "Nonce": route.request().url().split('/').pop(),
+          "Resolvers": [
+            { "Addr": "8.8.8.8", "Reverse": { "Names": ["dns.google."] }, "Org": "Google LLC", "Country": "US" }
+          ]
+        }),
+      });
+    });
+
+    await page.goto('/');
+    const leak = page.locator('#leak');
+    await expect(leak).toBeVisible();
+    await expect(leak).toContainText('8.8.8.8');
+    await expect(leak).toContainText('dns.google.');
+    await expect(leak).toContainText('Google LLC');
+  });
 });